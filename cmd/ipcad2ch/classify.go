@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/inkuber/ipcad2ch/pkg/classifier"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+// ExplainFlags registers flags of classify subcommand
+func ExplainFlags() {
+	flag.String("src", "", "Source IP")
+	flag.String("dst", "", "Destination IP")
+	flag.Uint("sport", 0, "Source port")
+	flag.Uint("dport", 0, "Destination port")
+	flag.Uint("proto", 0, "Protocol number")
+	flag.String("iface", "", "Interface")
+	flag.String("time", "", "Collected time, RFC3339, now by default")
+}
+
+func flagValue(name string) string {
+	return flag.Lookup(name).Value.String()
+}
+
+func flagUint(name string, bits int) uint64 {
+	value, err := strconv.ParseUint(flagValue(name), 10, bits)
+	if err != nil {
+		log.Fatal(fmt.Sprintf("Could not parse %s %v", name, err))
+	}
+
+	return value
+}
+
+// Explain loads classifier and prints decisions made for flow set by flags
+func Explain(cfg Config) {
+	src := net.ParseIP(flagValue("src"))
+	dst := net.ParseIP(flagValue("dst"))
+	if src == nil || dst == nil {
+		log.Fatal("Both --src and --dst IP should be set")
+	}
+
+	collected := time.Now()
+	if value := flagValue("time"); value != "" {
+		var err error
+		collected, err = time.Parse(time.RFC3339, value)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	c := classifier.NewClassifier(cfg.Classifier)
+
+	e := classifier.Entry{
+		SrcIP:     src,
+		DstIP:     dst,
+		SrcPort:   uint16(flagUint("sport", 16)),
+		DstPort:   uint16(flagUint("dport", 16)),
+		Proto:     uint8(flagUint("proto", 8)),
+		Iface:     flagValue("iface"),
+		Exporter:  cfg.Ipcad.Exporter,
+		Collected: collected,
+	}
+
+	trace := c.Explain(&e)
+
+	fmt.Printf("Flow: %s:%d -> %s:%d proto %d iface %q exporter %q at %s\n",
+		e.SrcIP, e.SrcPort, e.DstIP, e.DstPort, e.Proto, e.Iface, e.Exporter, e.Collected.Format(time.RFC3339))
+
+	for _, step := range trace.Steps {
+		fmt.Println("  " + step)
+	}
+
+	fmt.Printf("Dir: %s\nClass: %s\nUser: %s\nService: %s\nRemote ASN: %d\n", e.Dir, e.Class, e.UserID, e.Service, e.RemoteASN)
+
+	if mirror, ok := c.Mirror(&e); ok {
+		fmt.Printf("Mirror: dir %s user %s\n", mirror.Dir, mirror.UserID)
+	}
+}
@@ -6,12 +6,21 @@ import (
 	"fmt"
 	"github.com/inkuber/ipcad2ch/pkg/classifier"
 	"github.com/inkuber/ipcad2ch/pkg/clickhouse"
+	"github.com/inkuber/ipcad2ch/pkg/filter"
+	"github.com/inkuber/ipcad2ch/pkg/geoip"
 	"github.com/inkuber/ipcad2ch/pkg/ipcad"
+	"github.com/inkuber/ipcad2ch/pkg/metrics"
+	"github.com/inkuber/ipcad2ch/pkg/rating"
+	"github.com/inkuber/ipcad2ch/pkg/worker"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
+	"io"
 	"log"
 	"os"
+	"os/signal"
+	"runtime"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -20,9 +29,17 @@ type Config struct {
 	File   string `mapstructure:"file"`
 	Buffer int    `mapstructure:"buffer"`
 
+	// Load input already recorded in loads journal
+	Force bool `mapstructure:"force"`
+
 	Ipcad      ipcad.Config
 	Clickhouse clickhouse.Config
 	Classifier classifier.Config
+	GeoIP      geoip.Config
+	Metrics    metrics.Config
+	Workers    worker.Config
+	Rating     rating.Config
+	Filters    []filter.Config
 }
 
 func ParseConfig() Config {
@@ -35,9 +52,12 @@ func ParseConfig() Config {
 	flag.String("config", "", "Config file")
 	flag.String("file", "stdin", "Read IPCAD from file")
 	flag.String("ipcad.collected", "", "Collected time")
+	flag.String("exporter", "", "Exporter name")
+	flag.Bool("force", false, "Load input already recorded in loads journal")
 	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
 	pflag.Parse()
 	v.BindPFlags(pflag.CommandLine)
+	v.BindPFlag("Ipcad::Exporter", pflag.Lookup("exporter"))
 
 	config := v.GetString("config")
 
@@ -58,21 +78,46 @@ func ParseConfig() Config {
 	}
 
 	v.SetDefault("Clickhouse::Bunch", 100000)
+	v.SetDefault("Clickhouse::UnclassifiedTop", 20)
+	v.SetDefault("Clickhouse::Privacy::Prefix", 24)
+	v.SetDefault("Clickhouse::Privacy::Settle", 24*time.Hour)
+	v.SetDefault("Clickhouse::Spool::Retries", 3)
+	v.SetDefault("Clickhouse::Spool::Backoff", time.Second)
 	v.SetDefault("Buffer", 100)
-
-	t := time.Now()
-	v.SetDefault("Ipcad::Collected", t.Format(time.RFC3339))
+	v.SetDefault("Workers::Count", runtime.NumCPU())
+	v.SetDefault("Classifier::Cache", 100000)
+	v.SetDefault("Classifier::Users::FollowSessions", 10*time.Second)
 
 	v.SetDefault("Classifier::Users::Fetch::Comma", ";")
 	v.SetDefault("Classifier::Users::Fetch::IDField", 0)
 	v.SetDefault("Classifier::Users::Fetch::CIDRField", 1)
+	v.SetDefault("Classifier::Users::Fetch::Timeout", 30*time.Second)
+	v.SetDefault("Classifier::Users::Fetch::Retries", 3)
+	v.SetDefault("Classifier::Users::Fetch::Backoff", time.Second)
 
 	v.SetDefault("Classifier::Networks::Fetch::Comma", ";")
 	v.SetDefault("Classifier::Networks::Fetch::CIDRField", 0)
 	v.SetDefault("Classifier::Networks::Fetch::ClassField", 1)
+	v.SetDefault("Classifier::Networks::Fetch::Timeout", 30*time.Second)
+	v.SetDefault("Classifier::Networks::Fetch::Retries", 3)
+	v.SetDefault("Classifier::Networks::Fetch::Backoff", time.Second)
+
+	v.SetDefault("Classifier::Special::Bogons::Timeout", 30*time.Second)
+	v.SetDefault("Classifier::Special::Bogons::Retries", 3)
+	v.SetDefault("Classifier::Special::Bogons::Backoff", time.Second)
 
 	v.Unmarshal(&cfg)
 
+	// SQL dictionaries are queried from clickhouse section connection by default,
+	// DSN with password is set only when query is configured
+	if cfg.Classifier.Users.SQL.Query != "" && cfg.Classifier.Users.SQL.DSN == "" && cfg.Classifier.Users.SQL.Driver == "" {
+		cfg.Classifier.Users.SQL.DSN = clickhouse.DSN(cfg.Clickhouse)
+	}
+
+	if cfg.Classifier.Networks.SQL.Query != "" && cfg.Classifier.Networks.SQL.DSN == "" && cfg.Classifier.Networks.SQL.Driver == "" {
+		cfg.Classifier.Networks.SQL.DSN = clickhouse.DSN(cfg.Clickhouse)
+	}
+
 	b, err := json.MarshalIndent(cfg, "", "    ")
 	if err != nil {
 		log.Fatal(err)
@@ -87,6 +132,14 @@ func ParseConfig() Config {
 
 func main() {
 
+	// Subcommand explains classification of one flow
+	if len(os.Args) > 1 && os.Args[1] == "classify" {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+		ExplainFlags()
+		Explain(ParseConfig())
+		return
+	}
+
 	cfg := ParseConfig()
 
 	in := os.Stdin
@@ -98,18 +151,95 @@ func main() {
 		in = f
 	}
 
+	var input io.Reader = in
+
+	// Regular file is hashed before it is read to refuse already loaded one,
+	// stream is hashed while it is read and identified by collected time
+	var load *clickhouse.Load
+	if cfg.Clickhouse.Loads.Journal {
+		info, err := in.Stat()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		hash := ""
+		var hasher *ipcad.Hasher
+		if info.Mode().IsRegular() {
+			hash, err = ipcad.Hash(in)
+			if err != nil {
+				log.Fatal(err)
+			}
+		} else {
+			hasher = ipcad.NewHasher(in)
+		}
+
+		load, err = clickhouse.NewLoad(fmt.Sprintf("%s:%s", cfg.Ipcad.Exporter, cfg.File), cfg.Ipcad.Exporter, cfg.Ipcad.Collected, hash)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if hasher != nil {
+			load.Sum = hasher.Sum
+			input = hasher
+			log.Println(fmt.Sprintf("Load %s of stream collected at %s", load.ID, load.Collected.Format(time.RFC3339)))
+
+			if cfg.Ipcad.Collected == "" {
+				log.Println("WARNING: Stream without --ipcad.collected gets new load id every run, already loaded stream is never refused")
+			}
+		} else {
+			log.Println(fmt.Sprintf("Load %s of content %s", load.ID, hash))
+		}
+
+		loaded, err := clickhouse.CheckLoad(cfg.Clickhouse, load)
+		if err != nil {
+			if cfg.Clickhouse.Spool.Dir == "" {
+				log.Fatal(err)
+			}
+			log.Println(fmt.Sprintf("Could not check loads journal: %v", err))
+		}
+
+		if loaded && !cfg.Force {
+			log.Println(fmt.Sprintf("Load %s is already loaded, use --force to load it again", load.ID))
+			metrics.Add("ipcad2ch_refused_loads_total", 1)
+			metrics.Write(cfg.Metrics)
+			return
+		}
+	}
+
 	var wg sync.WaitGroup
 
-	classifier := classifier.NewClassifier(cfg.Classifier)
+	c := classifier.NewClassifier(cfg.Classifier)
+	enricher := geoip.NewEnricher(cfg.GeoIP)
+	rater := rating.NewRater(cfg.Rating)
+	filters := filter.NewSet(cfg.Filters)
+
+	// Dictionaries are reloaded on SIGHUP without stopping long running pipe
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Println("Reloading classifier dictionaries")
+			c.Reload()
+		}
+	}()
+
+	go c.FollowSessions(cfg.Classifier.Users.FollowSessions)
 
 	entries := make(chan *ipcad.Entry, cfg.Buffer)
 	log.Println(fmt.Sprintf("entries [len=%d cap=%d]", len(entries), cap(entries)))
 
+	classified := make(chan *classifier.Entry, cfg.Buffer)
+
+	wg.Add(1)
+	go ipcad.Read(&wg, cfg.Ipcad, input, entries)
+
 	wg.Add(1)
-	go ipcad.Read(&wg, cfg.Ipcad, in, entries)
+	go worker.Classify(&wg, cfg.Workers, c, enricher, filters, entries, classified)
 
 	wg.Add(1)
-	go clickhouse.Write(&wg, cfg.Clickhouse, classifier, entries)
+	go clickhouse.Write(&wg, cfg.Clickhouse, c, rater, load, classified)
 
 	wg.Wait()
+
+	metrics.Write(cfg.Metrics)
 }
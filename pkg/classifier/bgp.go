@@ -0,0 +1,417 @@
+package classifier
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+BGPConfig describes one routing table used as networks source
+
+	BGPConfig {
+	  Format: Routing table format: mrt (TABLE_DUMP_V2), bird (show route all)
+	  File: Path to routing table dump
+
+	  PeerASNs: Routes learned from these neighbour ASNs are peering
+	  Communities: Routes tagged with these communities are peering,
+	               format "65000:100" or large "65000:1:100"
+	}
+*/
+type BGPConfig struct {
+	Format      string   `mapstructure:"format"`
+	File        string   `mapstructure:"file"`
+	PeerASNs    []uint32 `mapstructure:"peerASNs"`
+	Communities []string `mapstructure:"communities"`
+}
+
+// Route is a BGP route read from routing table dump
+type Route struct {
+	Prefix      net.IPNet
+	PeerASN     uint32
+	ASPath      []uint32
+	Communities []string
+}
+
+// Origin returns ASN originated the route, 0 for locally originated routes
+func (r Route) Origin() uint32 {
+	if len(r.ASPath) == 0 {
+		return 0
+	}
+
+	return r.ASPath[len(r.ASPath)-1]
+}
+
+// RouteInfo is value stored in classifier routes trie
+type RouteInfo struct {
+	Origin  uint32
+	Peering bool
+	Source  string
+}
+
+var (
+	mrtTableDumpV2     uint16 = 13
+	mrtPeerIndexTable  uint16 = 1
+	mrtRIBIPv4Unicast  uint16 = 2
+	bgpAttrASPath      uint8  = 2
+	bgpAttrCommunities uint8  = 8
+	bgpAttrLargeComm   uint8  = 32
+	bgpASSet           uint8  = 1
+)
+
+func (c *Classifier) readBGP(cfg BGPConfig) error {
+	log.Println(fmt.Sprintf("Reading %s routes from file %s", cfg.Format, cfg.File))
+
+	f, err := os.Open(cfg.File)
+	if err != nil {
+		return fmt.Errorf("could not read routes: %v", err)
+	}
+	defer f.Close()
+
+	peers := make(map[uint32]bool)
+	for _, asn := range cfg.PeerASNs {
+		peers[asn] = true
+	}
+
+	communities := make(map[string]bool)
+	for _, community := range cfg.Communities {
+		communities[community] = true
+	}
+
+	routes, peering := 0, 0
+	source := fmt.Sprintf("bgp %s file %s", cfg.Format, cfg.File)
+
+	// Paths of one prefix come in a row, prefix is peering if any path is
+	var last *net.IPNet
+	var info RouteInfo
+	insert := func() {
+		if last != nil && c.Routes.Insert(*last, info) {
+			routes = routes + 1
+			if info.Peering {
+				peering = peering + 1
+			}
+		}
+	}
+
+	handle := func(r Route) {
+		if last == nil || !last.IP.Equal(r.Prefix.IP) || last.Mask.String() != r.Prefix.Mask.String() {
+			insert()
+			prefix := r.Prefix
+			last = &prefix
+			info = RouteInfo{Origin: r.Origin(), Source: source}
+		}
+
+		peer := peers[r.PeerASN] || (len(r.ASPath) > 0 && peers[r.ASPath[0]])
+		for _, community := range r.Communities {
+			if communities[community] {
+				peer = true
+			}
+		}
+
+		if peer && !info.Peering {
+			info = RouteInfo{Origin: r.Origin(), Peering: true, Source: source}
+		}
+	}
+
+	switch cfg.Format {
+	case "mrt":
+		err = ParseMRT(f, handle)
+	case "bird":
+		err = ParseBird(f, handle)
+	default:
+		err = fmt.Errorf("unknown routes format %s", cfg.Format)
+	}
+
+	if err != nil {
+		return fmt.Errorf("could not parse routes %s: %v", cfg.File, err)
+	}
+
+	insert()
+
+	// Empty table of wrong format or failed dump would make all traffic internet
+	if routes == 0 {
+		return fmt.Errorf("no routes found in %s", cfg.File)
+	}
+
+	log.Println(fmt.Sprintf("Parsed %d routes, %d peering", routes, peering))
+
+	return nil
+}
+
+// ParseMRT reads MRT TABLE_DUMP_V2 IPv4 unicast RIB entries, one route per RIB entry
+func ParseMRT(in io.Reader, handle func(Route)) error {
+	r := bufio.NewReader(in)
+
+	var peers []uint32
+	header := make([]byte, 12)
+	for {
+		_, err := io.ReadFull(r, header)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		mrtType := binary.BigEndian.Uint16(header[4:6])
+		subtype := binary.BigEndian.Uint16(header[6:8])
+		length := binary.BigEndian.Uint32(header[8:12])
+
+		body := make([]byte, length)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return err
+		}
+
+		if mrtType != mrtTableDumpV2 {
+			continue
+		}
+
+		switch subtype {
+		case mrtPeerIndexTable:
+			peers, err = parseMRTPeers(body)
+		case mrtRIBIPv4Unicast:
+			err = parseMRTRIB(body, peers, handle)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+var errMRTShort = errors.New("mrt record is too short")
+
+func parseMRTPeers(b []byte) ([]uint32, error) {
+	if len(b) < 6 {
+		return nil, errMRTShort
+	}
+
+	viewLen := int(binary.BigEndian.Uint16(b[4:6]))
+	b = b[6:]
+	if len(b) < viewLen+2 {
+		return nil, errMRTShort
+	}
+	b = b[viewLen:]
+
+	count := int(binary.BigEndian.Uint16(b[0:2]))
+	b = b[2:]
+
+	peers := make([]uint32, 0, count)
+	for i := 0; i < count; i++ {
+		if len(b) < 1 {
+			return nil, errMRTShort
+		}
+
+		peerType := b[0]
+		ipLen, asLen := 4, 2
+		if peerType&0x1 != 0 {
+			ipLen = 16
+		}
+		if peerType&0x2 != 0 {
+			asLen = 4
+		}
+
+		size := 1 + 4 + ipLen + asLen
+		if len(b) < size {
+			return nil, errMRTShort
+		}
+
+		as := b[size-asLen : size]
+		if asLen == 4 {
+			peers = append(peers, binary.BigEndian.Uint32(as))
+		} else {
+			peers = append(peers, uint32(binary.BigEndian.Uint16(as)))
+		}
+
+		b = b[size:]
+	}
+
+	return peers, nil
+}
+
+func parseMRTRIB(b []byte, peers []uint32, handle func(Route)) error {
+	if len(b) < 5 {
+		return errMRTShort
+	}
+
+	bits := int(b[4])
+	size := (bits + 7) / 8
+	if bits > 32 || len(b) < 5+size+2 {
+		return errMRTShort
+	}
+
+	ip := make(net.IP, 4)
+	copy(ip, b[5:5+size])
+	prefix := net.IPNet{IP: ip, Mask: net.CIDRMask(bits, 32)}
+
+	b = b[5+size:]
+	count := int(binary.BigEndian.Uint16(b[0:2]))
+	b = b[2:]
+
+	for i := 0; i < count; i++ {
+		if len(b) < 8 {
+			return errMRTShort
+		}
+
+		peerIndex := int(binary.BigEndian.Uint16(b[0:2]))
+		attrLen := int(binary.BigEndian.Uint16(b[6:8]))
+		if len(b) < 8+attrLen {
+			return errMRTShort
+		}
+
+		route := Route{Prefix: prefix}
+		if peerIndex < len(peers) {
+			route.PeerASN = peers[peerIndex]
+		}
+
+		if err := parseBGPAttributes(b[8:8+attrLen], &route); err != nil {
+			return err
+		}
+
+		handle(route)
+		b = b[8+attrLen:]
+	}
+
+	return nil
+}
+
+func parseBGPAttributes(b []byte, route *Route) error {
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return errMRTShort
+		}
+
+		flags, attrType := b[0], b[1]
+		offset, length := 3, int(b[2])
+
+		// Extended length flag
+		if flags&0x10 != 0 {
+			if len(b) < 4 {
+				return errMRTShort
+			}
+			offset, length = 4, int(binary.BigEndian.Uint16(b[2:4]))
+		}
+
+		if len(b) < offset+length {
+			return errMRTShort
+		}
+
+		value := b[offset : offset+length]
+		switch attrType {
+		case bgpAttrASPath:
+			// TABLE_DUMP_V2 always uses 4 byte ASNs
+			for len(value) >= 2 {
+				segType, segLen := value[0], int(value[1])
+				if len(value) < 2+segLen*4 {
+					return errMRTShort
+				}
+
+				for j := 0; j < segLen; j++ {
+					asn := binary.BigEndian.Uint32(value[2+j*4:])
+					route.ASPath = append(route.ASPath, asn)
+
+					// AS_SET is counted as one hop
+					if segType == bgpASSet {
+						break
+					}
+				}
+				value = value[2+segLen*4:]
+			}
+		case bgpAttrCommunities:
+			for j := 0; j+4 <= len(value); j += 4 {
+				route.Communities = append(route.Communities, fmt.Sprintf("%d:%d",
+					binary.BigEndian.Uint16(value[j:]), binary.BigEndian.Uint16(value[j+2:])))
+			}
+		case bgpAttrLargeComm:
+			for j := 0; j+12 <= len(value); j += 12 {
+				route.Communities = append(route.Communities, fmt.Sprintf("%d:%d:%d",
+					binary.BigEndian.Uint32(value[j:]), binary.BigEndian.Uint32(value[j+4:]), binary.BigEndian.Uint32(value[j+8:])))
+			}
+		}
+
+		b = b[offset+length:]
+	}
+
+	return nil
+}
+
+// ParseBird reads BIRD "show route all" output, one route per path
+func ParseBird(in io.Reader, handle func(Route)) error {
+	scanner := bufio.NewScanner(in)
+
+	var prefix *net.IPNet
+	var route *Route
+
+	flush := func() {
+		if route != nil {
+			if len(route.ASPath) > 0 {
+				route.PeerASN = route.ASPath[0]
+			}
+			handle(*route)
+			route = nil
+		}
+	}
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			continue
+		}
+
+		fields := strings.Fields(trimmed)
+
+		// New prefix starts at the beginning of line, alternative paths are indented
+		if line[0] != ' ' && line[0] != '\t' {
+			if _, network, err := net.ParseCIDR(fields[0]); err == nil {
+				flush()
+				prefix = network
+				if network.IP.To4() != nil {
+					route = &Route{Prefix: *network}
+				}
+			}
+			continue
+		}
+
+		// Alternative path line has protocol name in brackets, next hop lines not
+		if (fields[0] == "unicast" || fields[0] == "via") && strings.Contains(trimmed, "[") {
+			flush()
+			if prefix != nil && prefix.IP.To4() != nil {
+				route = &Route{Prefix: *prefix}
+			}
+			continue
+		}
+
+		if route == nil {
+			continue
+		}
+
+		switch fields[0] {
+		case "BGP.as_path:":
+			for _, f := range fields[1:] {
+				asn, err := strconv.ParseUint(strings.Trim(f, "{}"), 10, 32)
+				if err != nil {
+					return fmt.Errorf("invalid AS path %q of %s", strings.Join(fields[1:], " "), route.Prefix.String())
+				}
+				route.ASPath = append(route.ASPath, uint32(asn))
+			}
+		case "BGP.community:", "BGP.large_community:":
+			value := strings.Join(fields[1:], "")
+			for _, community := range strings.Split(value, ")(") {
+				community = strings.Trim(community, "()")
+				route.Communities = append(route.Communities, strings.Replace(community, ",", ":", -1))
+			}
+		}
+	}
+
+	flush()
+
+	return scanner.Err()
+}
@@ -0,0 +1,155 @@
+package classifier
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func mrtRecord(subtype uint16, body []byte) []byte {
+	header := make([]byte, 12)
+	binary.BigEndian.PutUint16(header[4:6], mrtTableDumpV2)
+	binary.BigEndian.PutUint16(header[6:8], subtype)
+	binary.BigEndian.PutUint32(header[8:12], uint32(len(body)))
+	return append(header, body...)
+}
+
+func TestShouldParseMRT(t *testing.T) {
+	// Peer index table: collector id, empty view, two AS4 IPv4 peers
+	peers := []byte{10, 0, 0, 1, 0, 0, 0, 2}
+	peers = append(peers, 0x2, 10, 0, 0, 2, 10, 0, 0, 2, 0, 0, 0xfd, 0xe8)
+	peers = append(peers, 0x2, 10, 0, 0, 3, 10, 0, 0, 3, 0, 0, 0xfd, 0xe9)
+
+	// AS_PATH 65001 13335 and community 65000:100
+	attrs := []byte{0x40, 2, 10, 2, 2, 0, 0, 0xfd, 0xe9, 0, 0, 0x34, 0x17}
+	attrs = append(attrs, 0xc0, 8, 4, 0xfd, 0xe8, 0, 100)
+
+	rib := []byte{0, 0, 0, 1, 24, 1, 0, 0, 0, 1}
+	rib = append(rib, 0, 1, 0, 0, 0, 0, 0, byte(len(attrs)))
+	rib = append(rib, attrs...)
+
+	dump := append(mrtRecord(mrtPeerIndexTable, peers), mrtRecord(mrtRIBIPv4Unicast, rib)...)
+
+	routes := make([]Route, 0)
+	err := ParseMRT(bytes.NewReader(dump), func(r Route) {
+		routes = append(routes, r)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(routes) != 1 {
+		t.Fatalf("Should parse one route, got %d", len(routes))
+	}
+
+	r := routes[0]
+	if r.Prefix.String() != "1.0.0.0/24" || r.PeerASN != 65001 || r.Origin() != 13335 {
+		t.Errorf("Route mismatch %v", r)
+	}
+
+	if len(r.Communities) != 1 || r.Communities[0] != "65000:100" {
+		t.Errorf("Communities mismatch %v", r.Communities)
+	}
+}
+
+func TestShouldParseBird(t *testing.T) {
+	dump := `Table master4:
+1.0.0.0/24           unicast [transit 2020-11-19] * (100) [AS13335i]
+	via 10.0.0.1 on eth0
+	Type: BGP univ
+	BGP.as_path: 174 13335
+	BGP.community: (174,21000) (174,22013)
+                     unicast [ix_rs 2020-11-19] (100) [AS13335i]
+	via 10.1.0.1 on eth1
+	Type: BGP univ
+	BGP.as_path: 13335
+	BGP.large_community: (65000, 1, 100)
+`
+
+	routes := make([]Route, 0)
+	err := ParseBird(strings.NewReader(dump), func(r Route) {
+		routes = append(routes, r)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(routes) != 2 {
+		t.Fatalf("Should parse two paths, got %d", len(routes))
+	}
+
+	if routes[0].PeerASN != 174 || routes[1].PeerASN != 13335 || routes[1].Origin() != 13335 {
+		t.Errorf("Paths mismatch %v", routes)
+	}
+
+	if routes[0].Communities[1] != "174:22013" || routes[1].Communities[0] != "65000:1:100" {
+		t.Errorf("Communities mismatch %v", routes)
+	}
+}
+
+func TestShouldClassifyPeeringByRoute(t *testing.T) {
+	cfg := Config{}
+
+	cfg.Networks.Networks = make(map[string]string)
+	cfg.Networks.Networks["192.168.0.0/16"] = "local"
+
+	c := NewClassifier(cfg)
+
+	_, transit, _ := net.ParseCIDR("1.0.0.0/16")
+	_, peering, _ := net.ParseCIDR("1.0.0.0/24")
+	c.Routes.Insert(*transit, RouteInfo{Origin: 174})
+	c.Routes.Insert(*peering, RouteInfo{Origin: 13335, Peering: true})
+
+	e := Entry{
+		SrcIP: net.ParseIP("192.168.0.1"),
+		DstIP: net.ParseIP("1.0.0.1"),
+	}
+	c.Classify(&e)
+
+	if e.Class != "peering" || e.RemoteASN != 13335 {
+		t.Errorf("Should classify peering by longest prefix")
+	}
+
+	e.DstIP = net.ParseIP("1.0.1.1")
+	c.Classify(&e)
+
+	if e.Class != "internet" || e.RemoteASN != 174 {
+		t.Errorf("Should classify internet by route")
+	}
+}
+
+func TestShouldReturnRoutesErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "classifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	empty := filepath.Join(dir, "empty.txt")
+	ioutil.WriteFile(empty, []byte("Table master4:\n"), 0644)
+
+	invalid := filepath.Join(dir, "invalid.txt")
+	ioutil.WriteFile(invalid, []byte("1.0.0.0/24 unicast [transit 2020-11-19] * (100) [AS13335i]\n\tBGP.as_path: 174 AS13335\n"), 0644)
+
+	cases := map[string]BGPConfig{
+		"could not read routes":  {Format: "bird", File: filepath.Join(dir, "missing.txt")},
+		"unknown routes format":  {Format: "gobgp", File: empty},
+		"no routes found":        {Format: "bird", File: empty},
+		"could not parse routes": {Format: "bird", File: invalid},
+	}
+
+	for message, bgp := range cases {
+		cfg := Config{}
+		cfg.Networks.BGP = []BGPConfig{bgp}
+
+		_, err := build(cfg, nil)
+		if err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("Should return %q, got %v", message, err)
+		}
+	}
+}
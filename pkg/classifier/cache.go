@@ -0,0 +1,110 @@
+package classifier
+
+import (
+	"container/list"
+	"net"
+	"sync"
+)
+
+// networkMatch is classification by local networks and remote address only,
+// it doesn't depend on entry time, ports and interface, so it is cached by address pair
+type networkMatch struct {
+	// Side is our side: src, dst or empty when no local network matched
+	Side      string
+	Dir       string
+	Class     string
+	RemoteASN uint32
+}
+
+type pairKey [32]byte
+
+func newPairKey(src net.IP, dst net.IP) pairKey {
+	var key pairKey
+	copy(key[:16], src.To16())
+	copy(key[16:], dst.To16())
+	return key
+}
+
+type cacheItem struct {
+	key   pairKey
+	match networkMatch
+}
+
+/*
+matchCache is LRU cache of network matches, safe for concurrent use
+
+Nil cache or cache of zero size stores nothing
+*/
+type matchCache struct {
+	mu     sync.Mutex
+	size   int
+	items  map[pairKey]*list.Element
+	order  *list.List
+	hits   uint64
+	misses uint64
+}
+
+func newMatchCache(size int) *matchCache {
+	return &matchCache{
+		size:  size,
+		items: make(map[pairKey]*list.Element),
+		order: list.New(),
+	}
+}
+
+// Get returns cached match and moves it to front
+func (m *matchCache) Get(key pairKey) (networkMatch, bool) {
+	if m == nil || m.size <= 0 {
+		return networkMatch{}, false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	element, ok := m.items[key]
+	if !ok {
+		m.misses = m.misses + 1
+		return networkMatch{}, false
+	}
+
+	m.hits = m.hits + 1
+	m.order.MoveToFront(element)
+
+	return element.Value.(*cacheItem).match, true
+}
+
+// Add stores match, the least recently used one is evicted when cache is full
+func (m *matchCache) Add(key pairKey, match networkMatch) {
+	if m == nil || m.size <= 0 {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if element, ok := m.items[key]; ok {
+		element.Value.(*cacheItem).match = match
+		m.order.MoveToFront(element)
+		return
+	}
+
+	m.items[key] = m.order.PushFront(&cacheItem{key: key, match: match})
+
+	if m.order.Len() > m.size {
+		last := m.order.Back()
+		m.order.Remove(last)
+		delete(m.items, last.Value.(*cacheItem).key)
+	}
+}
+
+// Stats returns number of cache hits and misses
+func (m *matchCache) Stats() (uint64, uint64) {
+	if m == nil {
+		return 0, 0
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.hits, m.misses
+}
@@ -0,0 +1,141 @@
+package classifier
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestShouldEvictLeastRecentlyUsedMatch(t *testing.T) {
+	cache := newMatchCache(2)
+
+	a := newPairKey(net.ParseIP("10.0.0.1"), net.ParseIP("8.8.8.8"))
+	b := newPairKey(net.ParseIP("10.0.0.2"), net.ParseIP("8.8.8.8"))
+	c := newPairKey(net.ParseIP("10.0.0.3"), net.ParseIP("8.8.8.8"))
+
+	cache.Add(a, networkMatch{Side: "src"})
+	cache.Add(b, networkMatch{Side: "src"})
+
+	if _, ok := cache.Get(a); !ok {
+		t.Errorf("Should find match")
+	}
+
+	cache.Add(c, networkMatch{Side: "src"})
+
+	if _, ok := cache.Get(b); ok {
+		t.Errorf("Should evict least recently used match")
+	}
+
+	if _, ok := cache.Get(a); !ok {
+		t.Errorf("Should keep recently used match")
+	}
+
+	hits, misses := cache.Stats()
+	if hits != 2 || misses != 1 {
+		t.Errorf("Stats mismatch hits:%d misses:%d", hits, misses)
+	}
+}
+
+func TestShouldClassifyCachedEntry(t *testing.T) {
+	cfg := Config{Cache: 10}
+	cfg.Users.Users = map[string]string{"192.168.0.1": "1"}
+	cfg.Networks.Networks = map[string]string{"192.168.0.0/16": "local", "1.1.1.0/24": "peering"}
+
+	c := NewClassifier(cfg)
+
+	for i := 0; i < 2; i++ {
+		e := Entry{SrcIP: net.ParseIP("192.168.0.1"), DstIP: net.ParseIP("1.1.1.1")}
+		c.Classify(&e)
+
+		if e.UserID != "1" || e.Dir != "out" || e.Class != "peering" {
+			t.Errorf("Classification %d mismatch %v", i, e)
+		}
+	}
+
+	if hits, _ := c.CacheStats(); hits != 1 {
+		t.Errorf("Should classify second entry from cache, hits:%d", hits)
+	}
+}
+
+func TestShouldReloadConcurrently(t *testing.T) {
+	cfg := Config{Cache: 10}
+	cfg.Users.Users = map[string]string{"192.168.0.1": "1"}
+	cfg.Networks.Networks = map[string]string{"192.168.0.0/16": "local"}
+
+	c := NewClassifier(cfg)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				e := Entry{SrcIP: net.ParseIP("192.168.0.1"), DstIP: net.ParseIP("8.8.8.8")}
+				c.Classify(&e)
+
+				if e.UserID != "1" {
+					t.Errorf("User mismatch %v", e)
+					return
+				}
+			}
+		}()
+	}
+
+	c.Reload()
+	wg.Wait()
+
+	if len(cfg.Users.Users) != 1 || c.Users[IP2Int(net.ParseIP("192.168.0.1"))] != "1" {
+		t.Errorf("Should keep configured users %v", c.Users)
+	}
+}
+
+func TestShouldKeepDictionariesWhenReloadFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "classifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "users.json")
+
+	err = ioutil.WriteFile(file, []byte(`{"192.168.0.1": "1"}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := Config{}
+	cfg.Users.Fetch.File = file
+	cfg.Networks.Networks = map[string]string{"192.168.0.0/16": "local"}
+
+	c := NewClassifier(cfg)
+	version := c.Version
+
+	for _, body := range []string{`not a dictionary`, ``} {
+		err = ioutil.WriteFile(file, []byte(body), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Unparseable users are replaced by previous ones in memory
+		err = c.Reload()
+		if err != nil || c.Version != version {
+			t.Errorf("Should keep previous users instead of %q: %v", body, err)
+		}
+	}
+
+	os.Remove(file)
+
+	if c.Reload() == nil {
+		t.Errorf("Should return error of missing file")
+	}
+
+	e := Entry{SrcIP: net.ParseIP("192.168.0.1"), DstIP: net.ParseIP("8.8.8.8")}
+	c.Classify(&e)
+
+	if c.Version != version || e.UserID != "1" {
+		t.Errorf("Should keep current dictionaries %s %v", c.Version, e)
+	}
+}
@@ -2,73 +2,143 @@ package classifier
 
 import (
 	"encoding/binary"
-	"encoding/csv"
-	"encoding/json"
 	"fmt"
-	"io"
+	"github.com/inkuber/ipcad2ch/pkg/metrics"
 	"io/ioutil"
 	"log"
 	"net"
-	"net/http"
-	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 /*
 Config struct used in classifier consturctor NewClassifier
 
-Config {
-  Users: {
-    Fetch {
-      URL: URL to fetch users, formats: json, csv
-
-      File: File path to users file, formats: json, csv
-
-      IDField: ID field index for csv
-      CIDRField: CIDR field index for csv
-      Comma: Field delimiter
-    }
-    Users: users hash map ip => id
-  }
-  Networks: {
-    Fetch {
-      URL: URL to fetch networks, formats: json, csv
-
-      File: File path to networks file, formats: json, csv
-
-      IDField: ID field index for csv
-      CIDRField: CIDR field index for csv
-      Comma: Field delimiter
-    }
-    Networks: networks hash map cidr => class, classes: local, peering
-  }
-}
+	Config {
+	  Users: {
+	    Fetch {
+	      URL: URL to fetch users
+	      Timeout, Retries, Backoff, Cache: url fetching options, see FetchOptions
+
+	      File: File path to users file
+
+	      Format: csv, tsv, json or yaml, detected by content type or extension if empty
+	      IDField: ID field index for csv
+	      CIDRField: CIDR field index for csv
+	      Comma: Field delimiter
+
+	      Header: First csv row is header, fields are found by column names
+	      IDColumn: ID column name for csv with header and array of objects, default id
+	      CIDRColumn: CIDR column name for csv with header and array of objects, default ip
+	      Attributes: Fields of csv with header and array of objects carried with user,
+	                  stored in user_<attribute> columns, used for sql and command users too
+
+	      MaxRemoved, MinEntries, RejectOverlaps: checks of new users, see Safeguards
+	    }
+	    SQL: users query, see SQLConfig, fetch format options, cache and safeguards are used
+	    Command: users printed by external command, see CommandConfig, fetch format
+	             options, cache and safeguards are used
+	    Users: users hash map ip => id
+	    DHCP: list of DHCP lease databases, see DHCPConfig
+	    Sessions: list of BRAS session logs, see SessionConfig
+	    FollowSessions: Interval of checking session logs for new sessions, 0 disables
+	    NAT: list of NAT translation logs, see NATConfig
+	  }
+	  Networks: {
+	    Fetch {
+	      URL: URL to fetch networks
+	      Timeout, Retries, Backoff, Cache: url fetching options, see FetchOptions
+
+	      File: File path to networks file
+
+	      Format: csv, tsv, json or yaml, detected by content type or extension if empty
+	      CIDRField: CIDR field index for csv
+	      ClassField: Class field index for csv
+	      Comma: Field delimiter
+
+	      Header: First csv row is header, fields are found by column names
+	      CIDRColumn: CIDR column name for csv with header and array of objects, default cidr
+	      ClassColumn: Class column name for csv with header and array of objects, default class
+
+	      MaxRemoved, MinEntries, RejectOverlaps: checks of new networks, see Safeguards
+	    }
+	    SQL: networks query, see SQLConfig, fetch format options, cache and safeguards are used
+	    Command: networks printed by external command, see CommandConfig, fetch format
+	             options, cache and safeguards are used
+	    Networks: networks hash map cidr => class, classes: local, peering
+	    BGP: list of routing tables, see BGPConfig
+	  }
+	  Services: list of service rules, see ServiceConfig
+	  Interfaces: list of exporter interface roles, see InterfaceConfig
+	  Special: special purpose ranges and bogons classified by remote address, see SpecialConfig
+	  MirrorLocal: local to local flows get second mirrored row of sender user, see Mirror
+	  Cache: size of LRU cache of classification by address pair, 0 disables cache
+	}
 */
 type Config struct {
 	Users struct {
 		Fetch struct {
 			URL       string `mapstructure:"url"`
 			File      string `mapstructure:"file"`
+			Format    string `mapstructure:"format"`
 			IDField   int    `mapstructure:"IDField"`
-			CIDRField int    `mapstructure:"IPField"`
+			CIDRField int    `mapstructure:"CIDRField"`
 			Comma     string `mapstructure:"Comma"`
+
+			Header     bool   `mapstructure:"header"`
+			IDColumn   string `mapstructure:"idColumn"`
+			CIDRColumn string `mapstructure:"cidrColumn"`
+
+			Attributes []string `mapstructure:"attributes"`
+
+			FetchOptions `mapstructure:",squash"`
+			Safeguards   `mapstructure:",squash"`
 		}
 
-		Users map[string]string `mapstructure:"users"`
+		SQL     SQLConfig     `mapstructure:"sql"`
+		Command CommandConfig `mapstructure:"command"`
+
+		Users    map[string]string `mapstructure:"users"`
+		DHCP     []DHCPConfig      `mapstructure:"dhcp"`
+		Sessions []SessionConfig   `mapstructure:"sessions"`
+		NAT      []NATConfig       `mapstructure:"nat"`
+
+		FollowSessions time.Duration `mapstructure:"followSessions"`
 	}
 
 	Networks struct {
 		Fetch struct {
 			URL        string `mapstructure:"url"`
 			File       string `mapstructure:"file"`
+			Format     string `mapstructure:"format"`
 			CIDRField  int    `mapstructure:"CIDRField"`
 			ClassField int    `mapstructure:"classField"`
 			Comma      string `mapstructure:"Comma"`
+
+			Header      bool   `mapstructure:"header"`
+			CIDRColumn  string `mapstructure:"cidrColumn"`
+			ClassColumn string `mapstructure:"classColumn"`
+
+			FetchOptions `mapstructure:",squash"`
+			Safeguards   `mapstructure:",squash"`
 		}
 
+		SQL     SQLConfig     `mapstructure:"sql"`
+		Command CommandConfig `mapstructure:"command"`
+
 		Networks map[string]string `mapstructure:"networks"`
+		BGP      []BGPConfig       `mapstructure:"bgp"`
 	}
+
+	Services   []ServiceConfig   `mapstructure:"services"`
+	Interfaces []InterfaceConfig `mapstructure:"interfaces"`
+	Special    SpecialConfig     `mapstructure:"special"`
+
+	MirrorLocal bool `mapstructure:"mirrorLocal"`
+	Cache       int  `mapstructure:"cache"`
 }
 
 // Entry is DTO object for classification
@@ -82,23 +152,91 @@ type Entry struct {
 	Proto     uint8
 	Iface     string
 	Collected time.Time
+	Exporter  string
+
+	UserID    string
+	Dir       string
+	Class     string
+	RemoteASN uint32
+
+	RemoteCountry string
+	RemoteOrg     string
+	Service       string
+
+	UserAttributes map[string]string
+	DictVersion    string
+
+	// Mirror is second row of local to local flow, see Classifier.Mirror
+	Mirror bool
 
-	UserID string
-	Dir    string
-	Class  string
+	// Cost is set by rating stage
+	Cost float64
+}
+
+// RemoteIP returns remote side address of classified entry, nil if direction is unknown
+func (e *Entry) RemoteIP() net.IP {
+	switch e.Dir {
+	case IN:
+		return e.SrcIP
+	case OUT:
+		return e.DstIP
+	}
+
+	return nil
 }
 
 /*
 Classifier class struct
 
-Should be instantiate with NewClassifier method
+Should be instantiate with NewClassifier method, it is safe for concurrent
+classification and Reload
 */
 type Classifier struct {
-	Config    Config
-	Users     map[uint32]string
-	Local     []net.IPNet
-	Peering   []net.IPNet
-	Multicast net.IPNet
+	Config   Config
+	Users    map[uint32]string
+	Leases   map[uint32][]Lease
+	NAT      map[uint32][]NATMapping
+	Local    []net.IPNet
+	Peering  []net.IPNet
+	Routes   *Trie
+	Services []Service
+
+	// Special is special purpose ranges trie, see SpecialRange
+	Special *Trie
+
+	// SessionLeases are subscriber addresses of BRAS sessions, see FollowSessions
+	SessionLeases map[uint32][]Lease
+
+	// IfaceSessions is "exporter/iface" => sessions
+	IfaceSessions map[string][]Lease
+
+	// Sources of users and networks: url, file or config
+	UserSources    map[uint32]string
+	NetworkSources map[string]string
+
+	// UserAttributes is user id => attribute => value
+	UserAttributes map[string]map[string]string
+
+	// Version of users and networks dictionaries, see Snapshot
+	Version string
+	Loaded  time.Time
+
+	source            string
+	rawUserSources    map[string]string
+	rawNetworkSources map[string]string
+	sessionStamps     map[string]fileStamp
+
+	// dictionaries are last accepted users and networks by source kind,
+	// safeguards compare new dictionaries with them on Reload
+	dictionaries map[string]Fetched
+
+	// previous is classifier replaced by Reload, it is set while dictionaries are loaded
+	previous *Classifier
+
+	// config is constructor config without loaded users and networks, used by Reload
+	config Config
+	mu     *sync.RWMutex
+	cache  *matchCache
 }
 
 var (
@@ -122,46 +260,155 @@ var (
 
 	// MULTICAST network
 	MULTICAST string = "multicast"
+
+	// PRIVATE RFC1918 network
+	PRIVATE string = "private"
+
+	// CGNAT shared address space
+	CGNAT string = "cgnat"
+
+	// LINKLOCAL network
+	LINKLOCAL string = "linklocal"
+
+	// BROADCAST address
+	BROADCAST string = "broadcast"
+
+	// RESERVED IANA special purpose network
+	RESERVED string = "reserved"
+
+	// BOGON network from bogon list
+	BOGON string = "bogon"
 )
 
 // NewClassifier constructor method
-func NewClassifier(cfg Config) Classifier {
-	_, mcast, _ := net.ParseCIDR("224.0.0.0/4")
+func NewClassifier(cfg Config) *Classifier {
+	c, err := build(cfg, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return c
+}
 
-	if cfg.Users.Users == nil {
-		cfg.Users.Users = make(map[string]string)
+// build loads dictionaries, previous is current classifier on Reload and nil on start
+func build(cfg Config, previous *Classifier) (*Classifier, error) {
+	config := cfg
+
+	// Loaded users and networks are added to copies of configured ones
+	cfg.Users.Users = copyMap(cfg.Users.Users)
+	cfg.Networks.Networks = copyMap(cfg.Networks.Networks)
+
+	c := &Classifier{
+		Config:  cfg,
+		Users:   make(map[uint32]string),
+		Leases:  make(map[uint32][]Lease),
+		NAT:     make(map[uint32][]NATMapping),
+		Local:   make([]net.IPNet, 0),
+		Peering: make([]net.IPNet, 0),
+		Routes:  NewTrie(),
+		Special: NewTrie(),
+
+		SessionLeases: make(map[uint32][]Lease),
+		IfaceSessions: make(map[string][]Lease),
+
+		UserSources:    make(map[uint32]string),
+		NetworkSources: make(map[string]string),
+		UserAttributes: make(map[string]map[string]string),
+
+		rawUserSources:    make(map[string]string),
+		rawNetworkSources: make(map[string]string),
+		sessionStamps:     make(map[string]fileStamp),
+
+		dictionaries: make(map[string]Fetched),
+		previous:     previous,
+
+		config: config,
+		mu:     &sync.RWMutex{},
+		cache:  newMatchCache(cfg.Cache),
 	}
 
-	if cfg.Networks.Networks == nil {
-		cfg.Networks.Networks = make(map[string]string)
+	for ip := range cfg.Users.Users {
+		c.rawUserSources[ip] = "config"
 	}
 
-	c := Classifier{
-		Config:    cfg,
-		Users:     make(map[uint32]string),
-		Local:     make([]net.IPNet, 0),
-		Peering:   make([]net.IPNet, 0),
-		Multicast: *mcast,
+	for _, attribute := range cfg.Users.Fetch.Attributes {
+		if !attributeName.MatchString(attribute) {
+			return nil, fmt.Errorf("invalid user attribute name %s, allowed lowercase letters, digits and _", attribute)
+		}
+	}
+
+	for cidr := range cfg.Networks.Networks {
+		c.rawNetworkSources[cidr] = "config"
 	}
 
+	loaders := make([]func() error, 0)
+
 	if cfg.Users.Fetch.URL != "" {
-		c.fetchUsers()
+		loaders = append(loaders, c.fetchUsers)
 	}
 
 	if cfg.Networks.Fetch.URL != "" {
-		c.fetchNetworks()
+		loaders = append(loaders, c.fetchNetworks)
 	}
 
 	if cfg.Users.Fetch.File != "" {
-		c.readUsers()
+		loaders = append(loaders, c.readUsers)
 	}
 
 	if cfg.Networks.Fetch.File != "" {
-		c.readNetworks()
+		loaders = append(loaders, c.readNetworks)
+	}
+
+	if cfg.Users.SQL.Query != "" {
+		loaders = append(loaders, c.queryUsers)
+	}
+
+	if cfg.Networks.SQL.Query != "" {
+		loaders = append(loaders, c.queryNetworks)
+	}
+
+	if cfg.Users.Command.Command != "" {
+		loaders = append(loaders, c.execUsers)
+	}
+
+	if cfg.Networks.Command.Command != "" {
+		loaders = append(loaders, c.execNetworks)
+	}
+
+	for _, dhcp := range cfg.Users.DHCP {
+		dhcp := dhcp
+		loaders = append(loaders, func() error { return c.readDHCP(dhcp) })
+	}
+
+	for _, sessions := range cfg.Users.Sessions {
+		sessions := sessions
+		loaders = append(loaders, func() error { return c.readSessions(sessions) })
 	}
 
+	for _, nat := range cfg.Users.NAT {
+		nat := nat
+		loaders = append(loaders, func() error { return c.readNAT(nat) })
+	}
+
+	for _, bgp := range cfg.Networks.BGP {
+		bgp := bgp
+		loaders = append(loaders, func() error { return c.readBGP(bgp) })
+	}
+
+	loaders = append(loaders, c.compileServices, c.compileInterfaces, c.compileSpecial)
+
+	for _, load := range loaders {
+		err := load()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Previous classifier is not referenced after load
+	c.previous = nil
+
 	for ip, id := range cfg.Users.Users {
-		netIP := net.ParseIP(ip)
+		netIP := ParseUserIP(ip)
 		if netIP == nil {
 			log.Printf(fmt.Sprintf("Could not parse ip %s for user %s, skipping", ip, id))
 			continue
@@ -169,6 +416,7 @@ func NewClassifier(cfg Config) Classifier {
 
 		intIP := IP2Int(netIP)
 		c.Users[intIP] = id
+		c.UserSources[intIP] = c.rawUserSources[ip]
 	}
 
 	for cidr, class := range cfg.Networks.Networks {
@@ -178,6 +426,8 @@ func NewClassifier(cfg Config) Classifier {
 			continue
 		}
 
+		c.NetworkSources[network.String()] = c.rawNetworkSources[cidr]
+
 		if class == LOCAL {
 			c.Local = append(c.Local, *network)
 		}
@@ -187,239 +437,655 @@ func NewClassifier(cfg Config) Classifier {
 		}
 	}
 
-	return c
-}
+	c.Loaded = time.Now()
+	c.Version = c.version()
 
-func (c *Classifier) fetchUsers() {
-	log.Println(fmt.Sprintf("Fetching users from url %s", c.Config.Users.Fetch.URL))
+	log.Println(fmt.Sprintf("Dictionaries version %s users:%d networks:%d", c.Version, len(c.Users), len(c.Local)+len(c.Peering)))
+
+	return c, nil
+}
 
-	resp, err := http.Get(c.Config.Users.Fetch.URL)
+// Reload loads dictionaries again, classification waits until they are replaced.
+// Current dictionaries are kept when new ones could not be loaded
+func (c *Classifier) Reload() error {
+	next, err := build(c.config, c)
 	if err != nil {
-		log.Fatal(err)
+		log.Println(fmt.Sprintf("Could not reload dictionaries, current version %s is kept: %v", c.Version, err))
+		return err
 	}
-	defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatal(err)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Every field except mu is replaced, mu is read by waiting classification
+	c.Config = next.Config
+	c.Users = next.Users
+	c.Leases = next.Leases
+	c.NAT = next.NAT
+	c.Local = next.Local
+	c.Peering = next.Peering
+	c.Routes = next.Routes
+	c.Services = next.Services
+	c.Special = next.Special
+	c.SessionLeases = next.SessionLeases
+	c.IfaceSessions = next.IfaceSessions
+	c.sessionStamps = next.sessionStamps
+	c.UserSources = next.UserSources
+	c.NetworkSources = next.NetworkSources
+	c.UserAttributes = next.UserAttributes
+	c.Version = next.Version
+	c.Loaded = next.Loaded
+	c.source = next.source
+	c.rawUserSources = next.rawUserSources
+	c.rawNetworkSources = next.rawNetworkSources
+	c.dictionaries = next.dictionaries
+	c.config = next.config
+	c.cache = next.cache
+
+	return nil
+}
+
+// CacheStats returns number of classification cache hits and misses
+func (c *Classifier) CacheStats() (uint64, uint64) {
+	return c.cache.Stats()
+}
+
+func copyMap(m map[string]string) map[string]string {
+	copied := make(map[string]string, len(m))
+	for k, v := range m {
+		copied[k] = v
 	}
 
-	contentType := resp.Header.Get("Content-Type")
+	return copied
+}
 
-	log.Println(fmt.Sprintf("Users fetched statusCode:%d type:%s", resp.StatusCode, contentType))
+func (c *Classifier) fetchUsers() error {
+	log.Println(fmt.Sprintf("Fetching users from url %s", c.Config.Users.Fetch.URL))
+	c.source = fmt.Sprintf("url %s", c.Config.Users.Fetch.URL)
 
-	if strings.Contains(contentType, "application/json") {
-		c.parseJSONUsers(string(body))
+	fetched, err := fetchDictionary("users", c.Config.Users.Fetch.URL, c.Config.Users.Fetch.FetchOptions)
+	if err != nil {
+		return err
 	}
 
-	if strings.Contains(contentType, "text/csv") {
-		c.parseCSVUsers(string(body))
+	if fetched.Cached {
+		c.source = fmt.Sprintf("cache %s of url %s", c.Config.Users.Fetch.Cache, c.Config.Users.Fetch.URL)
 	}
+
+	log.Println(fmt.Sprintf("Users fetched type:%s", fetched.ContentType))
+
+	return c.loadUsers("url", fetched)
 }
 
-func (c *Classifier) readUsers() {
+func (c *Classifier) readUsers() error {
 	log.Println(fmt.Sprintf("Reading users from file %s", c.Config.Users.Fetch.File))
+	c.source = fmt.Sprintf("file %s", c.Config.Users.Fetch.File)
 
 	body, err := ioutil.ReadFile(c.Config.Users.Fetch.File)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+
+	return c.loadUsers("file", Fetched{URL: c.Config.Users.Fetch.File, Time: time.Now(), Body: string(body)})
+}
+
+// loadUsers checks new users against safeguards, previous users are kept
+// when new ones are unparseable or rejected
+func (c *Classifier) loadUsers(kind string, fetched Fetched) error {
+	opts := c.Config.Users.Fetch.FetchOptions
+	previous, cached, hasPrevious := c.previousDictionary("users "+kind, opts)
+
+	users, attributes, err := c.parseUsers(fetched)
+	if err == nil && !fetched.Cached {
+		var previousUsers map[string]string
+		if hasPrevious {
+			previousUsers, _, _ = c.parseUsers(previous)
+		}
+
+		err = checkDictionary("users", c.Config.Users.Fetch.Safeguards, previousUsers, users)
 	}
 
-	ext := filepath.Ext(c.Config.Users.Fetch.File)
+	if err != nil && !fetched.Cached && hasPrevious {
+		fetched, err = c.keepPrevious("users", opts, previous, cached, err)
+		if err == nil {
+			users, attributes, err = c.parseUsers(fetched)
+		}
+	}
 
-	log.Println(fmt.Sprintf("Users readed extension:%s", ext))
+	if err != nil {
+		return fmt.Errorf("could not load users from %s: %v", c.source, err)
+	}
 
-	if ext == ".json" {
-		c.parseJSONUsers(string(body))
+	for cidr, id := range users {
+		c.Config.Users.Users[cidr] = id
+		c.rawUserSources[cidr] = c.source
 	}
 
-	if ext == ".csv" {
-		c.parseCSVUsers(string(body))
+	for id, values := range attributes {
+		c.UserAttributes[id] = values
 	}
+
+	log.Println(fmt.Sprintf("Loaded %d users from %s", len(users), c.source))
+
+	c.dictionaries["users "+kind] = fetched
+	saveCache("users", fetched, opts)
+
+	return nil
 }
 
-func (c *Classifier) fetchNetworks() {
+func (c *Classifier) fetchNetworks() error {
 	log.Println(fmt.Sprintf("Fetching networks from url %s", c.Config.Networks.Fetch.URL))
+	c.source = fmt.Sprintf("url %s", c.Config.Networks.Fetch.URL)
 
-	resp, err := http.Get(c.Config.Networks.Fetch.URL)
+	fetched, err := fetchDictionary("networks", c.Config.Networks.Fetch.URL, c.Config.Networks.Fetch.FetchOptions)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
-	contentType := resp.Header.Get("Content-Type")
-
-	log.Println(fmt.Sprintf("Networks fetched statusCode:%d type:%s", resp.StatusCode, contentType))
-
-	if strings.Contains(contentType, "application/json") {
-		c.parseJSONNetworks(string(body))
+	if fetched.Cached {
+		c.source = fmt.Sprintf("cache %s of url %s", c.Config.Networks.Fetch.Cache, c.Config.Networks.Fetch.URL)
 	}
 
-	if strings.Contains(contentType, "text/csv") {
-		c.parseCSVNetworks(string(body))
-	}
+	log.Println(fmt.Sprintf("Networks fetched type:%s", fetched.ContentType))
+
+	return c.loadNetworks("url", fetched)
 }
 
-func (c *Classifier) readNetworks() {
+func (c *Classifier) readNetworks() error {
 	log.Println(fmt.Sprintf("Reading networks from file %s", c.Config.Networks.Fetch.File))
+	c.source = fmt.Sprintf("file %s", c.Config.Networks.Fetch.File)
 
 	body, err := ioutil.ReadFile(c.Config.Networks.Fetch.File)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	ext := filepath.Ext(c.Config.Networks.Fetch.File)
+	return c.loadNetworks("file", Fetched{URL: c.Config.Networks.Fetch.File, Time: time.Now(), Body: string(body)})
+}
+
+// loadNetworks checks new networks against safeguards, previous networks are kept
+// when new ones are unparseable or rejected
+func (c *Classifier) loadNetworks(kind string, fetched Fetched) error {
+	opts := c.Config.Networks.Fetch.FetchOptions
+	previous, cached, hasPrevious := c.previousDictionary("networks "+kind, opts)
+
+	networks, err := c.parseNetworks(fetched)
+	if err == nil && !fetched.Cached {
+		var previousNetworks map[string]string
+		if hasPrevious {
+			previousNetworks, _ = c.parseNetworks(previous)
+		}
+
+		err = checkDictionary("networks", c.Config.Networks.Fetch.Safeguards, previousNetworks, networks)
+	}
 
-	log.Println(fmt.Sprintf("Networks readed extension:%s", ext))
+	if err != nil && !fetched.Cached && hasPrevious {
+		fetched, err = c.keepPrevious("networks", opts, previous, cached, err)
+		if err == nil {
+			networks, err = c.parseNetworks(fetched)
+		}
+	}
 
-	if ext == ".json" {
-		c.parseJSONUsers(string(body))
+	if err != nil {
+		return fmt.Errorf("could not load networks from %s: %v", c.source, err)
 	}
 
-	if ext == ".csv" {
-		c.parseCSVUsers(string(body))
+	for cidr, class := range networks {
+		c.Config.Networks.Networks[cidr] = class
+		c.rawNetworkSources[cidr] = c.source
 	}
+
+	log.Println(fmt.Sprintf("Loaded %d networks from %s", len(networks), c.source))
+
+	c.dictionaries["networks "+kind] = fetched
+	saveCache("networks", fetched, opts)
+
+	return nil
 }
 
-func (c *Classifier) parseJSONUsers(body string) {
-	log.Println("Parsing JSON users")
+// previousDictionary returns dictionary in memory of replaced classifier,
+// cache file is used on start, cached is true for cache file
+func (c *Classifier) previousDictionary(key string, opts FetchOptions) (Fetched, bool, bool) {
+	if c.previous != nil {
+		if fetched, ok := c.previous.dictionaries[key]; ok {
+			return fetched, false, true
+		}
+	}
 
-	var result map[string]string
-	err := json.Unmarshal([]byte(body), &result)
-	if err != nil {
-		log.Fatal(err)
+	if opts.Cache != "" {
+		if fetched, err := readCache(opts.Cache); err == nil {
+			return fetched, true, true
+		}
 	}
 
-	parsed := 0
-	for cidr, id := range result {
-		c.Config.Users.Users[cidr] = id
-		parsed = parsed + 1
+	return Fetched{}, false, false
+}
+
+// keepPrevious returns previous dictionary used instead of failed one
+func (c *Classifier) keepPrevious(name string, opts FetchOptions, previous Fetched, cached bool, reason error) (Fetched, error) {
+	if cached {
+		c.source = fmt.Sprintf("cache %s of %s", opts.Cache, c.source)
+		return cachedDictionary(name, opts, reason)
+	}
+
+	log.Println(fmt.Sprintf("WARNING: Could not load %s: %v", name, reason))
+	log.Println(fmt.Sprintf("WARNING: Keeping %s loaded at %s", name, previous.Time.Format(time.RFC3339)))
+
+	c.source = fmt.Sprintf("previous %s", c.source)
+
+	return previous, nil
+}
+
+// checkDictionary reports diff of new dictionary and previous one and checks safeguards,
+// previous is nil when unknown
+func checkDictionary(name string, guards Safeguards, previous map[string]string, next map[string]string) error {
+	if previous != nil {
+		Diff(previous, next).Report(name, previous, next, 10)
+	}
+
+	metrics.Set(fmt.Sprintf(`ipcad2ch_dictionary_entries{dictionary="%s"}`, name), float64(len(next)))
+
+	err := guards.Check(previous, next)
+	if err != nil {
+		metrics.Set(fmt.Sprintf(`ipcad2ch_dictionary_rejected{dictionary="%s"}`, name), 1)
+		return fmt.Errorf("new %s rejected: %v", name, err)
 	}
 
-	log.Println(fmt.Sprintf("Parsed %d users ", parsed))
+	metrics.Set(fmt.Sprintf(`ipcad2ch_dictionary_rejected{dictionary="%s"}`, name), 0)
+
+	return nil
 }
 
-func (c *Classifier) parseCSVUsers(body string) {
-	r := csv.NewReader(strings.NewReader(body))
-	r.Comma = rune(c.Config.Users.Fetch.Comma[0])
+// parseUsers validates all records, source without users is error
+func (c *Classifier) parseUsers(fetched Fetched) (map[string]string, map[string]map[string]string, error) {
+	cfg := c.Config.Users.Fetch
+
+	format, err := DetectFormat(column(fetched.Format, cfg.Format), fetched.ContentType, fetched.URL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	log.Println(fmt.Sprintf("Parsing %s users", format))
+
+	idColumn, cidrColumn := column(cfg.IDColumn, "id"), column(cfg.CIDRColumn, "ip")
+	if (format == "csv" || format == "tsv") && !cfg.Header {
+		idColumn, cidrColumn = strconv.Itoa(cfg.IDField), strconv.Itoa(cfg.CIDRField)
+	}
+
+	records, err := ParseRecords([]byte(fetched.Body), RecordFormat{
+		Format: format,
+		Comma:  cfg.Comma,
+		Header: cfg.Header,
+		Key:    cidrColumn,
+		Value:  idColumn,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(records) == 0 {
+		return nil, nil, fmt.Errorf("no users found")
+	}
 
-	parsed := 0
-	for {
-		record, err := r.Read()
-		if err == io.EOF {
-			break
+	users := make(map[string]string)
+	attributes := make(map[string]map[string]string)
+	for i, record := range records {
+		cidr, ok := record[cidrColumn]
+		if !ok {
+			return nil, nil, fmt.Errorf("record %d has no %s field", i+1, cidrColumn)
 		}
-		if err != nil {
-			log.Fatal(err)
+
+		if ParseUserIP(cidr) == nil {
+			return nil, nil, fmt.Errorf("record %d has invalid ip %q", i+1, cidr)
 		}
 
-		id := record[c.Config.Users.Fetch.IDField]
-		cidr := record[c.Config.Users.Fetch.CIDRField]
+		id := record[idColumn]
+		if id == "" {
+			return nil, nil, fmt.Errorf("record %d has no %s field", i+1, idColumn)
+		}
 
-		c.Config.Users.Users[cidr] = id
-		parsed = parsed + 1
+		users[cidr] = id
+
+		if len(cfg.Attributes) > 0 {
+			attributes[id] = make(map[string]string)
+			for _, attribute := range cfg.Attributes {
+				attributes[id][attribute] = record[attribute]
+			}
+		}
 	}
 
-	log.Println(fmt.Sprintf("Parsed %d users ", parsed))
+	log.Println(fmt.Sprintf("Parsed %d users ", len(users)))
+
+	return users, attributes, nil
 }
 
-func (c *Classifier) parseJSONNetworks(body string) {
-	log.Println("Parsing JSON networks")
+// parseNetworks validates all records, source without networks is error
+func (c *Classifier) parseNetworks(fetched Fetched) (map[string]string, error) {
+	cfg := c.Config.Networks.Fetch
 
-	var result map[string]string
-	err := json.Unmarshal([]byte(body), &result)
+	format, err := DetectFormat(column(fetched.Format, cfg.Format), fetched.ContentType, fetched.URL)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	parsed := 0
-	for cidr, class := range result {
-		c.Config.Networks.Networks[cidr] = class
-		parsed = parsed + 1
+	log.Println(fmt.Sprintf("Parsing %s networks", format))
+
+	cidrColumn, classColumn := column(cfg.CIDRColumn, "cidr"), column(cfg.ClassColumn, "class")
+	if (format == "csv" || format == "tsv") && !cfg.Header {
+		cidrColumn, classColumn = strconv.Itoa(cfg.CIDRField), strconv.Itoa(cfg.ClassField)
 	}
 
-	log.Println(fmt.Sprintf("Parsed %d networks", parsed))
-}
+	records, err := ParseRecords([]byte(fetched.Body), RecordFormat{
+		Format: format,
+		Comma:  cfg.Comma,
+		Header: cfg.Header,
+		Key:    cidrColumn,
+		Value:  classColumn,
+	})
+	if err != nil {
+		return nil, err
+	}
 
-func (c *Classifier) parseCSVNetworks(body string) {
-	r := csv.NewReader(strings.NewReader(body))
-	r.Comma = rune(c.Config.Networks.Fetch.Comma[0])
+	if len(records) == 0 {
+		return nil, fmt.Errorf("no networks found")
+	}
 
-	parsed := 0
-	for {
-		record, err := r.Read()
-		if err == io.EOF {
-			break
+	networks := make(map[string]string)
+	for i, record := range records {
+		cidr, ok := record[cidrColumn]
+		if !ok {
+			return nil, fmt.Errorf("record %d has no %s field", i+1, cidrColumn)
 		}
+
+		_, _, err := net.ParseCIDR(cidr)
 		if err != nil {
-			log.Fatal(err)
+			return nil, fmt.Errorf("record %d has invalid cidr %q", i+1, cidr)
 		}
 
-		cidr := record[c.Config.Networks.Fetch.CIDRField]
-		class := record[c.Config.Networks.Fetch.ClassField]
+		class := record[classColumn]
+		if class != LOCAL && class != PEERING {
+			return nil, fmt.Errorf("record %d has unknown class %q", i+1, class)
+		}
 
-		c.Config.Networks.Networks[cidr] = class
-		parsed = parsed + 1
+		networks[cidr] = class
+	}
+
+	log.Println(fmt.Sprintf("Parsed %d networks", len(networks)))
+
+	return networks, nil
+}
+
+// ParseUserIP parses user address, single address CIDR like "10.0.0.1/32" is accepted
+func ParseUserIP(value string) net.IP {
+	ip := net.ParseIP(value)
+
+	if strings.Contains(value, "/") {
+		var network *net.IPNet
+		var err error
+
+		ip, network, err = net.ParseCIDR(value)
+		if err != nil {
+			return nil
+		}
+
+		if ones, bits := network.Mask.Size(); ones != bits {
+			return nil
+		}
+	}
+
+	if ip == nil || ip.To4() == nil {
+		return nil
+	}
+
+	return ip.To4()
+}
+
+var attributeName = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// Attributes returns names of user attributes carried with classified entries
+func (c *Classifier) Attributes() []string {
+	return c.Config.Users.Fetch.Attributes
+}
+
+func column(name string, def string) string {
+	if name == "" {
+		return def
 	}
 
-	log.Println(fmt.Sprintf("Parsed %d networks", parsed))
+	return name
 }
 
-//
 // Classify entry
-//
 func (c *Classifier) Classify(entry *Entry) {
+	c.classify(entry, nil)
+}
+
+// Explain classifies entry and returns trace of decisions
+func (c *Classifier) Explain(entry *Entry) *Trace {
+	trace := &Trace{}
+	c.classify(entry, trace)
+	return trace
+}
+
+func (c *Classifier) classify(entry *Entry, trace *Trace) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	entry.Class = UNKNOWN
+	entry.Dir = UNKNOWN
+
+	// Explained entries are never cached, so every decision is traced
+	var m networkMatch
+	cached := false
+	key := newPairKey(entry.SrcIP, entry.DstIP)
+	if trace == nil {
+		m, cached = c.cache.Get(key)
+	}
+
+	if !cached {
+		m = c.matchNetworks(entry, trace)
+		if trace == nil {
+			c.cache.Add(key, m)
+		}
+	}
 
-	class := UNKNOWN
-	dir := UNKNOWN
+	dir, class := m.Dir, m.Class
 	var clientIP, remoteIP *net.IP
 
-	entry.Class = class
-	entry.Dir = dir
+	switch m.Side {
+	case "src":
+		clientIP, remoteIP = &entry.SrcIP, &entry.DstIP
+	case "dst":
+		clientIP, remoteIP = &entry.DstIP, &entry.SrcIP
+	}
+
+	// Subscriber address known from leases or sessions is our side
+	if clientIP == nil {
+		if lease, ok := c.findLease(IP2Int(entry.SrcIP), entry.Collected); ok {
+			clientIP, remoteIP, dir, class = &entry.SrcIP, &entry.DstIP, OUT, INTERNET
+			if trace != nil {
+				trace.Add("lease rule won: src %s leased to %s (%s)", entry.SrcIP, lease.UserID, lease.Source)
+			}
+		} else if lease, ok := c.findLease(IP2Int(entry.DstIP), entry.Collected); ok {
+			clientIP, remoteIP, dir, class = &entry.DstIP, &entry.SrcIP, IN, INTERNET
+			if trace != nil {
+				trace.Add("lease rule won: dst %s leased to %s (%s)", entry.DstIP, lease.UserID, lease.Source)
+			}
+		}
+	}
+
+	iface := c.lookupInterface(entry)
+	if trace != nil && iface != nil {
+		trace.Add("interface %s/%s matched rule exporter=%q iface=%q role=%q side=%q user=%q (config)",
+			entry.Exporter, entry.Iface, iface.Exporter, iface.Iface, iface.Role, iface.Side, iface.User)
+	}
+
+	if clientIP == nil && iface != nil {
+		clientIP, remoteIP, dir, class = c.classifyInterface(iface, entry)
+		if trace != nil && clientIP != nil {
+			trace.Add("interface rule won: dir %s class %s", dir, class)
+		}
+	}
+
+	// Remote of our side found by lease or interface depends on entry time and interface
+	if remoteIP != nil && m.Side == "" {
+		m = networkMatch{Dir: dir, Class: class}
+		c.matchRemote(&m, *remoteIP, trace)
+		class = m.Class
+	}
+
+	if remoteIP != nil {
+		entry.RemoteASN = m.RemoteASN
+	}
+
+	if clientIP != nil {
+		c.lookupUser(entry, *clientIP, dir, iface, trace)
+
+		entry.Dir = dir
+		entry.Class = class
+	}
+
+	entry.Service = c.classifyService(entry)
+	entry.DictVersion = c.Version
+
+	if trace != nil {
+		trace.Add("service %s", entry.Service)
+		trace.Add("result: dir %s class %s user %q", entry.Dir, entry.Class, entry.UserID)
+	}
+}
+
+// matchNetworks classifies entry by local networks and remote address only
+func (c *Classifier) matchNetworks(entry *Entry, trace *Trace) networkMatch {
+	m := networkMatch{Dir: UNKNOWN, Class: UNKNOWN}
+	var remoteIP *net.IP
 
 	for _, localNet := range c.Local {
 		if localNet.Contains(entry.SrcIP) {
-			clientIP = &entry.SrcIP
+			m.Side = "src"
 			remoteIP = &entry.DstIP
-			dir = OUT
-			class = INTERNET
+			m.Dir = OUT
+			m.Class = INTERNET
+
+			if trace != nil {
+				trace.Add("src %s matched local network %s (%s)", entry.SrcIP, localNet.String(), c.NetworkSources[localNet.String()])
+			}
 		}
 
 		if localNet.Contains(entry.DstIP) {
-			clientIP = &entry.DstIP
+			m.Side = "dst"
 			remoteIP = &entry.SrcIP
-			dir = IN
-			class = INTERNET
+			m.Dir = IN
+			m.Class = INTERNET
+
+			if trace != nil {
+				trace.Add("dst %s matched local network %s (%s)", entry.DstIP, localNet.String(), c.NetworkSources[localNet.String()])
+			}
 		}
 
 		if remoteIP != nil {
 			if localNet.Contains(*remoteIP) {
-				class = LOCAL
+				m.Class = LOCAL
 			}
 		}
 	}
 
+	if trace != nil && remoteIP != nil {
+		trace.Add("local network rule won: dir %s class %s", m.Dir, m.Class)
+	}
+
 	if remoteIP != nil {
-		for _, peeringNet := range c.Peering {
-			if peeringNet.Contains(*remoteIP) {
-				class = PEERING
+		c.matchRemote(&m, *remoteIP, trace)
+	}
+
+	return m
+}
+
+// matchRemote refines class of match by peering networks, routes and special ranges of remote address
+func (c *Classifier) matchRemote(m *networkMatch, remoteIP net.IP, trace *Trace) {
+	for _, peeringNet := range c.Peering {
+		if peeringNet.Contains(remoteIP) {
+			m.Class = PEERING
+
+			if trace != nil {
+				trace.Add("remote %s matched peering network %s (%s)", remoteIP, peeringNet.String(), c.NetworkSources[peeringNet.String()])
 			}
 		}
+	}
+
+	if network, value, ok := c.Routes.LookupNetwork(remoteIP); ok {
+		route := value.(RouteInfo)
+		if route.Peering && m.Class == INTERNET {
+			m.Class = PEERING
+		}
+
+		m.RemoteASN = route.Origin
 
-		if c.Multicast.Contains(*remoteIP) {
-			class = MULTICAST
+		if trace != nil {
+			trace.Add("remote %s matched route %s origin AS%d peering %t (%s)", remoteIP, network.String(), route.Origin, route.Peering, route.Source)
 		}
 	}
 
-	if clientIP != nil {
-		intIP := IP2Int(*clientIP)
-		if id, ok := c.Users[intIP]; ok {
-			entry.UserID = id
+	// Special ranges don't override configured local and peering networks
+	if network, value, ok := c.Special.LookupNetwork(remoteIP); ok && m.Class == INTERNET {
+		special := value.(SpecialRange)
+		m.Class = special.Class
+
+		if trace != nil {
+			trace.Add("remote %s matched %s range %s (%s)", remoteIP, special.Name, network.String(), special.Source)
 		}
+	}
+}
 
-		entry.Dir = dir
-		entry.Class = class
+// lookupUser sets user of client address and its attributes to entry
+func (c *Classifier) lookupUser(entry *Entry, clientIP net.IP, dir string, iface *InterfaceConfig, trace *Trace) {
+	intIP := IP2Int(clientIP)
+
+	// Public NAT pool address is resolved to subscriber address
+	port := entry.SrcPort
+	if dir == IN {
+		port = entry.DstPort
+	}
+
+	if m, ok := c.findNAT(intIP, port, entry.Collected); ok {
+		intIP = IP2Int(m.Private)
+
+		if trace != nil {
+			trace.Add("NAT %s:%d resolved to %s (%s)", clientIP, port, m.Private, m.Source)
+		}
+	}
+
+	if id, ok := c.Users[intIP]; ok {
+		entry.UserID = id
+
+		if trace != nil {
+			trace.Add("user %s by address (%s)", id, c.UserSources[intIP])
+		}
+	} else if lease, ok := c.findLease(intIP, entry.Collected); ok {
+		entry.UserID = lease.UserID
+
+		if trace != nil {
+			trace.Add("user %s by lease (%s)", lease.UserID, lease.Source)
+		}
+	} else if lease, ok := c.findIfaceSession(entry); ok {
+		entry.UserID = lease.UserID
+
+		if trace != nil {
+			trace.Add("user %s by interface session (%s)", lease.UserID, lease.Source)
+		}
+	} else if iface != nil && iface.User != "" {
+		entry.UserID = iface.User
+
+		if trace != nil {
+			trace.Add("user %s by interface (config)", iface.User)
+		}
+	}
+
+	if values, ok := c.UserAttributes[entry.UserID]; ok && entry.UserID != "" {
+		entry.UserAttributes = values
+
+		if trace != nil {
+			trace.Add("user attributes %v", values)
+		}
 	}
 }
 
@@ -1,7 +1,11 @@
 package classifier
 
 import (
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -126,3 +130,78 @@ func TestShouldClassifyDirectionEntry(t *testing.T) {
 		t.Errorf("Should classify direction")
 	}
 }
+
+func TestShouldExplainEntry(t *testing.T) {
+	e := Entry{
+		SrcIP: net.ParseIP("192.168.0.1"),
+		DstIP: net.ParseIP("10.10.0.1"),
+	}
+
+	cfg := Config{}
+
+	cfg.Users.Users = make(map[string]string)
+	cfg.Users.Users["192.168.0.1"] = "1"
+
+	cfg.Networks.Networks = make(map[string]string)
+	cfg.Networks.Networks["192.168.0.0/16"] = "local"
+	cfg.Networks.Networks["10.10.0.0/16"] = "peering"
+
+	classifier := NewClassifier(cfg)
+	trace := classifier.Explain(&e)
+
+	expected := []string{
+		"src 192.168.0.1 matched local network 192.168.0.0/16 (config)",
+		"local network rule won: dir out class internet",
+		"remote 10.10.0.1 matched peering network 10.10.0.0/16 (config)",
+		"user 1 by address (config)",
+		"service unknown",
+		"result: dir out class peering user \"1\"",
+	}
+
+	if trace.String() != strings.Join(expected, "\n") {
+		t.Errorf("Trace mismatch:\n%s", trace)
+	}
+}
+
+func TestShouldCarryUserAttributes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "classifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "users.csv")
+	err = ioutil.WriteFile(file, []byte("id;ip;region;tariff\n1;192.168.0.1;north;base\n2;192.168.0.2;south;pro\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := Config{}
+	cfg.Users.Fetch.File = file
+	cfg.Users.Fetch.Comma = ";"
+	cfg.Users.Fetch.Header = true
+	cfg.Users.Fetch.Attributes = []string{"region", "reseller"}
+
+	cfg.Networks.Networks = make(map[string]string)
+	cfg.Networks.Networks["192.168.0.0/16"] = "local"
+
+	classifier := NewClassifier(cfg)
+
+	e := Entry{
+		SrcIP: net.ParseIP("8.8.8.8"),
+		DstIP: net.ParseIP("192.168.0.2"),
+	}
+	classifier.Classify(&e)
+
+	if e.UserID != "2" {
+		t.Errorf("Should classify user")
+	}
+
+	if e.UserAttributes["region"] != "south" || e.UserAttributes["reseller"] != "" {
+		t.Errorf("Attributes mismatch %v", e.UserAttributes)
+	}
+
+	if _, ok := e.UserAttributes["tariff"]; ok {
+		t.Errorf("Should carry only configured attributes")
+	}
+}
@@ -0,0 +1,124 @@
+package classifier
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+/*
+CommandConfig describes users or networks source printed by external command
+
+	CommandConfig {
+	  Command: Path to executable, e.g. script querying LDAP or CRM
+	  Args: Command arguments
+	  Env: Environment variables NAME=value added to ipcad2ch environment,
+	       list is used as viper lowercases map keys
+	  Timeout: Command is killed after timeout, default 30s
+	  Format: stdout format csv, tsv, json or yaml, default is fetch format
+	}
+*/
+type CommandConfig struct {
+	Command string        `mapstructure:"command"`
+	Args    []string      `mapstructure:"args"`
+	Env     []string      `mapstructure:"env" json:"-"`
+	Timeout time.Duration `mapstructure:"timeout"`
+	Format  string        `mapstructure:"format"`
+}
+
+func (c *Classifier) execUsers() error {
+	cfg := c.Config.Users.Command
+
+	log.Println(fmt.Sprintf("Running users command %s", cfg.Command))
+	c.source = fmt.Sprintf("command %s", cfg.Command)
+
+	fetched, err := Run(cfg)
+	if err != nil {
+		// Failed command is handled as unreachable url, previous users are used
+		if c.Config.Users.Fetch.Cache == "" {
+			return err
+		}
+
+		fetched, err = cachedDictionary("users", c.Config.Users.Fetch.FetchOptions, err)
+		if err != nil {
+			return err
+		}
+		c.source = fmt.Sprintf("cache %s of %s", c.Config.Users.Fetch.Cache, c.source)
+	}
+
+	return c.loadUsers("command", fetched)
+}
+
+func (c *Classifier) execNetworks() error {
+	cfg := c.Config.Networks.Command
+
+	log.Println(fmt.Sprintf("Running networks command %s", cfg.Command))
+	c.source = fmt.Sprintf("command %s", cfg.Command)
+
+	fetched, err := Run(cfg)
+	if err != nil {
+		if c.Config.Networks.Fetch.Cache == "" {
+			return err
+		}
+
+		fetched, err = cachedDictionary("networks", c.Config.Networks.Fetch.FetchOptions, err)
+		if err != nil {
+			return err
+		}
+		c.source = fmt.Sprintf("cache %s of %s", c.Config.Networks.Fetch.Cache, c.source)
+	}
+
+	return c.loadNetworks("command", fetched)
+}
+
+// Run executes command and returns its stdout, non-zero exit code or timeout is error
+func Run(cfg CommandConfig) (Fetched, error) {
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.Command(cfg.Command, cfg.Args...)
+	cmd.Env = append(os.Environ(), cfg.Env...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Start()
+	if err != nil {
+		return Fetched{}, fmt.Errorf("command %s failed: %v", cfg.Command, err)
+	}
+
+	// Children of killed command could hold output open, so it is not waited after timeout
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err = <-done:
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		return Fetched{}, fmt.Errorf("command %s timed out after %s", cfg.Command, timeout)
+	}
+
+	if err != nil {
+		return Fetched{}, fmt.Errorf("command %s failed: %v: %s", cfg.Command, err, strings.TrimSpace(stderr.String()))
+	}
+
+	if stderr.Len() > 0 {
+		log.Println(fmt.Sprintf("Command %s stderr: %s", cfg.Command, strings.TrimSpace(stderr.String())))
+	}
+
+	return Fetched{
+		URL:    cfg.Command,
+		Format: cfg.Format,
+		Time:   time.Now(),
+		Body:   stdout.String(),
+	}, nil
+}
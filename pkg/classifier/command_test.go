@@ -0,0 +1,49 @@
+package classifier
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShouldRunCommand(t *testing.T) {
+	fetched, err := Run(CommandConfig{
+		Command: "/bin/sh",
+		Args:    []string{"-c", `echo "$PREFIX.1;1"; echo warning >&2`},
+		Env:     []string{"PREFIX=10.0.0"},
+		Format:  "csv",
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fetched.Body != "10.0.0.1;1\n" || fetched.Format != "csv" {
+		t.Errorf("Command output mismatch %v", fetched)
+	}
+}
+
+func TestShouldFailCommand(t *testing.T) {
+	_, err := Run(CommandConfig{Command: "/bin/sh", Args: []string{"-c", "echo denied >&2; exit 2"}})
+	if err == nil || !strings.Contains(err.Error(), "denied") {
+		t.Errorf("Should fail with stderr, got %v", err)
+	}
+
+	_, err = Run(CommandConfig{Command: "/bin/sh", Args: []string{"-c", "sleep 5"}, Timeout: 100 * time.Millisecond})
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("Should time out, got %v", err)
+	}
+}
+
+func TestShouldExecUsers(t *testing.T) {
+	cfg := Config{}
+	cfg.Users.Command.Command = "/bin/sh"
+	cfg.Users.Command.Args = []string{"-c", `echo '{"10.0.0.1": "1", "10.0.0.2": "2"}'`}
+	cfg.Users.Command.Format = "json"
+
+	c := NewClassifier(cfg)
+
+	if len(c.Users) != 2 || c.Users[IP2Int(ParseUserIP("10.0.0.2"))] != "2" {
+		t.Errorf("Users mismatch %v", c.Users)
+	}
+}
@@ -0,0 +1,433 @@
+package classifier
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+DHCPConfig describes one DHCP lease database used as users source
+
+	DHCPConfig {
+	  Format: Lease database format: isc, kea, dnsmasq
+	  File: Path to lease database
+
+	  Match: Lease field used as customer key: mac, hostname, client-id,
+	         circuit-id, remote-id (option 82, isc only)
+
+	  Customers: hash map key => user id
+	  CustomersFile: CSV file with key and user id
+	  Comma: Field delimiter for CustomersFile
+	}
+*/
+type DHCPConfig struct {
+	Format        string            `mapstructure:"format"`
+	File          string            `mapstructure:"file"`
+	Match         string            `mapstructure:"match"`
+	Customers     map[string]string `mapstructure:"customers"`
+	CustomersFile string            `mapstructure:"customersFile"`
+	Comma         string            `mapstructure:"comma"`
+}
+
+// Lease binds user to ip for period of time, zero Start or End means unbounded
+type Lease struct {
+	UserID string
+	Start  time.Time
+	End    time.Time
+	Source string
+}
+
+// Active checks lease is valid at time t
+func (l Lease) Active(t time.Time) bool {
+	if !l.Start.IsZero() && t.Before(l.Start) {
+		return false
+	}
+
+	if !l.End.IsZero() && !t.Before(l.End) {
+		return false
+	}
+
+	return true
+}
+
+// DHCPLease is a lease record read from DHCP server database
+type DHCPLease struct {
+	IP        net.IP
+	Start     time.Time
+	End       time.Time
+	MAC       string
+	Hostname  string
+	ClientID  string
+	CircuitID string
+	RemoteID  string
+}
+
+// Key returns lease field used for customer lookup
+func (l DHCPLease) Key(match string) string {
+	switch match {
+	case "hostname":
+		return strings.ToLower(l.Hostname)
+	case "client-id":
+		return strings.ToLower(l.ClientID)
+	case "circuit-id":
+		return strings.ToLower(l.CircuitID)
+	case "remote-id":
+		return strings.ToLower(l.RemoteID)
+	}
+
+	return l.MAC
+}
+
+func (c *Classifier) readDHCP(cfg DHCPConfig) error {
+	log.Println(fmt.Sprintf("Reading %s DHCP leases from file %s", cfg.Format, cfg.File))
+
+	customers := make(map[string]string)
+	for key, id := range cfg.Customers {
+		customers[normalizeKey(cfg.Match, key)] = id
+	}
+
+	if cfg.CustomersFile != "" {
+		body, err := ioutil.ReadFile(cfg.CustomersFile)
+		if err != nil {
+			return fmt.Errorf("could not read DHCP customers: %v", err)
+		}
+
+		comma := ";"
+		if cfg.Comma != "" {
+			comma = cfg.Comma
+		}
+
+		r := csv.NewReader(strings.NewReader(string(body)))
+		r.Comma = rune(comma[0])
+		r.TrimLeadingSpace = true
+
+		for line := 1; ; line++ {
+			record, err := r.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("could not parse DHCP customers %s: %v", cfg.CustomersFile, err)
+			}
+
+			if len(record) < 2 {
+				return fmt.Errorf("could not parse DHCP customers %s: line %d has no user id", cfg.CustomersFile, line)
+			}
+
+			customers[normalizeKey(cfg.Match, record[0])] = record[1]
+		}
+	}
+
+	f, err := ioutil.ReadFile(cfg.File)
+	if err != nil {
+		return fmt.Errorf("could not read DHCP leases: %v", err)
+	}
+
+	var leases []DHCPLease
+	switch cfg.Format {
+	case "isc":
+		leases, err = ParseISCLeases(string(f))
+	case "kea":
+		leases, err = ParseKeaLeases(string(f))
+	case "dnsmasq":
+		leases, err = ParseDnsmasqLeases(string(f))
+	default:
+		err = fmt.Errorf("unknown DHCP leases format %s", cfg.Format)
+	}
+
+	if err != nil {
+		return fmt.Errorf("could not parse DHCP leases %s: %v", cfg.File, err)
+	}
+
+	source := fmt.Sprintf("dhcp %s file %s", cfg.Format, cfg.File)
+
+	matched := 0
+	for _, l := range leases {
+		id, ok := customers[l.Key(cfg.Match)]
+		if !ok || l.IP.To4() == nil {
+			continue
+		}
+
+		c.addLease(l.IP, Lease{UserID: id, Start: l.Start, End: l.End, Source: source})
+		matched = matched + 1
+	}
+
+	log.Println(fmt.Sprintf("Parsed %d leases, matched %d customers", len(leases), matched))
+
+	return nil
+}
+
+func (c *Classifier) addLease(ip net.IP, lease Lease) {
+	intIP := IP2Int(ip)
+	c.Leases[intIP] = append(c.Leases[intIP], lease)
+}
+
+// findLease returns lease active at time t, sessions have priority over DHCP leases
+func (c *Classifier) findLease(ip uint32, t time.Time) (Lease, bool) {
+	for _, leases := range [][]Lease{c.SessionLeases[ip], c.Leases[ip]} {
+		// Latest records win, lease databases are append only
+		for i := len(leases) - 1; i >= 0; i-- {
+			if leases[i].Active(t) {
+				return leases[i], true
+			}
+		}
+	}
+
+	return Lease{}, false
+}
+
+func normalizeKey(match string, key string) string {
+	key = strings.ToLower(strings.TrimSpace(key))
+	if match != "" && match != "mac" {
+		return key
+	}
+
+	hw, err := net.ParseMAC(key)
+	if err != nil {
+		return key
+	}
+
+	return hw.String()
+}
+
+// ParseISCLeases parses ISC dhcpd.leases file
+func ParseISCLeases(body string) ([]DHCPLease, error) {
+	leases := make([]DHCPLease, 0)
+
+	var current *DHCPLease
+	abandoned := false
+
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if current == nil {
+			fields := strings.Fields(line)
+			if len(fields) == 3 && fields[0] == "lease" && fields[2] == "{" {
+				ip := net.ParseIP(fields[1])
+				if ip == nil {
+					return nil, fmt.Errorf("could not parse lease ip %s", fields[1])
+				}
+
+				current = &DHCPLease{IP: ip}
+				abandoned = false
+			}
+			continue
+		}
+
+		if line == "}" {
+			if !abandoned {
+				leases = append(leases, *current)
+			}
+			current = nil
+			continue
+		}
+
+		line = strings.TrimSuffix(line, ";")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		switch fields[0] {
+		case "starts", "ends":
+			t, err := parseISCTime(fields[1:])
+			if err != nil {
+				return nil, err
+			}
+
+			if fields[0] == "starts" {
+				current.Start = t
+			} else {
+				current.End = t
+			}
+		case "binding":
+			abandoned = len(fields) > 2 && fields[2] == "abandoned"
+		case "hardware":
+			if len(fields) > 2 {
+				current.MAC = normalizeKey("mac", fields[2])
+			}
+		case "uid":
+			current.ClientID = unquote(strings.Join(fields[1:], " "))
+		case "client-hostname":
+			current.Hostname = unquote(strings.Join(fields[1:], " "))
+		case "option":
+			if len(fields) < 3 {
+				continue
+			}
+
+			value := unquote(strings.Join(fields[2:], " "))
+			switch fields[1] {
+			case "agent.circuit-id":
+				current.CircuitID = value
+			case "agent.remote-id":
+				current.RemoteID = value
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return leases, nil
+}
+
+func parseISCTime(fields []string) (time.Time, error) {
+	if fields[0] == "never" {
+		return time.Time{}, nil
+	}
+
+	if fields[0] == "epoch" && len(fields) > 1 {
+		sec, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		return time.Unix(sec, 0).UTC(), nil
+	}
+
+	if len(fields) < 3 {
+		return time.Time{}, fmt.Errorf("could not parse lease time %v", fields)
+	}
+
+	return time.Parse("2006/01/02 15:04:05", fields[1]+" "+fields[2])
+}
+
+// ParseKeaLeases parses Kea memfile CSV leases with header
+func ParseKeaLeases(body string) ([]DHCPLease, error) {
+	r := csv.NewReader(strings.NewReader(body))
+	r.FieldsPerRecord = -1
+
+	header, err := r.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[name] = i
+	}
+
+	for _, name := range []string{"address", "hwaddr", "client_id", "valid_lifetime", "expire", "hostname"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("kea leases column %s not found", name)
+		}
+	}
+
+	leases := make([]DHCPLease, 0)
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if len(record) != len(header) {
+			continue
+		}
+
+		// State 1 is declined lease
+		if i, ok := columns["state"]; ok && record[i] == "1" {
+			continue
+		}
+
+		ip := net.ParseIP(record[columns["address"]])
+		if ip == nil {
+			return nil, fmt.Errorf("could not parse lease ip %s", record[columns["address"]])
+		}
+
+		expire, err := strconv.ParseInt(record[columns["expire"]], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		lifetime, err := strconv.ParseInt(record[columns["valid_lifetime"]], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		leases = append(leases, DHCPLease{
+			IP:       ip,
+			Start:    time.Unix(expire-lifetime, 0).UTC(),
+			End:      time.Unix(expire, 0).UTC(),
+			MAC:      normalizeKey("mac", record[columns["hwaddr"]]),
+			ClientID: strings.ToLower(record[columns["client_id"]]),
+			Hostname: strings.ToLower(record[columns["hostname"]]),
+		})
+	}
+
+	return leases, nil
+}
+
+// ParseDnsmasqLeases parses dnsmasq leases file: expiry mac ip hostname client-id
+func ParseDnsmasqLeases(body string) ([]DHCPLease, error) {
+	leases := make([]DHCPLease, 0)
+
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+
+		// Skip DUID line of DHCPv6 leases
+		if len(fields) < 4 {
+			continue
+		}
+
+		ip := net.ParseIP(fields[2])
+		if ip == nil {
+			return nil, fmt.Errorf("could not parse lease ip %s", fields[2])
+		}
+
+		expiry, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		lease := DHCPLease{
+			IP:  ip,
+			MAC: normalizeKey("mac", fields[1]),
+		}
+
+		// Zero expiry means infinite lease
+		if expiry > 0 {
+			lease.End = time.Unix(expiry, 0).UTC()
+		}
+
+		if fields[3] != "*" {
+			lease.Hostname = strings.ToLower(fields[3])
+		}
+
+		if len(fields) > 4 && fields[4] != "*" {
+			lease.ClientID = strings.ToLower(fields[4])
+		}
+
+		leases = append(leases, lease)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return leases, nil
+}
+
+func unquote(s string) string {
+	if u, err := strconv.Unquote(s); err == nil {
+		return u
+	}
+
+	return strings.Trim(s, "\"")
+}
@@ -0,0 +1,148 @@
+package classifier
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShouldParseISCLeases(t *testing.T) {
+	body := `
+# The format of this file is documented in the dhcpd.leases(5) manual page.
+lease 192.168.0.10 {
+  starts 4 2020/11/19 10:00:00;
+  ends 4 2020/11/19 22:00:00;
+  binding state active;
+  hardware ethernet 00:11:22:AA:BB:CC;
+  client-hostname "Router";
+  option agent.circuit-id "eth0/1/2:100";
+  option agent.remote-id "olt-1";
+}
+lease 192.168.0.11 {
+  starts 4 2020/11/19 10:00:00;
+  ends never;
+  binding state abandoned;
+}
+`
+
+	leases, err := ParseISCLeases(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(leases) != 1 {
+		t.Fatalf("Should skip abandoned leases, got %d", len(leases))
+	}
+
+	l := leases[0]
+	if l.IP.String() != "192.168.0.10" {
+		t.Errorf("IP mismatch")
+	}
+
+	if l.MAC != "00:11:22:aa:bb:cc" || l.Key("hostname") != "router" {
+		t.Errorf("Keys mismatch")
+	}
+
+	if l.Key("circuit-id") != "eth0/1/2:100" || l.Key("remote-id") != "olt-1" {
+		t.Errorf("Option 82 mismatch")
+	}
+
+	if l.End.Sub(l.Start) != 12*time.Hour {
+		t.Errorf("Lease time mismatch")
+	}
+}
+
+func TestShouldParseKeaAndDnsmasqLeases(t *testing.T) {
+	kea := "address,hwaddr,client_id,valid_lifetime,expire,subnet_id,fqdn_fwd,fqdn_rev,hostname,state,user_context\n" +
+		"192.168.0.10,00:11:22:aa:bb:cc,01:00:11:22:aa:bb:cc,3600,1605787200,1,0,0,host,0,\n" +
+		"192.168.0.11,00:11:22:aa:bb:cd,,3600,1605787200,1,0,0,,1,\n"
+
+	leases, err := ParseKeaLeases(kea)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(leases) != 1 || leases[0].Start.Unix() != 1605783600 {
+		t.Errorf("Should parse kea leases")
+	}
+
+	dnsmasq := "1605787200 00:11:22:aa:bb:cc 192.168.0.10 host 01:00:11:22:aa:bb:cc\n" +
+		"0 00:11:22:aa:bb:cd 192.168.0.11 * *\n"
+
+	leases, err = ParseDnsmasqLeases(dnsmasq)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(leases) != 2 || !leases[1].End.IsZero() || leases[1].Hostname != "" {
+		t.Errorf("Should parse dnsmasq leases")
+	}
+}
+
+func TestShouldClassifyUserByLease(t *testing.T) {
+	cfg := Config{}
+
+	cfg.Networks.Networks = make(map[string]string)
+	cfg.Networks.Networks["192.168.0.0/16"] = "local"
+
+	c := NewClassifier(cfg)
+	c.addLease(net.ParseIP("192.168.0.10"), Lease{
+		UserID: "1",
+		Start:  time.Date(2020, 11, 19, 10, 0, 0, 0, time.UTC),
+		End:    time.Date(2020, 11, 19, 22, 0, 0, 0, time.UTC),
+	})
+
+	e := Entry{
+		SrcIP:     net.ParseIP("192.168.0.10"),
+		DstIP:     net.ParseIP("10.10.0.1"),
+		Collected: time.Date(2020, 11, 19, 12, 0, 0, 0, time.UTC),
+	}
+	c.Classify(&e)
+
+	if e.UserID != "1" {
+		t.Errorf("Should classify user by active lease")
+	}
+
+	e.UserID = ""
+	e.Collected = time.Date(2020, 11, 19, 23, 0, 0, 0, time.UTC)
+	c.Classify(&e)
+
+	if e.UserID != "" {
+		t.Errorf("Should not classify user by expired lease")
+	}
+}
+
+func TestShouldReturnDHCPErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "classifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	leases := filepath.Join(dir, "dhcpd.leases")
+	ioutil.WriteFile(leases, []byte("lease 192.168.0.10 {\n  starts 4 yesterday;\n}\n"), 0644)
+
+	customers := filepath.Join(dir, "customers.csv")
+	ioutil.WriteFile(customers, []byte("00:11:22:aa:bb:cc;1\n00:11:22:aa:bb:cd\n"), 0644)
+
+	cases := map[string]DHCPConfig{
+		"could not read DHCP leases":     {Format: "isc", File: filepath.Join(dir, "missing.leases")},
+		"could not parse DHCP leases":    {Format: "isc", File: leases},
+		"unknown DHCP leases format":     {Format: "udhcpd", File: leases},
+		"could not parse DHCP customers": {Format: "isc", File: leases, CustomersFile: customers},
+	}
+
+	for message, dhcp := range cases {
+		cfg := Config{}
+		cfg.Users.DHCP = []DHCPConfig{dhcp}
+
+		_, err := build(cfg, nil)
+		if err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("Should return %q, got %v", message, err)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package classifier
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"github.com/inkuber/ipcad2ch/pkg/metrics"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+FetchOptions describes dictionary fetching from url
+
+	FetchOptions {
+	  Timeout: Request timeout, default 30s
+	  Retries: Number of retries after failed request, default 3
+	  Backoff: Delay before first retry, doubled for every next retry, default 1s
+	  Cache: Path to file with last successfully parsed dictionary,
+	         used when url is unreachable
+
+	  Username, Password: Basic authentication credentials
+	  TokenFile: Path to file with bearer token
+	  TokenEnv: Environment variable with bearer token
+	  Headers: Additional request headers
+
+	  CA: Path to PEM bundle of trusted certificate authorities
+	  Cert, Key: Paths to PEM client certificate and key for mutual TLS
+	}
+*/
+type FetchOptions struct {
+	Timeout time.Duration `mapstructure:"timeout"`
+	Retries int           `mapstructure:"retries"`
+	Backoff time.Duration `mapstructure:"backoff"`
+	Cache   string        `mapstructure:"cache"`
+
+	Username  string            `mapstructure:"username"`
+	Password  string            `mapstructure:"password" json:"-"`
+	TokenFile string            `mapstructure:"tokenFile"`
+	TokenEnv  string            `mapstructure:"tokenEnv"`
+	Headers   map[string]string `mapstructure:"headers" json:"-"`
+
+	CA   string `mapstructure:"ca"`
+	Cert string `mapstructure:"cert"`
+	Key  string `mapstructure:"key"`
+}
+
+type clientKey struct {
+	Timeout time.Duration
+	CA      string
+	Cert    string
+	Key     string
+}
+
+var (
+	clientsMu sync.Mutex
+	clients   = make(map[clientKey]*http.Client)
+)
+
+// HTTPClient returns client with timeout and TLS settings of options,
+// clients are shared by sources with the same settings
+func HTTPClient(opts FetchOptions) (*http.Client, error) {
+	key := clientKey{Timeout: opts.Timeout, CA: opts.CA, Cert: opts.Cert, Key: opts.Key}
+
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+
+	if client, ok := clients[key]; ok {
+		return client, nil
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if opts.CA != "" || opts.Cert != "" {
+		tlsConfig := &tls.Config{}
+
+		if opts.CA != "" {
+			pem, err := ioutil.ReadFile(opts.CA)
+			if err != nil {
+				return nil, err
+			}
+
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in CA bundle %s", opts.CA)
+			}
+		}
+
+		if opts.Cert != "" {
+			cert, err := tls.LoadX509KeyPair(opts.Cert, opts.Key)
+			if err != nil {
+				return nil, err
+			}
+
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	client := &http.Client{Timeout: opts.Timeout, Transport: transport}
+	clients[key] = client
+
+	return client, nil
+}
+
+// NewRequest creates GET request with authentication and headers of options
+func NewRequest(url string, opts FetchOptions) (*http.Request, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, value := range opts.Headers {
+		req.Header.Set(name, value)
+	}
+
+	if opts.Username != "" {
+		req.SetBasicAuth(opts.Username, opts.Password)
+	}
+
+	token := ""
+	if opts.TokenFile != "" {
+		body, err := ioutil.ReadFile(opts.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		token = strings.TrimSpace(string(body))
+	}
+
+	if opts.TokenEnv != "" {
+		token = os.Getenv(opts.TokenEnv)
+		if token == "" {
+			return nil, fmt.Errorf("environment variable %s with token is empty", opts.TokenEnv)
+		}
+	}
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return req, nil
+}
+
+// Fetched is dictionary body downloaded from url
+type Fetched struct {
+	URL         string    `json:"url"`
+	ContentType string    `json:"contentType"`
+	Format      string    `json:"format,omitempty"`
+	Time        time.Time `json:"time"`
+	Body        string    `json:"body"`
+	Cached      bool      `json:"-"`
+}
+
+// Fetch downloads url with timeout and retries, only 2xx responses are accepted
+func Fetch(url string, opts FetchOptions) (Fetched, error) {
+	client, err := HTTPClient(opts)
+	if err != nil {
+		return Fetched{}, err
+	}
+
+	backoff := opts.Backoff
+
+	for attempt := 0; attempt <= opts.Retries; attempt++ {
+		if attempt > 0 {
+			log.Println(fmt.Sprintf("Retrying %s in %s after error: %v", url, backoff, err))
+			time.Sleep(backoff)
+			backoff = backoff * 2
+		}
+
+		var fetched Fetched
+		fetched, err = fetchOnce(client, url, opts)
+		if err == nil {
+			return fetched, nil
+		}
+	}
+
+	return Fetched{}, err
+}
+
+func fetchOnce(client *http.Client, url string, opts FetchOptions) (Fetched, error) {
+	req, err := NewRequest(url, opts)
+	if err != nil {
+		return Fetched{}, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return Fetched{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return Fetched{}, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return Fetched{}, fmt.Errorf("%s responded with status %s", url, resp.Status)
+	}
+
+	return Fetched{
+		URL:         url,
+		ContentType: resp.Header.Get("Content-Type"),
+		Time:        time.Now(),
+		Body:        string(body),
+	}, nil
+}
+
+// fetchDictionary fetches dictionary or falls back to cache when url is unreachable
+func fetchDictionary(name string, url string, opts FetchOptions) (Fetched, error) {
+	fetched, err := Fetch(url, opts)
+	if err == nil {
+		metrics.Set(fmt.Sprintf(`ipcad2ch_dictionary_cache_used{dictionary="%s"}`, name), 0)
+		return fetched, nil
+	}
+
+	metrics.Add(fmt.Sprintf(`ipcad2ch_dictionary_fetch_errors_total{dictionary="%s"}`, name), 1)
+
+	if opts.Cache == "" {
+		return Fetched{}, err
+	}
+
+	return cachedDictionary(name, opts, err)
+}
+
+// cachedDictionary reads last successfully parsed dictionary used instead of failed one
+func cachedDictionary(name string, opts FetchOptions, reason error) (Fetched, error) {
+	log.Println(fmt.Sprintf("WARNING: Could not load %s: %v", name, reason))
+
+	fetched, cacheErr := readCache(opts.Cache)
+	if cacheErr != nil {
+		return Fetched{}, fmt.Errorf("could not read %s cache %s: %v", name, opts.Cache, cacheErr)
+	}
+
+	age := time.Since(fetched.Time)
+
+	log.Println(fmt.Sprintf("WARNING: Using %s cached at %s from file %s", name, fetched.Time.Format(time.RFC3339), opts.Cache))
+
+	metrics.Set(fmt.Sprintf(`ipcad2ch_dictionary_cache_used{dictionary="%s"}`, name), 1)
+	metrics.Set(fmt.Sprintf(`ipcad2ch_dictionary_cache_age_seconds{dictionary="%s"}`, name), age.Seconds())
+
+	return fetched, nil
+}
+
+// saveCache stores successfully parsed dictionary, errors are only logged
+func saveCache(name string, fetched Fetched, opts FetchOptions) {
+	if opts.Cache == "" || fetched.Cached {
+		return
+	}
+
+	err := writeCache(opts.Cache, fetched)
+	if err != nil {
+		log.Println(fmt.Sprintf("WARNING: Could not write %s cache %s: %v", name, opts.Cache, err))
+	}
+}
+
+func readCache(file string) (Fetched, error) {
+	body, err := ioutil.ReadFile(file)
+	if err != nil {
+		return Fetched{}, err
+	}
+
+	var fetched Fetched
+	err = json.Unmarshal(body, &fetched)
+	if err != nil {
+		return Fetched{}, err
+	}
+
+	fetched.Cached = true
+
+	return fetched, nil
+}
+
+func writeCache(file string, fetched Fetched) error {
+	body, err := json.Marshal(fetched)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(file), ".cache")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(body)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), file)
+}
@@ -0,0 +1,155 @@
+package classifier
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestShouldRetryFetch(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = requests + 1
+		if requests < 3 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte(`{"error": "bad gateway"}`))
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/csv")
+		w.Write([]byte("1;10.0.0.1\n"))
+	}))
+	defer server.Close()
+
+	fetched, err := Fetch(server.URL, FetchOptions{Timeout: time.Second, Retries: 3, Backoff: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if requests != 3 {
+		t.Errorf("Should retry failed requests, got %d requests", requests)
+	}
+
+	if fetched.ContentType != "text/csv" || fetched.Body != "1;10.0.0.1\n" {
+		t.Errorf("Fetched mismatch %v", fetched)
+	}
+
+	requests = 0
+	_, err = Fetch(server.URL, FetchOptions{Timeout: time.Second, Retries: 1, Backoff: time.Millisecond})
+	if err == nil {
+		t.Errorf("Should fail on non 2xx status")
+	}
+}
+
+func TestShouldUseCacheWhenUnreachable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "classifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"10.0.0.1": "1"}`))
+	}))
+
+	cfg := Config{}
+	cfg.Users.Fetch.URL = server.URL
+	cfg.Users.Fetch.Cache = filepath.Join(dir, "users.cache")
+	cfg.Users.Fetch.Timeout = time.Second
+
+	c := NewClassifier(cfg)
+	if c.Users[IP2Int(net.ParseIP("10.0.0.1"))] != "1" {
+		t.Errorf("Should fetch users")
+	}
+
+	server.Close()
+
+	cfg.Users.Users = nil
+	c = NewClassifier(cfg)
+	if c.Users[IP2Int(net.ParseIP("10.0.0.1"))] != "1" {
+		t.Errorf("Should read users from cache")
+	}
+
+	if c.UserSources[IP2Int(net.ParseIP("10.0.0.1"))] != "cache "+cfg.Users.Fetch.Cache+" of url "+server.URL {
+		t.Errorf("Source mismatch %s", c.UserSources[IP2Int(net.ParseIP("10.0.0.1"))])
+	}
+}
+
+func TestShouldAuthenticateFetch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "classifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, _ := r.BasicAuth()
+		if r.URL.Path == "/basic" && (username != "billing" || password != "secret") {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if r.URL.Path == "/bearer" && r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if r.Header.Get("X-Api-Version") != "2" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	ca := filepath.Join(dir, "ca.pem")
+	err = ioutil.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := filepath.Join(dir, "token")
+	err = ioutil.WriteFile(token, []byte("token\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	headers := map[string]string{"x-api-version": "2"}
+
+	_, err = Fetch(server.URL+"/basic", FetchOptions{Timeout: time.Second, Headers: headers})
+	if err == nil {
+		t.Errorf("Should not trust unknown CA")
+	}
+
+	_, err = Fetch(server.URL+"/basic", FetchOptions{Timeout: time.Second, CA: ca, Headers: headers})
+	if err == nil {
+		t.Errorf("Should fail without credentials")
+	}
+
+	_, err = Fetch(server.URL+"/basic", FetchOptions{Timeout: time.Second, CA: ca, Headers: headers, Username: "billing", Password: "secret"})
+	if err != nil {
+		t.Errorf("Should authenticate with basic auth %v", err)
+	}
+
+	_, err = Fetch(server.URL+"/bearer", FetchOptions{Timeout: time.Second, CA: ca, Headers: headers, TokenFile: token})
+	if err != nil {
+		t.Errorf("Should authenticate with token from file %v", err)
+	}
+
+	os.Setenv("IPCAD2CH_TEST_TOKEN", "token")
+	defer os.Unsetenv("IPCAD2CH_TEST_TOKEN")
+
+	_, err = Fetch(server.URL+"/bearer", FetchOptions{Timeout: time.Second, CA: ca, Headers: headers, TokenEnv: "IPCAD2CH_TEST_TOKEN"})
+	if err != nil {
+		t.Errorf("Should authenticate with token from env %v", err)
+	}
+}
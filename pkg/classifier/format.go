@@ -0,0 +1,197 @@
+package classifier
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Record is dictionary row, fields are named by header, object keys or column indexes
+type Record map[string]string
+
+/*
+RecordFormat describes how dictionary rows are parsed
+
+	RecordFormat {
+	  Format: csv, tsv, json or yaml
+	  Comma: Field delimiter for csv
+	  Header: First csv or tsv row is header with column names,
+	          otherwise columns are named by index: "0", "1", ...
+	  Key, Value: Field names for json or yaml map of key => value
+	}
+*/
+type RecordFormat struct {
+	Format string
+	Comma  string
+	Header bool
+	Key    string
+	Value  string
+}
+
+// DetectFormat returns explicit format or format inferred from content type or file extension
+func DetectFormat(format string, contentType string, file string) (string, error) {
+	if format != "" {
+		switch format {
+		case "csv", "tsv", "json", "yaml":
+			return format, nil
+		}
+		return "", fmt.Errorf("unknown format %s", format)
+	}
+
+	switch {
+	case strings.Contains(contentType, "json"):
+		return "json", nil
+	case strings.Contains(contentType, "text/csv"):
+		return "csv", nil
+	case strings.Contains(contentType, "tab-separated-values"):
+		return "tsv", nil
+	case strings.Contains(contentType, "yaml"):
+		return "yaml", nil
+	}
+
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".json":
+		return "json", nil
+	case ".csv":
+		return "csv", nil
+	case ".tsv":
+		return "tsv", nil
+	case ".yaml", ".yml":
+		return "yaml", nil
+	}
+
+	if contentType != "" {
+		return "", fmt.Errorf("could not detect format of content type %s, set format explicitly", contentType)
+	}
+
+	return "", fmt.Errorf("could not detect format of %s, set format explicitly", file)
+}
+
+// ParseRecords parses dictionary body, unparseable rows are errors
+func ParseRecords(body []byte, f RecordFormat) ([]Record, error) {
+	switch f.Format {
+	case "csv":
+		comma := ';'
+		if f.Comma != "" {
+			comma = rune(f.Comma[0])
+		}
+		return parseDelimited(body, comma, f.Header)
+	case "tsv":
+		return parseDelimited(body, '\t', f.Header)
+	case "json":
+		var value interface{}
+		err := json.Unmarshal(body, &value)
+		if err != nil {
+			return nil, err
+		}
+		return objectRecords(value, f)
+	case "yaml":
+		var value interface{}
+		err := yaml.Unmarshal(body, &value)
+		if err != nil {
+			return nil, err
+		}
+		return objectRecords(value, f)
+	}
+
+	return nil, fmt.Errorf("unknown format %s", f.Format)
+}
+
+func parseDelimited(body []byte, comma rune, header bool) ([]Record, error) {
+	r := csv.NewReader(bytes.NewReader(body))
+	r.Comma = comma
+	r.TrimLeadingSpace = true
+	r.LazyQuotes = comma == '\t'
+
+	var names []string
+	records := make([]Record, 0)
+
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if names == nil {
+			names = make([]string, len(row))
+			for i := range row {
+				names[i] = strconv.Itoa(i)
+				if header {
+					names[i] = strings.TrimSpace(row[i])
+				}
+			}
+
+			if header {
+				continue
+			}
+		}
+
+		record := make(Record)
+		for i, value := range row {
+			record[names[i]] = strings.TrimSpace(value)
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+// objectRecords converts map of key => value or array of objects into records
+func objectRecords(value interface{}, f RecordFormat) ([]Record, error) {
+	records := make([]Record, 0)
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			records = append(records, Record{f.Key: key, f.Value: scalar(value)})
+		}
+	case map[interface{}]interface{}:
+		for key, value := range v {
+			records = append(records, Record{f.Key: scalar(key), f.Value: scalar(value)})
+		}
+	case []interface{}:
+		for i, item := range v {
+			record := make(Record)
+			switch object := item.(type) {
+			case map[string]interface{}:
+				for key, value := range object {
+					record[key] = scalar(value)
+				}
+			case map[interface{}]interface{}:
+				for key, value := range object {
+					record[scalar(key)] = scalar(value)
+				}
+			default:
+				return nil, fmt.Errorf("item %d is not an object", i)
+			}
+			records = append(records, record)
+		}
+	case nil:
+	default:
+		return nil, fmt.Errorf("expected object or array of objects")
+	}
+
+	return records, nil
+}
+
+func scalar(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,112 @@
+package classifier
+
+import (
+	"testing"
+)
+
+func TestShouldDetectFormat(t *testing.T) {
+	tests := []struct {
+		format      string
+		contentType string
+		file        string
+		expected    string
+	}{
+		{"", "application/json; charset=utf-8", "", "json"},
+		{"", "text/csv", "", "csv"},
+		{"", "text/tab-separated-values", "", "tsv"},
+		{"", "application/x-yaml", "", "yaml"},
+		{"", "", "users.yml", "yaml"},
+		{"", "", "http://billing/users.tsv", "tsv"},
+		{"csv", "text/plain", "users.txt", "csv"},
+	}
+
+	for _, test := range tests {
+		format, err := DetectFormat(test.format, test.contentType, test.file)
+		if err != nil || format != test.expected {
+			t.Errorf("Format mismatch %v: %s %v", test, format, err)
+		}
+	}
+
+	_, err := DetectFormat("", "text/plain", "users.txt")
+	if err == nil {
+		t.Errorf("Should fail on unknown format")
+	}
+}
+
+func TestShouldParseRecords(t *testing.T) {
+	records, err := ParseRecords([]byte("ip;tariff;id\n10.0.0.1;base;1\n10.0.0.2; pro; 2\n"), RecordFormat{Format: "csv", Comma: ";", Header: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 2 || records[1]["ip"] != "10.0.0.2" || records[1]["id"] != "2" || records[1]["tariff"] != "pro" {
+		t.Errorf("Header CSV mismatch %v", records)
+	}
+
+	records, err = ParseRecords([]byte("1\t10.0.0.1\n"), RecordFormat{Format: "tsv"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 1 || records[0]["0"] != "1" || records[0]["1"] != "10.0.0.1" {
+		t.Errorf("TSV mismatch %v", records)
+	}
+
+	records, err = ParseRecords([]byte(`[{"ip": "10.0.0.1", "id": 1}]`), RecordFormat{Format: "json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 1 || records[0]["id"] != "1" {
+		t.Errorf("JSON array mismatch %v", records)
+	}
+
+	records, err = ParseRecords([]byte("- ip: 10.0.0.1\n  id: 1\n"), RecordFormat{Format: "yaml"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 1 || records[0]["ip"] != "10.0.0.1" || records[0]["id"] != "1" {
+		t.Errorf("YAML array mismatch %v", records)
+	}
+
+	records, err = ParseRecords([]byte("10.0.0.1: 1\n"), RecordFormat{Format: "yaml", Key: "ip", Value: "id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 1 || records[0]["ip"] != "10.0.0.1" || records[0]["id"] != "1" {
+		t.Errorf("YAML map mismatch %v", records)
+	}
+
+	_, err = ParseRecords([]byte("1;10.0.0.1\n2\n"), RecordFormat{Format: "csv", Comma: ";"})
+	if err == nil {
+		t.Errorf("Should fail on wrong number of fields")
+	}
+}
+
+func TestShouldRejectBadUsers(t *testing.T) {
+	c := NewClassifier(Config{})
+	c.Config.Users.Fetch.Header = true
+	c.Config.Users.Fetch.Comma = ";"
+
+	_, _, err := c.parseUsers(Fetched{URL: "users.csv", Body: "id;ip\n"})
+	if err == nil {
+		t.Errorf("Should fail on empty source")
+	}
+
+	_, _, err = c.parseUsers(Fetched{URL: "users.csv", Body: "ip;id\n10.0.0.1;1\n10.0.0;2\n"})
+	if err == nil {
+		t.Errorf("Should fail on invalid ip")
+	}
+
+	users, _, err := c.parseUsers(Fetched{URL: "users.csv", Body: "ip;id\n10.0.0.1/32;1\n"})
+	if err != nil || users["10.0.0.1/32"] != "1" {
+		t.Errorf("Should parse users %v", err)
+	}
+
+	_, err = c.parseNetworks(Fetched{ContentType: "application/json", Body: `{"10.0.0.0/8": "locla"}`})
+	if err == nil {
+		t.Errorf("Should fail on unknown class")
+	}
+}
@@ -0,0 +1,165 @@
+package classifier
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+)
+
+/*
+Safeguards describes checks of new dictionary before it is applied,
+rejected dictionary is replaced by previous one kept in memory by running
+classifier, fetch cache file is used as previous one on start only
+
+	Safeguards {
+	  MaxRemoved: Max percentage of previous entries removed in new dictionary
+	  MinEntries: Min number of entries in new dictionary
+	  RejectOverlaps: Reject dictionary with overlapping networks or duplicate addresses
+	}
+*/
+type Safeguards struct {
+	MaxRemoved     float64 `mapstructure:"maxRemoved"`
+	MinEntries     int     `mapstructure:"minEntries"`
+	RejectOverlaps bool    `mapstructure:"rejectOverlaps"`
+}
+
+// DictionaryDiff is keys added, removed and changed in new dictionary
+type DictionaryDiff struct {
+	Added   []string
+	Removed []string
+	Changed []string
+}
+
+// Diff compares dictionaries of key => value
+func Diff(previous map[string]string, next map[string]string) DictionaryDiff {
+	diff := DictionaryDiff{Added: []string{}, Removed: []string{}, Changed: []string{}}
+
+	for key, value := range next {
+		old, ok := previous[key]
+		if !ok {
+			diff.Added = append(diff.Added, key)
+		} else if old != value {
+			diff.Changed = append(diff.Changed, key)
+		}
+	}
+
+	for key := range previous {
+		if _, ok := next[key]; !ok {
+			diff.Removed = append(diff.Removed, key)
+		}
+	}
+
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Strings(diff.Changed)
+
+	return diff
+}
+
+func (d DictionaryDiff) String() string {
+	return fmt.Sprintf("added:%d removed:%d changed:%d", len(d.Added), len(d.Removed), len(d.Changed))
+}
+
+// Report logs diff with first entries of every kind
+func (d DictionaryDiff) Report(name string, previous map[string]string, next map[string]string, limit int) {
+	log.Println(fmt.Sprintf("Dictionary %s diff %s", name, d))
+
+	sample := func(keys []string, format func(string) string) {
+		for i, key := range keys {
+			if i == limit {
+				log.Println(fmt.Sprintf("  ... %d more", len(keys)-limit))
+				return
+			}
+			log.Println("  " + format(key))
+		}
+	}
+
+	sample(d.Added, func(key string) string { return fmt.Sprintf("+ %s %s", key, next[key]) })
+	sample(d.Removed, func(key string) string { return fmt.Sprintf("- %s %s", key, previous[key]) })
+	sample(d.Changed, func(key string) string { return fmt.Sprintf("~ %s %s -> %s", key, previous[key], next[key]) })
+}
+
+// Check returns error when new dictionary violates safeguards, previous is nil when unknown
+func (g Safeguards) Check(previous map[string]string, next map[string]string) error {
+	if g.MinEntries > 0 && len(next) < g.MinEntries {
+		return fmt.Errorf("%d entries is less than minimum %d", len(next), g.MinEntries)
+	}
+
+	if g.MaxRemoved > 0 && len(previous) > 0 {
+		removed := len(Diff(previous, next).Removed)
+		percent := float64(removed) * 100 / float64(len(previous))
+		if percent > g.MaxRemoved {
+			return fmt.Errorf("%d of %d entries removed (%.1f%%), maximum is %.1f%%", removed, len(previous), percent, g.MaxRemoved)
+		}
+	}
+
+	if g.RejectOverlaps {
+		keys := make([]string, 0, len(next))
+		for key := range next {
+			keys = append(keys, key)
+		}
+
+		if overlaps := Overlaps(keys); len(overlaps) > 0 {
+			return fmt.Errorf("%d overlapping entries, first %s and %s", len(overlaps), overlaps[0][0], overlaps[0][1])
+		}
+	}
+
+	return nil
+}
+
+// Overlaps returns pairs of networks contained in other ones, addresses are /32 networks
+func Overlaps(cidrs []string) [][2]string {
+	type item struct {
+		cidr    string
+		network *net.IPNet
+	}
+
+	items := make([]item, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		value := cidr
+		if !strings.Contains(value, "/") {
+			value = value + "/32"
+			if strings.Contains(cidr, ":") {
+				value = cidr + "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			continue
+		}
+
+		items = append(items, item{cidr: cidr, network: network})
+	}
+
+	// Networks are sorted by address and wider network first, so containing network
+	// is always on stack of open networks
+	sort.Slice(items, func(i, j int) bool {
+		if c := bytes.Compare(items[i].network.IP.To16(), items[j].network.IP.To16()); c != 0 {
+			return c < 0
+		}
+		onesI, _ := items[i].network.Mask.Size()
+		onesJ, _ := items[j].network.Mask.Size()
+		return onesI < onesJ
+	})
+
+	overlaps := make([][2]string, 0)
+	stack := make([]item, 0)
+
+	for _, it := range items {
+		for len(stack) > 0 && !stack[len(stack)-1].network.Contains(it.network.IP) {
+			stack = stack[:len(stack)-1]
+		}
+
+		if len(stack) > 0 {
+			overlaps = append(overlaps, [2]string{stack[len(stack)-1].cidr, it.cidr})
+		}
+
+		stack = append(stack, it)
+	}
+
+	return overlaps
+}
@@ -0,0 +1,155 @@
+package classifier
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestShouldDiffDictionaries(t *testing.T) {
+	previous := map[string]string{"10.0.0.1": "1", "10.0.0.2": "2", "10.0.0.3": "3"}
+	next := map[string]string{"10.0.0.1": "1", "10.0.0.2": "5", "10.0.0.4": "4"}
+
+	diff := Diff(previous, next)
+
+	if diff.String() != "added:1 removed:1 changed:1" {
+		t.Errorf("Diff mismatch %s", diff)
+	}
+
+	if diff.Added[0] != "10.0.0.4" || diff.Removed[0] != "10.0.0.3" || diff.Changed[0] != "10.0.0.2" {
+		t.Errorf("Diff keys mismatch %v", diff)
+	}
+}
+
+func TestShouldCheckSafeguards(t *testing.T) {
+	previous := map[string]string{"10.0.0.1": "1", "10.0.0.2": "2", "10.0.0.3": "3", "10.0.0.4": "4"}
+
+	guards := Safeguards{MaxRemoved: 50, MinEntries: 2}
+
+	if err := guards.Check(previous, map[string]string{"10.0.0.1": "1", "10.0.0.2": "2"}); err != nil {
+		t.Errorf("Should accept 50%% removed %v", err)
+	}
+
+	if err := guards.Check(previous, map[string]string{"10.0.0.1": "1", "10.0.0.5": "5"}); err == nil {
+		t.Errorf("Should reject 75%% removed")
+	}
+
+	if err := guards.Check(nil, map[string]string{"10.0.0.1": "1"}); err == nil {
+		t.Errorf("Should reject less than minimum entries")
+	}
+
+	guards = Safeguards{RejectOverlaps: true}
+
+	if err := guards.Check(nil, map[string]string{"10.0.0.0/8": "local", "10.1.0.0/16": "peering"}); err == nil {
+		t.Errorf("Should reject overlapping networks")
+	}
+
+	if err := guards.Check(nil, map[string]string{"10.0.0.1": "1", "10.0.0.1/32": "2"}); err == nil {
+		t.Errorf("Should reject duplicate addresses")
+	}
+}
+
+func TestShouldFindOverlaps(t *testing.T) {
+	overlaps := Overlaps([]string{"10.1.0.0/16", "192.168.0.0/24", "10.0.0.0/8", "10.2.3.0/24", "192.168.1.0/24"})
+
+	if len(overlaps) != 2 {
+		t.Fatalf("Should find 2 overlaps, got %v", overlaps)
+	}
+
+	if overlaps[0] != [2]string{"10.0.0.0/8", "10.1.0.0/16"} || overlaps[1] != [2]string{"10.0.0.0/8", "10.2.3.0/24"} {
+		t.Errorf("Overlaps mismatch %v", overlaps)
+	}
+}
+
+func TestShouldKeepPreviousUsersWhenRejected(t *testing.T) {
+	dir, err := ioutil.TempDir("", "classifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "users.json")
+
+	cfg := Config{}
+	cfg.Users.Fetch.File = file
+	cfg.Users.Fetch.Cache = filepath.Join(dir, "users.cache")
+	cfg.Users.Fetch.MaxRemoved = 50
+
+	err = ioutil.WriteFile(file, []byte(`{"10.0.0.1": "1", "10.0.0.2": "2", "10.0.0.3": "3"}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewClassifier(cfg)
+	if len(c.Users) != 3 {
+		t.Errorf("Should load users, got %d", len(c.Users))
+	}
+
+	err = ioutil.WriteFile(file, []byte(`{"10.0.0.1": "1"}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.Users.Users = nil
+	c = NewClassifier(cfg)
+	if len(c.Users) != 3 {
+		t.Errorf("Should keep previous users, got %d", len(c.Users))
+	}
+
+	err = ioutil.WriteFile(file, []byte(`{"10.0.0.1": "1", "10.0.0.2": "2", "10.0.0.4": "4"}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.Users.Users = nil
+	c = NewClassifier(cfg)
+	if len(c.Users) != 3 || c.Users[IP2Int(ParseUserIP("10.0.0.4"))] != "4" {
+		t.Errorf("Should apply accepted users %v", c.Users)
+	}
+}
+
+func TestShouldKeepPreviousUsersInMemoryWithoutCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "classifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "users.json")
+
+	cfg := Config{}
+	cfg.Users.Fetch.File = file
+	cfg.Users.Fetch.MaxRemoved = 50
+
+	err = ioutil.WriteFile(file, []byte(`{"10.0.0.1": "1", "10.0.0.2": "2", "10.0.0.3": "3"}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewClassifier(cfg)
+
+	err = ioutil.WriteFile(file, []byte(`{"10.0.0.1": "1"}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.Reload()
+	if err != nil {
+		t.Errorf("Should reload with previous users, got %v", err)
+	}
+
+	if len(c.Users) != 3 || c.UserSources[IP2Int(ParseUserIP("10.0.0.3"))] != "previous file "+file {
+		t.Errorf("Should keep previous users %v %v", c.Users, c.UserSources)
+	}
+
+	err = ioutil.WriteFile(file, []byte(`{"10.0.0.1": "1", "10.0.0.2": "2", "10.0.0.4": "4"}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Reload()
+	if len(c.Users) != 3 || c.Users[IP2Int(ParseUserIP("10.0.0.4"))] != "4" {
+		t.Errorf("Should apply accepted users %v", c.Users)
+	}
+}
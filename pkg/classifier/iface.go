@@ -0,0 +1,159 @@
+package classifier
+
+import (
+	"fmt"
+	"net"
+	"path"
+)
+
+/*
+InterfaceConfig describes role of exporter interface, rules are checked in order
+
+	InterfaceConfig {
+	  Exporter: Exporter name, empty matches any
+	  Iface: Interface name or glob pattern, e.g. "ng*", "vlan10*"
+	  Role: Interface role: uplink, customer, peering
+	  Side: Endpoint of our side for flows without local endpoint: src, dst,
+	        by default it is decided by role, see classifyInterface
+	  User: User id owning the interface
+	}
+*/
+type InterfaceConfig struct {
+	Exporter string `mapstructure:"exporter"`
+	Iface    string `mapstructure:"iface"`
+	Role     string `mapstructure:"role"`
+	Side     string `mapstructure:"side"`
+	User     string `mapstructure:"user"`
+}
+
+var (
+	// UPLINK interface role
+	UPLINK string = "uplink"
+
+	// CUSTOMER interface role
+	CUSTOMER string = "customer"
+)
+
+func (c *Classifier) compileInterfaces() error {
+	for _, iface := range c.Config.Interfaces {
+		if _, err := path.Match(iface.Iface, ""); err != nil {
+			return fmt.Errorf("could not parse interface pattern %s %v", iface.Iface, err)
+		}
+
+		switch iface.Role {
+		case UPLINK, CUSTOMER, PEERING, "":
+		default:
+			return fmt.Errorf("unknown role %s of interface %s", iface.Role, iface.Iface)
+		}
+
+		switch iface.Side {
+		case "src", "dst", "":
+		default:
+			return fmt.Errorf("unknown side %s of interface %s", iface.Side, iface.Iface)
+		}
+	}
+
+	return nil
+}
+
+func (c *Classifier) lookupInterface(entry *Entry) *InterfaceConfig {
+	for i, iface := range c.Config.Interfaces {
+		if iface.Exporter != "" && iface.Exporter != entry.Exporter {
+			continue
+		}
+
+		if ok, _ := path.Match(iface.Iface, entry.Iface); ok {
+			return &c.Config.Interfaces[i]
+		}
+	}
+
+	return nil
+}
+
+/*
+classifyInterface decides our side and class by interface role
+
+Our side is the endpoint set by side option, else known user address, else subscriber
+address (RFC1918 or CGNAT) when the other endpoint is not. Otherwise role decides:
+customer interface receives flows from customers, so source is our side, uplink and
+peering interfaces receive flows from remote networks, so destination is our side
+*/
+func (c *Classifier) classifyInterface(iface *InterfaceConfig, entry *Entry) (clientIP, remoteIP *net.IP, dir string, class string) {
+	if iface.Role == "" {
+		return nil, nil, UNKNOWN, UNKNOWN
+	}
+
+	side := iface.Side
+	if side == "" {
+		side = c.interfaceSide(iface, entry)
+	}
+
+	clientIP, remoteIP, dir = &entry.SrcIP, &entry.DstIP, OUT
+	if side == "dst" {
+		clientIP, remoteIP, dir = &entry.DstIP, &entry.SrcIP, IN
+	}
+
+	class = INTERNET
+	if iface.Role == PEERING {
+		class = PEERING
+	}
+
+	return clientIP, remoteIP, dir, class
+}
+
+// interfaceSide returns our side of flow captured on interface without side option
+func (c *Classifier) interfaceSide(iface *InterfaceConfig, entry *Entry) string {
+	_, srcUser := c.Users[IP2Int(entry.SrcIP)]
+	_, dstUser := c.Users[IP2Int(entry.DstIP)]
+	if srcUser != dstUser {
+		if srcUser {
+			return "src"
+		}
+		return "dst"
+	}
+
+	srcSubscriber, dstSubscriber := isSubscriberIP(entry.SrcIP), isSubscriberIP(entry.DstIP)
+	if srcSubscriber != dstSubscriber {
+		if srcSubscriber {
+			return "src"
+		}
+		return "dst"
+	}
+
+	if iface.Role == CUSTOMER {
+		return "src"
+	}
+
+	return "dst"
+}
+
+// subscriberNetworks are address spaces of subscribers behind NAT, see DefaultRanges
+var subscriberNetworks = rangeNetworks("rfc1918", "cgnat")
+
+func rangeNetworks(names ...string) []net.IPNet {
+	networks := make([]net.IPNet, 0)
+	for _, r := range DefaultRanges {
+		for _, name := range names {
+			if r.Name != name {
+				continue
+			}
+
+			for _, cidr := range r.CIDRs {
+				_, network, _ := net.ParseCIDR(cidr)
+				networks = append(networks, *network)
+			}
+		}
+	}
+
+	return networks
+}
+
+func isSubscriberIP(ip net.IP) bool {
+	for _, network := range subscriberNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,119 @@
+package classifier
+
+import (
+	"net"
+	"testing"
+)
+
+func TestShouldClassifyByInterfaceRole(t *testing.T) {
+	cfg := Config{}
+
+	cfg.Networks.Networks = make(map[string]string)
+	cfg.Networks.Networks["192.168.0.0/16"] = "local"
+
+	cfg.Interfaces = []InterfaceConfig{
+		{Exporter: "bras1", Iface: "ng12", Role: "customer", User: "12"},
+		{Exporter: "bras1", Iface: "ng*", Role: "customer"},
+		{Iface: "ix0", Role: "peering", Side: "dst"},
+	}
+
+	classifier := NewClassifier(cfg)
+
+	e := Entry{
+		SrcIP:    net.ParseIP("10.0.0.12"),
+		DstIP:    net.ParseIP("8.8.8.8"),
+		SrcPort:  50000,
+		DstPort:  53,
+		Iface:    "ng12",
+		Exporter: "bras1",
+	}
+	classifier.Classify(&e)
+
+	if e.Dir != "out" || e.Class != "internet" || e.UserID != "12" {
+		t.Errorf("Should classify by customer interface %v", e)
+	}
+
+	e = Entry{
+		SrcIP:    net.ParseIP("8.8.8.8"),
+		DstIP:    net.ParseIP("10.0.0.13"),
+		SrcPort:  53,
+		DstPort:  50000,
+		Iface:    "ng13",
+		Exporter: "bras1",
+	}
+	classifier.Classify(&e)
+
+	if e.Dir != "in" || e.Class != "internet" || e.UserID != "" {
+		t.Errorf("Should classify direction by ports %v", e)
+	}
+
+	e = Entry{
+		SrcIP:    net.ParseIP("1.1.1.1"),
+		DstIP:    net.ParseIP("10.0.0.13"),
+		SrcPort:  50000,
+		DstPort:  443,
+		Iface:    "ix0",
+		Exporter: "border",
+	}
+	classifier.Classify(&e)
+
+	if e.Dir != "in" || e.Class != "peering" {
+		t.Errorf("Should classify by fixed side %v", e)
+	}
+
+	e.Iface = "ng13"
+	classifier.Classify(&e)
+
+	if e.Dir != "unknown" || e.Class != "unknown" {
+		t.Errorf("Should not match other exporter interface %v", e)
+	}
+}
+
+func TestShouldDecideSideByInterfaceRole(t *testing.T) {
+	cfg := Config{}
+
+	cfg.Users.Users = map[string]string{"5.5.5.5": "5"}
+
+	cfg.Interfaces = []InterfaceConfig{
+		{Iface: "vlan*", Role: "customer"},
+		{Iface: "em0", Role: "uplink"},
+		{Iface: "ix0", Role: "peering"},
+	}
+
+	classifier := NewClassifier(cfg)
+
+	cases := []struct {
+		iface string
+		src   string
+		dst   string
+		dir   string
+	}{
+		// Public endpoints only, role decides
+		{"vlan10", "6.6.6.6", "7.7.7.7", "out"},
+		{"em0", "6.6.6.6", "7.7.7.7", "in"},
+		{"ix0", "6.6.6.6", "7.7.7.7", "in"},
+
+		// Subscriber address is our side on any role
+		{"vlan10", "7.7.7.7", "100.64.0.7", "in"},
+		{"em0", "100.64.0.7", "7.7.7.7", "out"},
+
+		// Known user address is our side on any role
+		{"vlan10", "7.7.7.7", "5.5.5.5", "in"},
+		{"em0", "5.5.5.5", "7.7.7.7", "out"},
+	}
+
+	for _, test := range cases {
+		e := Entry{
+			SrcIP:   net.ParseIP(test.src),
+			DstIP:   net.ParseIP(test.dst),
+			SrcPort: 443,
+			DstPort: 50000,
+			Iface:   test.iface,
+		}
+		classifier.Classify(&e)
+
+		if e.Dir != test.dir {
+			t.Errorf("Flow %s -> %s on %s should be %s, got %s", test.src, test.dst, test.iface, test.dir, e.Dir)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package classifier
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+var logTimeLayouts = []string{
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+}
+
+// ParseLogTime parses timestamp at the beginning of log line, supported formats:
+// syslog "Nov 19 10:00:00", "Nov 19 2020 10:00:00", RFC3339,
+// "[2006-01-02 15:04:05]", "[1605780000.123456]", rest of line is returned
+func ParseLogTime(line string, now time.Time) (time.Time, string, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return time.Time{}, line, false
+	}
+
+	if line[0] == '[' {
+		end := strings.IndexByte(line, ']')
+		if end == -1 {
+			return time.Time{}, line, false
+		}
+
+		value, rest := line[1:end], strings.TrimLeft(line[end+1:], ": ")
+
+		if sec, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+			return time.Unix(int64(sec), int64((sec-float64(int64(sec)))*1e9)).UTC(), rest, true
+		}
+
+		for _, layout := range logTimeLayouts {
+			if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+				return t, rest, true
+			}
+		}
+
+		return time.Time{}, line, false
+	}
+
+	fields := strings.SplitN(line, " ", 2)
+	if t, err := time.Parse(time.RFC3339Nano, fields[0]); err == nil {
+		rest := ""
+		if len(fields) == 2 {
+			rest = fields[1]
+		}
+		return t, rest, true
+	}
+
+	if len(line) >= 20 {
+		t, err := time.ParseInLocation("Jan _2 2006 15:04:05", line[:20], time.Local)
+		if err == nil {
+			return t, strings.TrimLeft(line[20:], ": "), true
+		}
+	}
+
+	// Syslog timestamp has no year, take the year when it is not in future
+	if len(line) >= 15 {
+		t, err := time.ParseInLocation(time.Stamp, line[:15], time.Local)
+		if err == nil {
+			t = t.AddDate(now.Year(), 0, 0)
+			if t.After(now.Add(24 * time.Hour)) {
+				t = t.AddDate(-1, 0, 0)
+			}
+			return t, strings.TrimSpace(line[15:]), true
+		}
+	}
+
+	return time.Time{}, line, false
+}
@@ -0,0 +1,45 @@
+package classifier
+
+import "net"
+
+/*
+Mirror returns second row of local to local flow attributed to sender user
+
+Classify attributes flow between two local addresses to receiver as "in"
+traffic. With MirrorLocal enabled mirrored copy of the flow is "out" traffic
+of sender user, it is marked with Mirror so total network volume is counted
+over rows without mirror flag
+*/
+func (c *Classifier) Mirror(entry *Entry) (Entry, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if !c.Config.MirrorLocal || entry.Mirror || entry.Class != LOCAL || entry.Dir != IN {
+		return Entry{}, false
+	}
+
+	if !c.isLocal(entry.SrcIP) {
+		return Entry{}, false
+	}
+
+	mirror := *entry
+	mirror.Dir = OUT
+	mirror.UserID = ""
+	mirror.UserAttributes = nil
+	mirror.Mirror = true
+
+	c.lookupUser(&mirror, entry.SrcIP, OUT, c.lookupInterface(&mirror), nil)
+	mirror.Service = c.classifyService(&mirror)
+
+	return mirror, true
+}
+
+func (c *Classifier) isLocal(ip net.IP) bool {
+	for _, localNet := range c.Local {
+		if localNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
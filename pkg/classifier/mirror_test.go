@@ -0,0 +1,48 @@
+package classifier
+
+import (
+	"net"
+	"testing"
+)
+
+func TestShouldMirrorLocalEntry(t *testing.T) {
+	e := Entry{
+		SrcIP: net.ParseIP("192.168.0.1"),
+		DstIP: net.ParseIP("192.168.0.2"),
+	}
+
+	cfg := Config{MirrorLocal: true}
+
+	cfg.Users.Users = make(map[string]string)
+	cfg.Users.Users["192.168.0.1"] = "1"
+	cfg.Users.Users["192.168.0.2"] = "2"
+
+	cfg.Networks.Networks = make(map[string]string)
+	cfg.Networks.Networks["192.168.0.0/16"] = "local"
+
+	classifier := NewClassifier(cfg)
+	classifier.Classify(&e)
+
+	mirror, ok := classifier.Mirror(&e)
+	if !ok {
+		t.Fatalf("Should mirror local entry")
+	}
+
+	if e.UserID != "2" || e.Dir != "in" || e.Mirror {
+		t.Errorf("Should keep receiver row %v", e)
+	}
+
+	if mirror.UserID != "1" || mirror.Dir != "out" || mirror.Class != "local" || !mirror.Mirror {
+		t.Errorf("Should attribute mirror to sender %v", mirror)
+	}
+
+	e = Entry{
+		SrcIP: net.ParseIP("10.0.0.1"),
+		DstIP: net.ParseIP("192.168.0.2"),
+	}
+	classifier.Classify(&e)
+
+	if _, ok := classifier.Mirror(&e); ok {
+		t.Errorf("Should not mirror internet entry")
+	}
+}
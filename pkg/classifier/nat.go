@@ -0,0 +1,238 @@
+package classifier
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+NATConfig describes one NAT translation log used to resolve public address to subscriber
+
+	NATConfig {
+	  Format: Log format: conntrack ("conntrack -E -o timestamp" events),
+	          juniper (RT_FLOW sessions and port block allocation),
+	          cisco (ASA translation built and teardown)
+	  File: Path to log file
+	}
+*/
+type NATConfig struct {
+	Format string `mapstructure:"format"`
+	File   string `mapstructure:"file"`
+}
+
+// NATMapping binds public address port range to private address for period of time
+type NATMapping struct {
+	Private  net.IP
+	Public   net.IP
+	PortFrom uint16
+	PortTo   uint16
+	Start    time.Time
+	End      time.Time
+	Source   string
+}
+
+// NATEvent is translation created or removed
+type NATEvent struct {
+	Mapping NATMapping
+	Release bool
+}
+
+func (c *Classifier) readNAT(cfg NATConfig) error {
+	log.Println(fmt.Sprintf("Reading %s NAT translations from file %s", cfg.Format, cfg.File))
+
+	f, err := os.Open(cfg.File)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var parse func(string) (NATEvent, bool)
+	switch cfg.Format {
+	case "conntrack":
+		parse = ParseConntrackNAT
+	case "juniper":
+		parse = ParseJuniperNAT
+	case "cisco":
+		parse = ParseCiscoNAT
+	default:
+		return fmt.Errorf("unknown NAT log format %s", cfg.Format)
+	}
+
+	mappings, err := ReadNATLog(f, time.Now(), parse)
+	if err != nil {
+		return err
+	}
+
+	source := fmt.Sprintf("%s NAT file %s", cfg.Format, cfg.File)
+
+	for _, m := range mappings {
+		if m.Public.To4() == nil || m.Private.To4() == nil {
+			continue
+		}
+
+		m.Source = source
+
+		public := IP2Int(m.Public)
+		c.NAT[public] = append(c.NAT[public], m)
+	}
+
+	log.Println(fmt.Sprintf("Parsed %d NAT translations", len(mappings)))
+
+	return nil
+}
+
+// findNAT resolves public address and port at time t to private address mapping
+func (c *Classifier) findNAT(public uint32, port uint16, t time.Time) (NATMapping, bool) {
+	mappings := c.NAT[public]
+
+	for i := len(mappings) - 1; i >= 0; i-- {
+		m := mappings[i]
+		if port < m.PortFrom || port > m.PortTo {
+			continue
+		}
+
+		if (Lease{Start: m.Start, End: m.End}).Active(t) {
+			return m, true
+		}
+	}
+
+	return NATMapping{}, false
+}
+
+// ReadNATLog reads translation events and pairs them into mappings
+func ReadNATLog(in io.Reader, now time.Time, parse func(string) (NATEvent, bool)) ([]NATMapping, error) {
+	mappings := make([]NATMapping, 0)
+	open := make(map[string]int)
+
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		t, rest, ok := ParseLogTime(scanner.Text(), now)
+		if !ok {
+			continue
+		}
+
+		event, ok := parse(rest)
+		if !ok {
+			continue
+		}
+
+		m := event.Mapping
+		key := fmt.Sprintf("%s:%d-%d", m.Public, m.PortFrom, m.PortTo)
+
+		if event.Release {
+			if i, ok := open[key]; ok {
+				mappings[i].End = t
+				delete(open, key)
+			}
+			continue
+		}
+
+		// Interim records of existing mapping are skipped
+		if i, ok := open[key]; ok && mappings[i].Private.Equal(m.Private) {
+			continue
+		}
+
+		if i, ok := open[key]; ok {
+			mappings[i].End = t
+		}
+
+		m.Start = t
+		open[key] = len(mappings)
+		mappings = append(mappings, m)
+	}
+
+	return mappings, scanner.Err()
+}
+
+var conntrackField = regexp.MustCompile(`(src|dst|sport|dport)=(\S+)`)
+
+// ParseConntrackNAT parses conntrack NEW and DESTROY events of source NAT
+func ParseConntrackNAT(line string) (NATEvent, bool) {
+	release := strings.Contains(line, "[DESTROY]")
+	if !release && !strings.Contains(line, "[NEW]") {
+		return NATEvent{}, false
+	}
+
+	// Original direction goes first, reply direction second
+	values := make(map[string][]string)
+	for _, m := range conntrackField.FindAllStringSubmatch(line, -1) {
+		values[m[1]] = append(values[m[1]], m[2])
+	}
+
+	if len(values["src"]) != 2 || len(values["dst"]) != 2 || len(values["dport"]) != 2 {
+		return NATEvent{}, false
+	}
+
+	private := net.ParseIP(values["src"][0])
+	public := net.ParseIP(values["dst"][1])
+	port, err := strconv.ParseUint(values["dport"][1], 10, 16)
+	if private == nil || public == nil || err != nil || private.Equal(public) {
+		return NATEvent{}, false
+	}
+
+	return NATEvent{
+		Mapping: NATMapping{Private: private, Public: public, PortFrom: uint16(port), PortTo: uint16(port)},
+		Release: release,
+	}, true
+}
+
+var (
+	juniperPair = regexp.MustCompile(`(\d+\.\d+\.\d+\.\d+)/(\d+)->(\d+\.\d+\.\d+\.\d+)/(\d+)`)
+	juniperPBA  = regexp.MustCompile(`JSERVICES_NAT_PORT_BLOCK_(ALLOC|ACTIVE|RELEASE): (\d+\.\d+\.\d+\.\d+) -> (\d+\.\d+\.\d+\.\d+):(\d+)-(\d+)`)
+)
+
+// ParseJuniperNAT parses RT_FLOW session create and close, and port block allocation events
+func ParseJuniperNAT(line string) (NATEvent, bool) {
+	if m := juniperPBA.FindStringSubmatch(line); m != nil {
+		from, _ := strconv.ParseUint(m[4], 10, 16)
+		to, _ := strconv.ParseUint(m[5], 10, 16)
+
+		return NATEvent{
+			Mapping: NATMapping{Private: net.ParseIP(m[2]), Public: net.ParseIP(m[3]), PortFrom: uint16(from), PortTo: uint16(to)},
+			Release: m[1] == "RELEASE",
+		}, true
+	}
+
+	release := strings.Contains(line, "RT_FLOW_SESSION_CLOSE")
+	if !release && !strings.Contains(line, "RT_FLOW_SESSION_CREATE") {
+		return NATEvent{}, false
+	}
+
+	// Original flow goes first, translated flow second
+	pairs := juniperPair.FindAllStringSubmatch(line, 2)
+	if len(pairs) != 2 || pairs[0][1] == pairs[1][1] {
+		return NATEvent{}, false
+	}
+
+	port, _ := strconv.ParseUint(pairs[1][2], 10, 16)
+
+	return NATEvent{
+		Mapping: NATMapping{Private: net.ParseIP(pairs[0][1]), Public: net.ParseIP(pairs[1][1]), PortFrom: uint16(port), PortTo: uint16(port)},
+		Release: release,
+	}, true
+}
+
+var ciscoTranslation = regexp.MustCompile(`(Built|Teardown) dynamic \S+ translation from \S*?:?(\d+\.\d+\.\d+\.\d+)/(\d+) to \S*?:?(\d+\.\d+\.\d+\.\d+)/(\d+)`)
+
+// ParseCiscoNAT parses ASA dynamic translation built and teardown events
+func ParseCiscoNAT(line string) (NATEvent, bool) {
+	m := ciscoTranslation.FindStringSubmatch(line)
+	if m == nil {
+		return NATEvent{}, false
+	}
+
+	port, _ := strconv.ParseUint(m[5], 10, 16)
+
+	return NATEvent{
+		Mapping: NATMapping{Private: net.ParseIP(m[2]), Public: net.ParseIP(m[4]), PortFrom: uint16(port), PortTo: uint16(port)},
+		Release: m[1] == "Teardown",
+	}, true
+}
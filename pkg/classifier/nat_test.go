@@ -0,0 +1,85 @@
+package classifier
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShouldParseNATLogs(t *testing.T) {
+	conntrack := `[1605780000.000000]	    [NEW] tcp      6 120 SYN_SENT src=10.0.0.5 dst=1.2.3.4 sport=5000 dport=80 [UNREPLIED] src=1.2.3.4 dst=100.64.0.1 sport=80 dport=62000
+[1605780001.000000]	    [NEW] tcp      6 120 SYN_SENT src=100.64.0.2 dst=1.2.3.4 sport=5000 dport=80 [UNREPLIED] src=1.2.3.4 dst=100.64.0.2 sport=80 dport=5000
+[1605780100.000000]	[DESTROY] tcp      6 src=10.0.0.5 dst=1.2.3.4 sport=5000 dport=80 src=1.2.3.4 dst=100.64.0.1 sport=80 dport=62000
+`
+
+	mappings, err := ReadNATLog(strings.NewReader(conntrack), time.Now(), ParseConntrackNAT)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(mappings) != 1 || mappings[0].Private.String() != "10.0.0.5" || mappings[0].PortFrom != 62000 {
+		t.Fatalf("Should parse conntrack NAT %v", mappings)
+	}
+
+	if mappings[0].End.Sub(mappings[0].Start) != 100*time.Second {
+		t.Errorf("Mapping time mismatch %v", mappings[0])
+	}
+
+	juniper := `Nov 19 10:00:00 srx RT_FLOW: RT_FLOW_SESSION_CREATE: session created 10.0.0.5/5000->1.2.3.4/80 0x0 junos-http 100.64.0.1/62000->1.2.3.4/80 0x0 source rule r1
+Nov 19 10:00:00 mx JSERVICES_NAT_PORT_BLOCK_ALLOC: 10.0.0.6 -> 100.64.0.1:1024-1535 0x5fb6a1c0
+Nov 19 10:05:00 mx JSERVICES_NAT_PORT_BLOCK_ACTIVE: 10.0.0.6 -> 100.64.0.1:1024-1535 0x5fb6a1c0
+`
+
+	mappings, err = ReadNATLog(strings.NewReader(juniper), time.Now(), ParseJuniperNAT)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(mappings) != 2 || mappings[1].PortFrom != 1024 || mappings[1].PortTo != 1535 || !mappings[1].End.IsZero() {
+		t.Errorf("Should parse juniper NAT %v", mappings)
+	}
+
+	event, ok := ParseCiscoNAT("%ASA-6-305012: Teardown dynamic TCP translation from inside:10.0.0.5/5000 to outside:100.64.0.1/62000 duration 0:00:30")
+	if !ok || !event.Release || event.Mapping.Public.String() != "100.64.0.1" || event.Mapping.PortFrom != 62000 {
+		t.Errorf("Should parse cisco NAT %v", event)
+	}
+}
+
+func TestShouldClassifyUserBehindNAT(t *testing.T) {
+	cfg := Config{}
+
+	cfg.Users.Users = make(map[string]string)
+	cfg.Users.Users["10.0.0.5"] = "1"
+
+	cfg.Networks.Networks = make(map[string]string)
+	cfg.Networks.Networks["100.64.0.0/24"] = "local"
+
+	c := NewClassifier(cfg)
+
+	start := time.Date(2020, 11, 19, 10, 0, 0, 0, time.UTC)
+	c.NAT[IP2Int(net.ParseIP("100.64.0.1"))] = []NATMapping{
+		{Private: net.ParseIP("10.0.0.5"), Public: net.ParseIP("100.64.0.1"), PortFrom: 1024, PortTo: 1535, Start: start},
+	}
+
+	e := Entry{
+		SrcIP:     net.ParseIP("1.2.3.4"),
+		DstIP:     net.ParseIP("100.64.0.1"),
+		SrcPort:   443,
+		DstPort:   1100,
+		Collected: start.Add(time.Minute),
+	}
+	c.Classify(&e)
+
+	if e.UserID != "1" {
+		t.Errorf("Should classify user behind NAT")
+	}
+
+	e.UserID = ""
+	e.DstPort = 2000
+	c.Classify(&e)
+
+	if e.UserID != "" {
+		t.Errorf("Should not classify port out of block")
+	}
+}
@@ -0,0 +1,229 @@
+package classifier
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+ServiceConfig describes one service classification rule, rules are checked in order
+
+	ServiceConfig {
+	  Name: Service name stored in service column
+	  Proto: Protocols list: tcp, udp or protocol numbers, empty matches any
+	  Ports: Remote ports list with ranges "80,443,6881-6889", empty matches any
+	  Networks: Remote networks CIDR list
+	  File: File with remote networks, one CIDR per line
+	}
+*/
+type ServiceConfig struct {
+	Name     string   `mapstructure:"name"`
+	Proto    []string `mapstructure:"proto"`
+	Ports    string   `mapstructure:"ports"`
+	Networks []string `mapstructure:"networks"`
+	File     string   `mapstructure:"file"`
+}
+
+type portRange struct {
+	From uint16
+	To   uint16
+}
+
+// Service is compiled service classification rule
+type Service struct {
+	Name     string
+	Protos   map[uint8]bool
+	Ports    []portRange
+	Networks *Trie
+}
+
+// DefaultServices are used when no services configured
+var DefaultServices = []ServiceConfig{
+	{Name: "dns", Proto: []string{"tcp", "udp"}, Ports: "53"},
+	{Name: "quic", Proto: []string{"udp"}, Ports: "443"},
+	{Name: "https", Proto: []string{"tcp"}, Ports: "443"},
+	{Name: "http", Proto: []string{"tcp"}, Ports: "80,8080"},
+	{Name: "smtp", Proto: []string{"tcp"}, Ports: "25,465,587"},
+	{Name: "bittorrent", Proto: []string{"tcp", "udp"}, Ports: "6881-6889"},
+}
+
+var protocols = map[string]uint8{
+	"icmp": 1,
+	"tcp":  6,
+	"udp":  17,
+	"gre":  47,
+	"esp":  50,
+}
+
+// NewService compiles service classification rule
+func NewService(cfg ServiceConfig) (Service, error) {
+	s := Service{
+		Name:   cfg.Name,
+		Protos: make(map[uint8]bool),
+	}
+
+	for _, proto := range cfg.Proto {
+		if number, ok := protocols[strings.ToLower(proto)]; ok {
+			s.Protos[number] = true
+			continue
+		}
+
+		number, err := strconv.ParseUint(proto, 10, 8)
+		if err != nil {
+			return s, fmt.Errorf("could not parse protocol %s of service %s", proto, cfg.Name)
+		}
+		s.Protos[uint8(number)] = true
+	}
+
+	ports, err := ParsePorts(cfg.Ports)
+	if err != nil {
+		return s, err
+	}
+	s.Ports = ports
+
+	networks := cfg.Networks
+	if cfg.File != "" {
+		lines, err := readLines(cfg.File)
+		if err != nil {
+			return s, err
+		}
+		networks = append(networks, lines...)
+	}
+
+	if len(networks) > 0 {
+		s.Networks = NewTrie()
+		for _, cidr := range networks {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return s, fmt.Errorf("could not parse CIDR %s of service %s", cidr, cfg.Name)
+			}
+			s.Networks.Insert(*network, true)
+		}
+	}
+
+	return s, nil
+}
+
+// ParsePorts parses ports list with ranges "80,443,6881-6889"
+func ParsePorts(ports string) ([]portRange, error) {
+	ranges := make([]portRange, 0)
+	for _, part := range strings.Split(ports, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		bounds := strings.SplitN(part, "-", 2)
+		from, err := strconv.ParseUint(bounds[0], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse port %s", part)
+		}
+
+		to := from
+		if len(bounds) == 2 {
+			to, err = strconv.ParseUint(bounds[1], 10, 16)
+			if err != nil || to < from {
+				return nil, fmt.Errorf("could not parse port range %s", part)
+			}
+		}
+
+		ranges = append(ranges, portRange{From: uint16(from), To: uint16(to)})
+	}
+
+	return ranges, nil
+}
+
+// Match checks entry matches service rule, remote is remote ip and port, nil for unknown direction
+func (s Service) Match(proto uint8, remoteIP net.IP, remotePort uint16, localPort uint16) bool {
+	if len(s.Protos) > 0 && !s.Protos[proto] {
+		return false
+	}
+
+	if s.Networks != nil {
+		if remoteIP == nil {
+			return false
+		}
+
+		if _, ok := s.Networks.Lookup(remoteIP); !ok {
+			return false
+		}
+	}
+
+	if len(s.Ports) == 0 {
+		return true
+	}
+
+	for _, r := range s.Ports {
+		if remotePort >= r.From && remotePort <= r.To {
+			return true
+		}
+
+		// Direction is unknown, both ports could be service port
+		if remoteIP == nil && localPort >= r.From && localPort <= r.To {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *Classifier) compileServices() error {
+	services := c.Config.Services
+	if services == nil {
+		services = DefaultServices
+	}
+
+	for _, cfg := range services {
+		s, err := NewService(cfg)
+		if err != nil {
+			return err
+		}
+
+		c.Services = append(c.Services, s)
+	}
+
+	log.Println(fmt.Sprintf("Compiled %d service rules", len(c.Services)))
+
+	return nil
+}
+
+func (c *Classifier) classifyService(entry *Entry) string {
+	remoteIP := entry.RemoteIP()
+	remotePort, localPort := entry.DstPort, entry.SrcPort
+	if entry.Dir == IN {
+		remotePort, localPort = entry.SrcPort, entry.DstPort
+	}
+
+	for _, s := range c.Services {
+		if s.Match(entry.Proto, remoteIP, remotePort, localPort) {
+			return s.Name
+		}
+	}
+
+	return UNKNOWN
+}
+
+func readLines(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	lines := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	return lines, scanner.Err()
+}
@@ -0,0 +1,62 @@
+package classifier
+
+import (
+	"net"
+	"testing"
+)
+
+func TestShouldParsePorts(t *testing.T) {
+	ports, err := ParsePorts("80, 443,6881-6889")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ports) != 3 || ports[2].From != 6881 || ports[2].To != 6889 {
+		t.Errorf("Ports mismatch %v", ports)
+	}
+
+	if _, err := ParsePorts("6889-6881"); err == nil {
+		t.Errorf("Should not parse reversed range")
+	}
+}
+
+func TestShouldClassifyServiceEntry(t *testing.T) {
+	cfg := Config{}
+
+	cfg.Networks.Networks = make(map[string]string)
+	cfg.Networks.Networks["192.168.0.0/16"] = "local"
+
+	cfg.Services = []ServiceConfig{
+		{Name: "youtube", Proto: []string{"tcp", "udp"}, Ports: "443", Networks: []string{"173.194.0.0/16"}},
+	}
+	cfg.Services = append(cfg.Services, DefaultServices...)
+
+	classifier := NewClassifier(cfg)
+
+	e := Entry{
+		SrcIP:   net.ParseIP("173.194.1.1"),
+		DstIP:   net.ParseIP("192.168.0.1"),
+		SrcPort: 443,
+		DstPort: 50000,
+		Proto:   17,
+	}
+	classifier.Classify(&e)
+
+	if e.Service != "youtube" {
+		t.Errorf("Should classify service by network, got %s", e.Service)
+	}
+
+	e.SrcIP = net.ParseIP("8.8.8.8")
+	classifier.Classify(&e)
+
+	if e.Service != "quic" {
+		t.Errorf("Should classify service by port, got %s", e.Service)
+	}
+
+	e.SrcPort = 50001
+	classifier.Classify(&e)
+
+	if e.Service != "unknown" {
+		t.Errorf("Should not classify service, got %s", e.Service)
+	}
+}
@@ -0,0 +1,383 @@
+package classifier
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+SessionConfig describes one BRAS sessions source used as users source
+
+	SessionConfig {
+	  Format: Sessions format: mpd5 (mpd5 log), accel-ppp (accel-ppp log),
+	          accel-ppp-sessions ("accel-cmd show sessions" dump)
+	  File: Path to log or dump file
+	  Exporter: Exporter name of interfaces in sessions
+	}
+*/
+type SessionConfig struct {
+	Format   string `mapstructure:"format"`
+	File     string `mapstructure:"file"`
+	Exporter string `mapstructure:"exporter"`
+}
+
+// Session is subscriber session binding interface, login and ip for period of time
+type Session struct {
+	Iface string
+	Login string
+	IP    net.IP
+	Start time.Time
+	End   time.Time
+}
+
+// fileStamp is size and modification time of file, changed file is read again
+type fileStamp struct {
+	Size    int64
+	ModTime time.Time
+}
+
+func (c *Classifier) readSessions(cfg SessionConfig) error {
+	log.Println(fmt.Sprintf("Reading %s sessions from file %s", cfg.Format, cfg.File))
+
+	f, err := os.Open(cfg.File)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	c.sessionStamps[cfg.File] = fileStamp{Size: info.Size(), ModTime: info.ModTime()}
+
+	var sessions []Session
+	switch cfg.Format {
+	case "mpd5":
+		sessions, err = ParseMpd5Log(f, time.Now())
+	case "accel-ppp":
+		sessions, err = ParseAccelLog(f, time.Now())
+	case "accel-ppp-sessions":
+		sessions, err = ParseAccelSessions(f, info.ModTime())
+	default:
+		err = fmt.Errorf("unknown sessions format %s", cfg.Format)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	source := fmt.Sprintf("%s sessions file %s", cfg.Format, cfg.File)
+
+	for _, s := range sessions {
+		if s.Login == "" {
+			continue
+		}
+
+		lease := Lease{UserID: s.Login, Start: s.Start, End: s.End, Source: source}
+
+		if s.IP != nil && s.IP.To4() != nil {
+			intIP := IP2Int(s.IP)
+			c.SessionLeases[intIP] = append(c.SessionLeases[intIP], lease)
+		}
+
+		if s.Iface != "" {
+			key := cfg.Exporter + "/" + s.Iface
+			c.IfaceSessions[key] = append(c.IfaceSessions[key], lease)
+		}
+	}
+
+	log.Println(fmt.Sprintf("Parsed %d sessions", len(sessions)))
+
+	return nil
+}
+
+/*
+FollowSessions reads session files again when they are changed, checked every interval,
+so sessions of connected users are known without Reload. Current sessions are kept
+when changed files could not be read
+*/
+func (c *Classifier) FollowSessions(interval time.Duration) {
+	if interval <= 0 || len(c.Config.Users.Sessions) == 0 {
+		return
+	}
+
+	log.Println(fmt.Sprintf("Following session files every %s", interval))
+
+	for range time.Tick(interval) {
+		err := c.refreshSessions()
+		if err != nil {
+			log.Println(fmt.Sprintf("Could not read sessions, current ones are kept: %v", err))
+		}
+	}
+}
+
+// refreshSessions replaces sessions when any session file is changed
+func (c *Classifier) refreshSessions() error {
+	c.mu.RLock()
+	sessions := c.Config.Users.Sessions
+	stamps := c.sessionStamps
+	c.mu.RUnlock()
+
+	changed := false
+	for _, cfg := range sessions {
+		info, err := os.Stat(cfg.File)
+		if err != nil {
+			return err
+		}
+
+		if stamps[cfg.File] != (fileStamp{Size: info.Size(), ModTime: info.ModTime()}) {
+			changed = true
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+
+	next := &Classifier{
+		SessionLeases: make(map[uint32][]Lease),
+		IfaceSessions: make(map[string][]Lease),
+		sessionStamps: make(map[string]fileStamp),
+	}
+
+	for _, cfg := range sessions {
+		err := next.readSessions(cfg)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	c.SessionLeases = next.SessionLeases
+	c.IfaceSessions = next.IfaceSessions
+	c.sessionStamps = next.sessionStamps
+	c.mu.Unlock()
+
+	// Sessions are part of dictionaries version, see Snapshot
+	version := c.version()
+
+	c.mu.Lock()
+	c.Version = version
+	c.mu.Unlock()
+
+	return nil
+}
+
+func (c *Classifier) findIfaceSession(entry *Entry) (Lease, bool) {
+	sessions := c.IfaceSessions[entry.Exporter+"/"+entry.Iface]
+
+	for i := len(sessions) - 1; i >= 0; i-- {
+		if sessions[i].Active(entry.Collected) {
+			return sessions[i], true
+		}
+	}
+
+	return Lease{}, false
+}
+
+var (
+	mpdContext   = regexp.MustCompile(`\[([^\]\s]+)\]\s+(.*)$`)
+	mpdName      = regexp.MustCompile(`^Name: "(.*)"`)
+	mpdRadius    = regexp.MustCompile(`RAD_ACCESS_ACCEPT for user '(.*)'`)
+	mpdJoin      = regexp.MustCompile(`Link: Join bundle "(.*)"`)
+	mpdInterface = regexp.MustCompile(`Bundle: Interface (\S+) created`)
+	mpdAddresses = regexp.MustCompile(`^(\d+\.\d+\.\d+\.\d+) -> (\d+\.\d+\.\d+\.\d+)$`)
+)
+
+// ParseMpd5Log reads mpd5 log and correlates link login with bundle interface and peer address
+func ParseMpd5Log(in io.Reader, now time.Time) ([]Session, error) {
+	logins := make(map[string]string)
+	active := make(map[string]*Session)
+	ipcp := make(map[string]bool)
+	sessions := make([]Session, 0)
+
+	finish := func(bundle string, t time.Time) {
+		if s, ok := active[bundle]; ok {
+			s.End = t
+			sessions = append(sessions, *s)
+			delete(active, bundle)
+		}
+	}
+
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		t, rest, ok := ParseLogTime(scanner.Text(), now)
+		if !ok {
+			continue
+		}
+
+		m := mpdContext.FindStringSubmatch(rest)
+		if m == nil {
+			continue
+		}
+
+		context, msg := m[1], strings.TrimSpace(m[2])
+
+		if m := mpdName.FindStringSubmatch(msg); m != nil {
+			logins[context] = m[1]
+			continue
+		}
+
+		if m := mpdRadius.FindStringSubmatch(msg); m != nil {
+			logins[context] = m[1]
+			continue
+		}
+
+		if m := mpdJoin.FindStringSubmatch(msg); m != nil {
+			finish(m[1], t)
+			active[m[1]] = &Session{Login: logins[context], Start: t}
+			continue
+		}
+
+		s, ok := active[context]
+		if !ok {
+			continue
+		}
+
+		if m := mpdInterface.FindStringSubmatch(msg); m != nil {
+			s.Iface = m[1]
+			continue
+		}
+
+		if msg == "IPCP: LayerUp" {
+			ipcp[context] = true
+			continue
+		}
+
+		if m := mpdAddresses.FindStringSubmatch(msg); m != nil && ipcp[context] {
+			s.IP = net.ParseIP(m[2])
+			s.Start = t
+			ipcp[context] = false
+			continue
+		}
+
+		if msg == "IFACE: Down event" || msg == "Bundle: Shutdown" {
+			finish(context, t)
+		}
+	}
+
+	for bundle := range active {
+		finish(bundle, time.Time{})
+	}
+
+	return sessions, scanner.Err()
+}
+
+var (
+	accelContext = regexp.MustCompile(`^\s*\w+:\s+(\w+[\w.]*):([^:\s]+):\s+(.*)$`)
+	accelIP      = regexp.MustCompile(`(?:Framed-IP-Address[ =]|\bip=|\baddr=)(\d+\.\d+\.\d+\.\d+)`)
+)
+
+// ParseAccelLog reads accel-ppp log with "ifname:username:" context of session messages
+func ParseAccelLog(in io.Reader, now time.Time) ([]Session, error) {
+	active := make(map[string]*Session)
+	sessions := make([]Session, 0)
+
+	finish := func(iface string, t time.Time) {
+		if s, ok := active[iface]; ok {
+			s.End = t
+			sessions = append(sessions, *s)
+			delete(active, iface)
+		}
+	}
+
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		t, rest, ok := ParseLogTime(scanner.Text(), now)
+		if !ok {
+			continue
+		}
+
+		m := accelContext.FindStringSubmatch(rest)
+		if m == nil {
+			continue
+		}
+
+		iface, login, msg := m[1], m[2], m[3]
+
+		s, ok := active[iface]
+		if !ok || s.Login != login {
+			finish(iface, t)
+			s = &Session{Iface: iface, Login: login, Start: t}
+			active[iface] = s
+		}
+
+		if m := accelIP.FindStringSubmatch(msg); m != nil {
+			s.IP = net.ParseIP(m[1])
+		}
+
+		if strings.Contains(msg, "disconnected") || strings.Contains(msg, "session finished") {
+			finish(iface, t)
+		}
+	}
+
+	for iface := range active {
+		finish(iface, time.Time{})
+	}
+
+	return sessions, scanner.Err()
+}
+
+// ParseAccelSessions reads "accel-cmd show sessions" table with ifname, username, ip
+// and optional uptime-raw columns, dumped at time dumped
+func ParseAccelSessions(in io.Reader, dumped time.Time) ([]Session, error) {
+	sessions := make([]Session, 0)
+
+	var columns map[string]int
+
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(strings.TrimSpace(line), "-") {
+			continue
+		}
+
+		fields := strings.Split(line, "|")
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+
+		if columns == nil {
+			columns = make(map[string]int)
+			for i, name := range fields {
+				columns[name] = i
+			}
+
+			for _, name := range []string{"ifname", "username", "ip"} {
+				if _, ok := columns[name]; !ok {
+					return nil, fmt.Errorf("accel-ppp sessions column %s not found", name)
+				}
+			}
+			continue
+		}
+
+		if len(fields) < len(columns) {
+			continue
+		}
+
+		s := Session{
+			Iface: fields[columns["ifname"]],
+			Login: fields[columns["username"]],
+			IP:    net.ParseIP(fields[columns["ip"]]),
+		}
+
+		if i, ok := columns["uptime-raw"]; ok {
+			if uptime, err := strconv.ParseInt(fields[i], 10, 64); err == nil {
+				s.Start = dumped.Add(-time.Duration(uptime) * time.Second)
+			}
+		}
+
+		sessions = append(sessions, s)
+	}
+
+	return sessions, scanner.Err()
+}
@@ -0,0 +1,201 @@
+package classifier
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShouldParseLogTime(t *testing.T) {
+	now := time.Date(2021, 1, 2, 0, 0, 0, 0, time.Local)
+
+	ts, rest, ok := ParseLogTime("Dec 31 23:00:00 bras1 mpd: [B-1] IFACE: Up event", now)
+	if !ok || ts.Year() != 2020 || rest != "bras1 mpd: [B-1] IFACE: Up event" {
+		t.Errorf("Should parse syslog time of previous year %v %s", ts, rest)
+	}
+
+	ts, rest, ok = ParseLogTime("[1605780000.500000] [NEW] tcp", now)
+	if !ok || ts.Unix() != 1605780000 || rest != "[NEW] tcp" {
+		t.Errorf("Should parse epoch time %v %s", ts, rest)
+	}
+
+	if _, _, ok := ParseLogTime("garbage", now); ok {
+		t.Errorf("Should not parse time")
+	}
+}
+
+func TestShouldParseMpd5Log(t *testing.T) {
+	log := `Nov 19 10:00:00 bras1 mpd: [L-12] Link: UP event
+Nov 19 10:00:00 bras1 mpd: [L-12]  Name: "user1"
+Nov 19 10:00:01 bras1 mpd: [L-12] Link: Join bundle "B-12"
+Nov 19 10:00:01 bras1 mpd: [B-12] Bundle: Interface ng11 created
+Nov 19 10:00:02 bras1 mpd: [B-12] IPCP: LayerUp
+Nov 19 10:00:02 bras1 mpd: [B-12]   10.0.0.1 -> 10.0.3.5
+Nov 19 12:00:00 bras1 mpd: [B-12] IFACE: Down event
+Nov 19 12:00:00 bras1 mpd: [B-12] Bundle: Shutdown
+`
+
+	sessions, err := ParseMpd5Log(strings.NewReader(log), time.Date(2020, 11, 20, 0, 0, 0, 0, time.Local))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sessions) != 1 {
+		t.Fatalf("Should parse one session, got %d", len(sessions))
+	}
+
+	s := sessions[0]
+	if s.Iface != "ng11" || s.Login != "user1" || s.IP.String() != "10.0.3.5" {
+		t.Errorf("Session mismatch %v", s)
+	}
+
+	if s.End.Sub(s.Start) != 2*time.Hour-2*time.Second {
+		t.Errorf("Session time mismatch %v %v", s.Start, s.End)
+	}
+}
+
+func TestShouldParseAccelSessions(t *testing.T) {
+	log := `[2020-11-19 10:00:00]:  info: ppp3: connect: ppp3 <--> pppoe(00:11:22:33:44:55)
+[2020-11-19 10:00:01]:  info: ppp3:user1: user1: authentication succeeded
+[2020-11-19 10:00:01]:  info: ppp3:user1: Framed-IP-Address 10.0.3.5
+[2020-11-19 12:00:00]:  info: ppp3:user1: disconnected
+`
+
+	sessions, err := ParseAccelLog(strings.NewReader(log), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sessions) != 1 || sessions[0].Iface != "ppp3" || sessions[0].IP.String() != "10.0.3.5" || sessions[0].End.IsZero() {
+		t.Errorf("Should parse accel-ppp log %v", sessions)
+	}
+
+	dump := ` ifname | username |    ip     | uptime-raw
+--------+----------+-----------+------------
+ ppp3   | user1    | 10.0.3.5  | 3600
+`
+
+	dumped := time.Date(2020, 11, 19, 12, 0, 0, 0, time.UTC)
+	sessions, err = ParseAccelSessions(strings.NewReader(dump), dumped)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sessions) != 1 || sessions[0].Login != "user1" || sessions[0].Start.Hour() != 11 {
+		t.Errorf("Should parse accel-ppp sessions %v", sessions)
+	}
+}
+
+func TestShouldClassifyUserBySession(t *testing.T) {
+	c := NewClassifier(Config{})
+
+	start := time.Date(2020, 11, 19, 10, 0, 0, 0, time.UTC)
+	lease := Lease{UserID: "user1", Start: start, End: start.Add(time.Hour)}
+	c.addLease(net.ParseIP("100.64.3.5"), lease)
+	c.IfaceSessions["bras1/ng11"] = []Lease{lease}
+
+	e := Entry{
+		SrcIP:     net.ParseIP("8.8.8.8"),
+		DstIP:     net.ParseIP("100.64.3.5"),
+		Collected: start.Add(time.Minute),
+	}
+	c.Classify(&e)
+
+	if e.Dir != "in" || e.UserID != "user1" {
+		t.Errorf("Should classify by session address %v", e)
+	}
+
+	c.Config.Interfaces = []InterfaceConfig{{Iface: "ng*", Role: "customer"}}
+
+	e = Entry{
+		SrcIP:     net.ParseIP("100.64.3.6"),
+		DstIP:     net.ParseIP("8.8.8.8"),
+		SrcPort:   50000,
+		DstPort:   53,
+		Iface:     "ng11",
+		Exporter:  "bras1",
+		Collected: start.Add(time.Minute),
+	}
+	c.Classify(&e)
+
+	if e.Dir != "out" || e.UserID != "user1" {
+		t.Errorf("Should classify by interface session %v", e)
+	}
+}
+
+func TestShouldParseMpd5CustomContexts(t *testing.T) {
+	log := `Nov 19 10:00:00 bras1 mpd[1234]: [pppoe-12] Link: UP event
+Nov 19 10:00:00 bras1 mpd[1234]: [pppoe-12]  Name: "user1"
+Nov 19 10:00:01 bras1 mpd[1234]: [pppoe-12] Link: Join bundle "vlan10-12"
+Nov 19 10:00:01 bras1 mpd[1234]: [vlan10-12] Bundle: Interface ng11 created
+Nov 19 10:00:02 bras1 mpd[1234]: [vlan10-12] IPCP: LayerUp
+Nov 19 10:00:02 bras1 mpd[1234]: [vlan10-12]   10.0.0.1 -> 10.0.3.5
+`
+
+	sessions, err := ParseMpd5Log(strings.NewReader(log), time.Date(2020, 11, 20, 0, 0, 0, 0, time.Local))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sessions) != 1 || sessions[0].Login != "user1" || sessions[0].Iface != "ng11" || sessions[0].IP.String() != "10.0.3.5" {
+		t.Errorf("Should parse custom named link and bundle %v", sessions)
+	}
+}
+
+func TestShouldFollowSessions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "classifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "accel.log")
+	err = ioutil.WriteFile(file, []byte("[2020-11-19 10:00:01]:  info: ppp3:user1: Framed-IP-Address 10.0.3.5\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := Config{}
+	cfg.Users.Sessions = []SessionConfig{{Format: "accel-ppp", File: file, Exporter: "bras1"}}
+
+	c := NewClassifier(cfg)
+	version := c.Version
+
+	e := Entry{SrcIP: net.ParseIP("10.0.3.6"), DstIP: net.ParseIP("8.8.8.8"), Collected: time.Date(2020, 11, 19, 11, 0, 0, 0, time.Local)}
+	c.Classify(&e)
+
+	if e.UserID != "" {
+		t.Fatalf("Should not know user before session %v", e)
+	}
+
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("[2020-11-19 10:30:00]:  info: ppp4:user2: Framed-IP-Address 10.0.3.6\n")
+	f.Close()
+
+	err = c.refreshSessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e.UserID = ""
+	c.Classify(&e)
+
+	if e.UserID != "user2" || c.Version == version {
+		t.Errorf("Should follow new session with new version %v %s", e, c.Version)
+	}
+
+	// Unchanged files are not read again
+	stamps := c.sessionStamps
+	c.refreshSessions()
+	if fmt.Sprintf("%p", stamps) != fmt.Sprintf("%p", c.sessionStamps) {
+		t.Errorf("Should not read unchanged sessions")
+	}
+}
@@ -0,0 +1,189 @@
+package classifier
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// UserMapping is one address => user binding of users dictionary
+type UserMapping struct {
+	IP     uint32
+	UserID string
+	Source string
+}
+
+// NetworkMapping is one network => class binding of networks dictionary or
+// routing table, Origin is ASN originated the route
+type NetworkMapping struct {
+	Network net.IPNet
+	Class   string
+	Origin  uint32
+	Source  string
+}
+
+// LeaseMapping is address => user binding for period of time: DHCP lease or BRAS session
+type LeaseMapping struct {
+	IP uint32
+	Lease
+}
+
+// InterfaceMapping is exporter interface => user binding: configured interface or BRAS session
+type InterfaceMapping struct {
+	Exporter string
+	Iface    string
+	Role     string
+	Side     string
+	Lease
+}
+
+/*
+Snapshot is dictionaries in effect for classification: users, networks and
+routes, DHCP leases, BRAS sessions, interfaces and NAT translations
+
+Version is the same for equal dictionaries, so it is changed only when
+mappings are changed
+*/
+type Snapshot struct {
+	Version    string
+	Loaded     time.Time
+	Users      []UserMapping
+	Networks   []NetworkMapping
+	Leases     []LeaseMapping
+	Interfaces []InterfaceMapping
+	NAT        []NATMapping
+}
+
+// Snapshot returns loaded dictionaries sorted by address
+func (c *Classifier) Snapshot() Snapshot {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	s := Snapshot{
+		Version:  c.Version,
+		Loaded:   c.Loaded,
+		Users:    make([]UserMapping, 0, len(c.Users)),
+		Networks: make([]NetworkMapping, 0, len(c.Local)+len(c.Peering)),
+	}
+
+	for ip, id := range c.Users {
+		s.Users = append(s.Users, UserMapping{IP: ip, UserID: id, Source: c.UserSources[ip]})
+	}
+
+	sort.Slice(s.Users, func(i, j int) bool {
+		return s.Users[i].IP < s.Users[j].IP
+	})
+
+	for _, network := range c.Local {
+		s.Networks = append(s.Networks, NetworkMapping{Network: network, Class: LOCAL, Source: c.NetworkSources[network.String()]})
+	}
+
+	for _, network := range c.Peering {
+		s.Networks = append(s.Networks, NetworkMapping{Network: network, Class: PEERING, Source: c.NetworkSources[network.String()]})
+	}
+
+	c.Routes.Walk(func(network net.IPNet, value interface{}) {
+		info := value.(RouteInfo)
+
+		class := INTERNET
+		if info.Peering {
+			class = PEERING
+		}
+
+		s.Networks = append(s.Networks, NetworkMapping{Network: network, Class: class, Origin: info.Origin, Source: info.Source})
+	})
+
+	// Routes of the same network go after configured ones, stable sort keeps walk order
+	sort.SliceStable(s.Networks, func(i, j int) bool {
+		if s.Networks[i].Network.String() != s.Networks[j].Network.String() {
+			return s.Networks[i].Network.String() < s.Networks[j].Network.String()
+		}
+		return s.Networks[i].Class < s.Networks[j].Class
+	})
+
+	// Leases of one address are kept in order, the latest active one wins
+	for _, leases := range []map[uint32][]Lease{c.Leases, c.SessionLeases} {
+		ips := make([]uint32, 0, len(leases))
+		for ip := range leases {
+			ips = append(ips, ip)
+		}
+		sort.Slice(ips, func(i, j int) bool { return ips[i] < ips[j] })
+
+		for _, ip := range ips {
+			for _, lease := range leases[ip] {
+				s.Leases = append(s.Leases, LeaseMapping{IP: ip, Lease: lease})
+			}
+		}
+	}
+
+	for _, iface := range c.Config.Interfaces {
+		s.Interfaces = append(s.Interfaces, InterfaceMapping{
+			Exporter: iface.Exporter,
+			Iface:    iface.Iface,
+			Role:     iface.Role,
+			Side:     iface.Side,
+			Lease:    Lease{UserID: iface.User, Source: "config"},
+		})
+	}
+
+	keys := make([]string, 0, len(c.IfaceSessions))
+	for key := range c.IfaceSessions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		exporter, iface := key, ""
+		if i := strings.LastIndex(key, "/"); i >= 0 {
+			exporter, iface = key[:i], key[i+1:]
+		}
+
+		for _, lease := range c.IfaceSessions[key] {
+			s.Interfaces = append(s.Interfaces, InterfaceMapping{Exporter: exporter, Iface: iface, Lease: lease})
+		}
+	}
+
+	publics := make([]uint32, 0, len(c.NAT))
+	for public := range c.NAT {
+		publics = append(publics, public)
+	}
+	sort.Slice(publics, func(i, j int) bool { return publics[i] < publics[j] })
+
+	for _, public := range publics {
+		s.NAT = append(s.NAT, c.NAT[public]...)
+	}
+
+	return s
+}
+
+// version returns short hash of all mappings of snapshot
+func (c *Classifier) version() string {
+	s := c.Snapshot()
+
+	h := sha256.New()
+	for _, u := range s.Users {
+		fmt.Fprintf(h, "user %d %s\n", u.IP, u.UserID)
+	}
+
+	for _, n := range s.Networks {
+		fmt.Fprintf(h, "network %s %s %d\n", n.Network.String(), n.Class, n.Origin)
+	}
+
+	for _, l := range s.Leases {
+		fmt.Fprintf(h, "lease %d %s %d %d\n", l.IP, l.UserID, l.Start.Unix(), l.End.Unix())
+	}
+
+	for _, i := range s.Interfaces {
+		fmt.Fprintf(h, "iface %s/%s %s %s %s %d %d\n", i.Exporter, i.Iface, i.Role, i.Side, i.UserID, i.Start.Unix(), i.End.Unix())
+	}
+
+	for _, m := range s.NAT {
+		fmt.Fprintf(h, "nat %s %d-%d %s %d %d\n", m.Public, m.PortFrom, m.PortTo, m.Private, m.Start.Unix(), m.End.Unix())
+	}
+
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
@@ -0,0 +1,99 @@
+package classifier
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestShouldVersionDictionaries(t *testing.T) {
+	config := func(id string) Config {
+		cfg := Config{}
+
+		cfg.Users.Users = make(map[string]string)
+		cfg.Users.Users["192.168.0.1"] = id
+		cfg.Users.Users["192.168.0.2/32"] = "2"
+
+		cfg.Networks.Networks = make(map[string]string)
+		cfg.Networks.Networks["192.168.0.0/16"] = "local"
+		cfg.Networks.Networks["10.10.0.0/16"] = "peering"
+
+		return cfg
+	}
+
+	first := NewClassifier(config("1"))
+	second := NewClassifier(config("1"))
+	changed := NewClassifier(config("3"))
+
+	if first.Version == "" || first.Version != second.Version {
+		t.Errorf("Should version equal dictionaries equally %s %s", first.Version, second.Version)
+	}
+
+	if first.Version == changed.Version {
+		t.Errorf("Should change version with mapping")
+	}
+
+	s := first.Snapshot()
+	if len(s.Users) != 2 || s.Users[0].UserID != "1" || s.Users[0].Source != "config" {
+		t.Errorf("Users snapshot mismatch %v", s.Users)
+	}
+
+	if len(s.Networks) != 2 || s.Networks[0].Network.String() != "10.10.0.0/16" || s.Networks[0].Class != "peering" {
+		t.Errorf("Networks snapshot mismatch %v", s.Networks)
+	}
+}
+
+func TestShouldVersionLeasesRoutesAndNAT(t *testing.T) {
+	cfg := Config{}
+	cfg.Interfaces = []InterfaceConfig{{Exporter: "bras1", Iface: "em0", Role: "customer", User: "5"}}
+
+	c := NewClassifier(cfg)
+	versions := map[string]bool{c.Version: true}
+
+	changes := []func(){
+		func() {
+			c.addLease(net.ParseIP("192.168.0.10"), Lease{UserID: "1", Start: time.Date(2020, 11, 19, 10, 0, 0, 0, time.UTC)})
+		},
+		func() {
+			c.SessionLeases[IP2Int(net.ParseIP("10.0.3.5").To4())] = []Lease{{UserID: "user1", Source: "sessions"}}
+		},
+		func() {
+			c.IfaceSessions["bras1/ng11"] = []Lease{{UserID: "user1", Source: "sessions"}}
+		},
+		func() {
+			_, network, _ := net.ParseCIDR("1.0.0.0/24")
+			c.Routes.Insert(*network, RouteInfo{Origin: 13335, Peering: true, Source: "bgp"})
+		},
+		func() {
+			public := net.ParseIP("100.64.0.1").To4()
+			c.NAT[IP2Int(public)] = []NATMapping{{Private: net.ParseIP("10.0.3.5"), Public: public, PortFrom: 1024, PortTo: 2047}}
+		},
+	}
+
+	for i, change := range changes {
+		change()
+
+		version := c.version()
+		if versions[version] {
+			t.Errorf("Should change version with mapping %d", i)
+		}
+		versions[version] = true
+	}
+
+	s := c.Snapshot()
+	if len(s.Leases) != 2 || s.Leases[0].UserID != "1" || s.Leases[1].UserID != "user1" {
+		t.Errorf("Leases snapshot mismatch %v", s.Leases)
+	}
+
+	if len(s.Interfaces) != 2 || s.Interfaces[0].UserID != "5" || s.Interfaces[1].Iface != "ng11" {
+		t.Errorf("Interfaces snapshot mismatch %v", s.Interfaces)
+	}
+
+	if len(s.Networks) != 1 || s.Networks[0].Class != "peering" || s.Networks[0].Origin != 13335 {
+		t.Errorf("Routes snapshot mismatch %v", s.Networks)
+	}
+
+	if len(s.NAT) != 1 || s.NAT[0].PortFrom != 1024 {
+		t.Errorf("NAT snapshot mismatch %v", s.NAT)
+	}
+}
@@ -0,0 +1,268 @@
+package classifier
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+/*
+SpecialConfig describes special purpose ranges classified by remote address
+
+	SpecialConfig {
+	  Builtin: Enable all built-in ranges, only multicast is enabled by default
+	  Ranges: list of ranges, see RangeConfig, built-in range with the same name
+	          is enabled and replaced, DefaultRanges are built in
+	  Bogons: downloadable bogon list, see BogonsConfig
+	}
+*/
+type SpecialConfig struct {
+	Builtin bool          `mapstructure:"builtin"`
+	Ranges  []RangeConfig `mapstructure:"ranges"`
+	Bogons  BogonsConfig  `mapstructure:"bogons"`
+}
+
+/*
+RangeConfig describes one special purpose range
+
+	RangeConfig {
+	  Name: Range name shown in classification trace
+	  Class: Class of flows with remote address in range: multicast, private,
+	         cgnat, linklocal, broadcast, reserved, bogon
+	  CIDRs: Range networks, built-in networks are kept if empty
+	  Disabled: Built-in range is not used
+	}
+*/
+type RangeConfig struct {
+	Name     string   `mapstructure:"name"`
+	Class    string   `mapstructure:"class"`
+	CIDRs    []string `mapstructure:"cidrs"`
+	Disabled bool     `mapstructure:"disabled"`
+}
+
+/*
+BogonsConfig describes bogon list, one CIDR per line, # comments are skipped
+
+	BogonsConfig {
+	  URL: URL to fetch bogons, e.g. Team Cymru fullbogons-ipv4.txt
+	  Timeout, Retries, Backoff, Cache: url fetching options, see FetchOptions
+	  File: File path to bogons
+	  Class: Class of bogon flows, default bogon
+	}
+*/
+type BogonsConfig struct {
+	URL   string `mapstructure:"url"`
+	File  string `mapstructure:"file"`
+	Class string `mapstructure:"class"`
+
+	FetchOptions `mapstructure:",squash"`
+}
+
+// SpecialRange is value stored in classifier special ranges trie
+type SpecialRange struct {
+	Name   string
+	Class  string
+	Source string
+}
+
+// DefaultRanges are IANA special purpose ranges, disabled ones are enabled by config
+var DefaultRanges = []RangeConfig{
+	{Name: "multicast", Class: MULTICAST, CIDRs: []string{"224.0.0.0/4"}},
+	{Name: "rfc1918", Class: PRIVATE, CIDRs: []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16"}, Disabled: true},
+	{Name: "cgnat", Class: CGNAT, CIDRs: []string{"100.64.0.0/10"}, Disabled: true},
+	{Name: "linklocal", Class: LINKLOCAL, CIDRs: []string{"169.254.0.0/16"}, Disabled: true},
+	{Name: "broadcast", Class: BROADCAST, CIDRs: []string{"255.255.255.255/32"}, Disabled: true},
+	{Name: "reserved", Class: RESERVED, CIDRs: []string{
+		"0.0.0.0/8", "127.0.0.0/8", "192.0.0.0/24", "192.0.2.0/24",
+		"198.18.0.0/15", "198.51.100.0/24", "203.0.113.0/24", "240.0.0.0/4",
+	}, Disabled: true},
+}
+
+var specialClasses = map[string]bool{
+	MULTICAST: true,
+	PRIVATE:   true,
+	CGNAT:     true,
+	LINKLOCAL: true,
+	BROADCAST: true,
+	RESERVED:  true,
+	BOGON:     true,
+}
+
+// SpecialRanges merges configured ranges into built-in ones
+func SpecialRanges(cfg SpecialConfig) ([]RangeConfig, error) {
+	ranges := make([]RangeConfig, len(DefaultRanges))
+	copy(ranges, DefaultRanges)
+
+	if cfg.Builtin {
+		for i := range ranges {
+			ranges[i].Disabled = false
+		}
+	}
+
+	for _, r := range cfg.Ranges {
+		if r.Class != "" && !specialClasses[r.Class] {
+			return nil, fmt.Errorf("unknown class %s of special range %s", r.Class, r.Name)
+		}
+
+		replaced := false
+		for i := range ranges {
+			if ranges[i].Name != r.Name {
+				continue
+			}
+
+			if r.Class != "" {
+				ranges[i].Class = r.Class
+			}
+
+			if len(r.CIDRs) > 0 {
+				ranges[i].CIDRs = r.CIDRs
+			}
+
+			ranges[i].Disabled = r.Disabled
+			replaced = true
+		}
+
+		if !replaced {
+			if r.Class == "" {
+				return nil, fmt.Errorf("class of special range %s is not set", r.Name)
+			}
+			ranges = append(ranges, r)
+		}
+	}
+
+	return ranges, nil
+}
+
+func (c *Classifier) compileSpecial() error {
+	// Bogons go first, so equal networks of named ranges replace them
+	if c.Config.Special.Bogons.URL != "" || c.Config.Special.Bogons.File != "" {
+		err := c.loadBogons()
+		if err != nil {
+			return err
+		}
+	}
+
+	ranges, err := SpecialRanges(c.Config.Special)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range ranges {
+		if r.Disabled {
+			continue
+		}
+
+		for _, cidr := range r.CIDRs {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return fmt.Errorf("could not parse network %s of special range %s: %v", cidr, r.Name, err)
+			}
+
+			c.Special.Insert(*network, SpecialRange{Name: r.Name, Class: r.Class, Source: "config"})
+		}
+	}
+
+	return nil
+}
+
+func (c *Classifier) loadBogons() error {
+	cfg := c.Config.Special.Bogons
+
+	class := cfg.Class
+	if class == "" {
+		class = BOGON
+	}
+
+	if !specialClasses[class] {
+		return fmt.Errorf("unknown class %s of bogons", class)
+	}
+
+	var fetched Fetched
+	source := fmt.Sprintf("file %s", cfg.File)
+
+	if cfg.URL != "" {
+		log.Println(fmt.Sprintf("Fetching bogons from url %s", cfg.URL))
+		source = fmt.Sprintf("url %s", cfg.URL)
+
+		var err error
+		fetched, err = fetchDictionary("bogons", cfg.URL, cfg.FetchOptions)
+		if err != nil {
+			return err
+		}
+
+		if fetched.Cached {
+			source = fmt.Sprintf("cache %s of url %s", cfg.Cache, cfg.URL)
+		}
+	} else {
+		log.Println(fmt.Sprintf("Reading bogons from file %s", cfg.File))
+
+		body, err := ioutil.ReadFile(cfg.File)
+		if err != nil {
+			return err
+		}
+
+		fetched = Fetched{URL: cfg.File, Time: time.Now(), Body: string(body)}
+	}
+
+	networks, err := ParseBogons(fetched.Body)
+	if err == nil && len(networks) == 0 {
+		err = fmt.Errorf("no networks found")
+	}
+
+	if err != nil && !fetched.Cached && cfg.Cache != "" {
+		fetched, err = cachedDictionary("bogons", cfg.FetchOptions, err)
+		if err == nil {
+			source = fmt.Sprintf("cache %s of %s", cfg.Cache, source)
+			networks, err = ParseBogons(fetched.Body)
+		}
+	}
+
+	if err != nil {
+		return fmt.Errorf("could not load bogons from %s: %v", source, err)
+	}
+
+	for _, network := range networks {
+		c.Special.Insert(network, SpecialRange{Name: "bogons", Class: class, Source: source})
+	}
+
+	log.Println(fmt.Sprintf("Loaded %d bogons from %s", len(networks), source))
+
+	saveCache("bogons", fetched, cfg.FetchOptions)
+
+	return nil
+}
+
+// ParseBogons parses one CIDR per line list, IPv6 networks are skipped
+func ParseBogons(body string) ([]net.IPNet, error) {
+	networks := make([]net.IPNet, 0)
+
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(line)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse bogon %s: %v", line, err)
+		}
+
+		if network.IP.To4() == nil {
+			continue
+		}
+
+		networks = append(networks, *network)
+	}
+
+	return networks, scanner.Err()
+}
@@ -0,0 +1,136 @@
+package classifier
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestShouldMergeSpecialRanges(t *testing.T) {
+	ranges, err := SpecialRanges(SpecialConfig{Ranges: []RangeConfig{
+		{Name: "cgnat", Class: PRIVATE},
+		{Name: "linklocal", Disabled: true},
+		{Name: "lab", Class: RESERVED, CIDRs: []string{"198.19.0.0/16"}},
+	}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ranges) != len(DefaultRanges)+1 {
+		t.Fatalf("Should add new range, got %v", ranges)
+	}
+
+	for _, r := range ranges {
+		switch r.Name {
+		case "cgnat":
+			if r.Class != PRIVATE || r.CIDRs[0] != "100.64.0.0/10" || r.Disabled {
+				t.Errorf("Should enable range and replace class only %v", r)
+			}
+		case "linklocal", "rfc1918":
+			if !r.Disabled {
+				t.Errorf("Should disable range %v", r)
+			}
+		case "multicast":
+			if r.Disabled {
+				t.Errorf("Should enable multicast by default %v", r)
+			}
+		}
+	}
+
+	ranges, err = SpecialRanges(SpecialConfig{Builtin: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range ranges {
+		if r.Disabled {
+			t.Errorf("Should enable built-in range %v", r)
+		}
+	}
+
+	_, err = SpecialRanges(SpecialConfig{Ranges: []RangeConfig{{Name: "lab", Class: "lab"}}})
+	if err == nil {
+		t.Errorf("Should reject unknown class")
+	}
+}
+
+func TestShouldParseBogons(t *testing.T) {
+	networks, err := ParseBogons("# last updated 1605780000\n0.0.0.0/8\n10.0.0.0/8 # rfc1918\n\n2001:db8::/32\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(networks) != 2 || networks[1].String() != "10.0.0.0/8" {
+		t.Errorf("Bogons mismatch %v", networks)
+	}
+
+	_, err = ParseBogons("10.0.0.0/33\n")
+	if err == nil {
+		t.Errorf("Should reject invalid network")
+	}
+}
+
+func TestShouldClassifySpecialRanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "classifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "bogons.txt")
+	err = ioutil.WriteFile(file, []byte("10.0.0.0/8\n23.128.0.0/10\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := Config{}
+	cfg.Networks.Networks = map[string]string{"188.218.0.0/16": "local", "172.16.0.0/12": "peering"}
+	cfg.Special.Builtin = true
+	cfg.Special.Bogons.File = file
+
+	c := NewClassifier(cfg)
+
+	cases := map[string]string{
+		"10.1.2.3":        PRIVATE,
+		"23.128.0.1":      BOGON,
+		"100.64.1.1":      CGNAT,
+		"224.0.0.251":     MULTICAST,
+		"255.255.255.255": BROADCAST,
+		"172.16.0.1":      PEERING,
+		"8.8.8.8":         INTERNET,
+	}
+
+	for remote, class := range cases {
+		e := Entry{SrcIP: net.ParseIP(remote), DstIP: net.ParseIP("188.218.189.188")}
+		c.Classify(&e)
+
+		if e.Class != class {
+			t.Errorf("Remote %s should be %s, got %s", remote, class, e.Class)
+		}
+	}
+}
+
+func TestShouldClassifyOnlyMulticastByDefault(t *testing.T) {
+	cfg := Config{}
+	cfg.Networks.Networks = map[string]string{"188.218.0.0/16": "local"}
+
+	c := NewClassifier(cfg)
+
+	cases := map[string]string{
+		"10.1.2.3":    INTERNET,
+		"100.64.1.1":  INTERNET,
+		"224.0.0.251": MULTICAST,
+	}
+
+	for remote, class := range cases {
+		e := Entry{SrcIP: net.ParseIP(remote), DstIP: net.ParseIP("188.218.189.188")}
+		c.Classify(&e)
+
+		if e.Class != class {
+			t.Errorf("Remote %s should be %s, got %s", remote, class, e.Class)
+		}
+	}
+}
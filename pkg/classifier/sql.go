@@ -0,0 +1,228 @@
+package classifier
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+/*
+SQLConfig describes users or networks source loaded by SQL query
+
+	SQLConfig {
+	  Driver: database/sql driver name, clickhouse is the only one built in
+	  DSN: Data source name, default is connection of clickhouse section
+	  Query: Query returning columns named as IDColumn and CIDRColumn for users,
+	         CIDRColumn and ClassColumn for networks, and user attributes
+	  Dictionary: Name of ClickHouse DICTIONARY created over users query,
+	              keyed by user id for dictGet in ad-hoc queries
+	}
+*/
+type SQLConfig struct {
+	Driver     string `mapstructure:"driver"`
+	DSN        string `mapstructure:"dsn" json:"-"`
+	Query      string `mapstructure:"query"`
+	Dictionary string `mapstructure:"dictionary"`
+}
+
+func (c *Classifier) queryUsers() error {
+	cfg := c.Config.Users.SQL
+
+	log.Println(fmt.Sprintf("Querying users from %s database", sqlDriver(cfg)))
+	c.source = fmt.Sprintf("%s query", sqlDriver(cfg))
+
+	err := cfg.validate()
+	if err != nil {
+		return err
+	}
+
+	db, err := sql.Open(sqlDriver(cfg), cfg.DSN)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	fetched, columns, queryErr := QueryRecords(db, cfg.Query)
+	if queryErr != nil {
+		// Unreachable database is handled as unreachable url, previous users are used
+		if c.Config.Users.Fetch.Cache == "" {
+			return queryErr
+		}
+
+		fetched, err = cachedDictionary("users", c.Config.Users.Fetch.FetchOptions, queryErr)
+		if err != nil {
+			return err
+		}
+		c.source = fmt.Sprintf("cache %s of %s", c.Config.Users.Fetch.Cache, c.source)
+	}
+
+	err = c.loadUsers("sql", fetched)
+	if err != nil {
+		return err
+	}
+
+	if cfg.Dictionary != "" && queryErr == nil {
+		err = createDictionary(db, cfg, column(c.Config.Users.Fetch.IDColumn, "id"), columns)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *Classifier) queryNetworks() error {
+	cfg := c.Config.Networks.SQL
+
+	log.Println(fmt.Sprintf("Querying networks from %s database", sqlDriver(cfg)))
+	c.source = fmt.Sprintf("%s query", sqlDriver(cfg))
+
+	err := cfg.validate()
+	if err != nil {
+		return err
+	}
+
+	db, err := sql.Open(sqlDriver(cfg), cfg.DSN)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	fetched, _, err := QueryRecords(db, cfg.Query)
+	if err != nil {
+		if c.Config.Networks.Fetch.Cache == "" {
+			return err
+		}
+
+		fetched, err = cachedDictionary("networks", c.Config.Networks.Fetch.FetchOptions, err)
+		if err != nil {
+			return err
+		}
+		c.source = fmt.Sprintf("cache %s of %s", c.Config.Networks.Fetch.Cache, c.source)
+	}
+
+	return c.loadNetworks("sql", fetched)
+}
+
+// QueryRecords runs query and returns rows as JSON array of objects named by columns
+func QueryRecords(db *sql.DB, query string) (Fetched, []string, error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return Fetched{}, nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return Fetched{}, nil, err
+	}
+
+	records := make([]Record, 0)
+
+	values := make([]interface{}, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+
+	for rows.Next() {
+		err := rows.Scan(pointers...)
+		if err != nil {
+			return Fetched{}, nil, err
+		}
+
+		record := make(Record)
+		for i, name := range columns {
+			switch v := values[i].(type) {
+			case []byte:
+				record[name] = string(v)
+			case time.Time:
+				record[name] = v.Format(time.RFC3339)
+			default:
+				record[name] = scalar(v)
+			}
+		}
+		records = append(records, record)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return Fetched{}, nil, err
+	}
+
+	body, err := json.Marshal(records)
+	if err != nil {
+		return Fetched{}, nil, err
+	}
+
+	return Fetched{
+		URL:         "query",
+		ContentType: "application/json",
+		Format:      "json",
+		Time:        time.Now(),
+		Body:        string(body),
+	}, columns, nil
+}
+
+// createDictionary creates ClickHouse dictionary over query keyed by user id
+func createDictionary(db *sql.DB, cfg SQLConfig, key string, columns []string) error {
+	if sqlDriver(cfg) != "clickhouse" {
+		return fmt.Errorf("dictionary %s could be created in clickhouse only", cfg.Dictionary)
+	}
+
+	found := false
+	attributes := make([]string, 0, len(columns))
+	selects := make([]string, 0, len(columns))
+	for _, name := range columns {
+		found = found || name == key
+		attributes = append(attributes, fmt.Sprintf("`%s` String", name))
+		selects = append(selects, fmt.Sprintf("toString(`%s`) AS `%s`", name, name))
+	}
+
+	if !found {
+		return fmt.Errorf("dictionary %s key column %s not found in query", cfg.Dictionary, key)
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM (%s)", strings.Join(selects, ", "), cfg.Query)
+
+	log.Println(fmt.Sprintf("Creating dictionary %s", cfg.Dictionary))
+
+	_, err := db.Exec(fmt.Sprintf(`
+		CREATE OR REPLACE DICTIONARY %s
+		(
+			%s
+		)
+		PRIMARY KEY `+"`%s`"+`
+		SOURCE(CLICKHOUSE(QUERY '%s'))
+		LIFETIME(MIN 300 MAX 600)
+		LAYOUT(COMPLEX_KEY_HASHED())
+	`, cfg.Dictionary, strings.Join(attributes, ",\n\t\t\t"), key, quote(query)))
+
+	return err
+}
+
+// validate checks driver is registered, clickhouse is the only driver built in
+func (cfg SQLConfig) validate() error {
+	for _, name := range sql.Drivers() {
+		if name == sqlDriver(cfg) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unsupported SQL driver %s, built in drivers: %s", sqlDriver(cfg), strings.Join(sql.Drivers(), ", "))
+}
+
+func sqlDriver(cfg SQLConfig) string {
+	if cfg.Driver == "" {
+		return "clickhouse"
+	}
+
+	return cfg.Driver
+}
+
+func quote(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value)
+}
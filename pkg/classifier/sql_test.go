@@ -0,0 +1,98 @@
+package classifier
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// testDriver returns the same rows for any query
+type testDriver struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+type testConn struct{ d *testDriver }
+type testStmt struct{ d *testDriver }
+type testRows struct {
+	d *testDriver
+	i int
+}
+
+func (d *testDriver) Open(name string) (driver.Conn, error) { return &testConn{d}, nil }
+
+func (c *testConn) Prepare(query string) (driver.Stmt, error) { return &testStmt{c.d}, nil }
+func (c *testConn) Close() error                              { return nil }
+func (c *testConn) Begin() (driver.Tx, error)                 { return nil, fmt.Errorf("not supported") }
+
+func (s *testStmt) Close() error  { return nil }
+func (s *testStmt) NumInput() int { return 0 }
+func (s *testStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, fmt.Errorf("not supported")
+}
+func (s *testStmt) Query(args []driver.Value) (driver.Rows, error) { return &testRows{d: s.d}, nil }
+
+func (r *testRows) Columns() []string { return r.d.columns }
+func (r *testRows) Close() error      { return nil }
+func (r *testRows) Next(dest []driver.Value) error {
+	if r.i == len(r.d.rows) {
+		return io.EOF
+	}
+	copy(dest, r.d.rows[r.i])
+	r.i = r.i + 1
+	return nil
+}
+
+func init() {
+	sql.Register("ipcad2ch-test", &testDriver{
+		columns: []string{"id", "ip", "region"},
+		rows: [][]driver.Value{
+			{int64(1), []byte("192.168.0.1"), "north"},
+			{int64(2), "192.168.0.2/32", nil},
+		},
+	})
+}
+
+func TestShouldQueryUsers(t *testing.T) {
+	cfg := Config{}
+	cfg.Users.SQL.Driver = "ipcad2ch-test"
+	cfg.Users.SQL.Query = "SELECT id, ip, region FROM subscribers"
+	cfg.Users.Fetch.Attributes = []string{"region"}
+
+	// Format of file source doesn't apply to query
+	cfg.Users.Fetch.Format = "csv"
+
+	c := NewClassifier(cfg)
+
+	if c.Users[IP2Int(ParseUserIP("192.168.0.1"))] != "1" || c.Users[IP2Int(ParseUserIP("192.168.0.2"))] != "2" {
+		t.Errorf("Users mismatch %v", c.Users)
+	}
+
+	if c.UserAttributes["1"]["region"] != "north" || c.UserAttributes["2"]["region"] != "" {
+		t.Errorf("Attributes mismatch %v", c.UserAttributes)
+	}
+
+	if c.UserSources[IP2Int(ParseUserIP("192.168.0.1"))] != "ipcad2ch-test query" {
+		t.Errorf("Source mismatch %s", c.UserSources[IP2Int(ParseUserIP("192.168.0.1"))])
+	}
+}
+
+func TestShouldQuoteDictionaryQuery(t *testing.T) {
+	if quote(`SELECT 'a\b'`) != `SELECT \'a\\b\'` {
+		t.Errorf("Quote mismatch %s", quote(`SELECT 'a\b'`))
+	}
+}
+
+func TestShouldRejectUnknownDriver(t *testing.T) {
+	cfg := Config{}
+	cfg.Users.SQL.Driver = "postgres"
+	cfg.Users.SQL.Query = "SELECT id, ip FROM subscribers"
+
+	_, err := build(cfg, nil)
+	if err == nil || !strings.Contains(err.Error(), "unsupported SQL driver postgres") {
+		t.Errorf("Should reject driver which is not built in, got %v", err)
+	}
+}
@@ -0,0 +1,20 @@
+package classifier
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Trace collects classification decisions made by Explain
+type Trace struct {
+	Steps []string
+}
+
+// Add appends decision step
+func (t *Trace) Add(format string, args ...interface{}) {
+	t.Steps = append(t.Steps, fmt.Sprintf(format, args...))
+}
+
+func (t *Trace) String() string {
+	return strings.Join(t.Steps, "\n")
+}
@@ -0,0 +1,125 @@
+package classifier
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+type trieNode struct {
+	children [2]*trieNode
+	value    interface{}
+	set      bool
+}
+
+/*
+Trie is IPv4 binary prefix tree with longest prefix match lookup
+
+Should be instantiate with NewTrie method
+*/
+type Trie struct {
+	root *trieNode
+	size int
+}
+
+// NewTrie constructor method
+func NewTrie() *Trie {
+	return &Trie{root: &trieNode{}}
+}
+
+// Insert stores value for network, existing value is replaced
+func (t *Trie) Insert(network net.IPNet, value interface{}) bool {
+	ip := network.IP.To4()
+	if ip == nil {
+		return false
+	}
+
+	ones, bits := network.Mask.Size()
+	if bits != 32 {
+		return false
+	}
+
+	key := IP2Int(ip)
+	node := t.root
+	for i := 0; i < ones; i++ {
+		bit := (key >> uint(31-i)) & 1
+		if node.children[bit] == nil {
+			node.children[bit] = &trieNode{}
+		}
+		node = node.children[bit]
+	}
+
+	if !node.set {
+		t.size = t.size + 1
+	}
+
+	node.value = value
+	node.set = true
+
+	return true
+}
+
+// Lookup returns value of the longest prefix containing ip
+func (t *Trie) Lookup(ip net.IP) (interface{}, bool) {
+	_, value, found := t.LookupNetwork(ip)
+	return value, found
+}
+
+// LookupNetwork returns the longest prefix containing ip and its value
+func (t *Trie) LookupNetwork(ip net.IP) (net.IPNet, interface{}, bool) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return net.IPNet{}, nil, false
+	}
+
+	key := IP2Int(ip4)
+
+	var value interface{}
+	found := false
+	ones := 0
+
+	node := t.root
+	for i := 0; node != nil; i++ {
+		if node.set {
+			value = node.value
+			found = true
+			ones = i
+		}
+
+		if i == 32 {
+			break
+		}
+
+		node = node.children[(key>>uint(31-i))&1]
+	}
+
+	if !found {
+		return net.IPNet{}, nil, false
+	}
+
+	mask := net.CIDRMask(ones, 32)
+	return net.IPNet{IP: ip4.Mask(mask), Mask: mask}, value, true
+}
+
+// Len returns number of stored prefixes
+func (t *Trie) Len() int {
+	return t.size
+}
+
+// Walk calls fn for every stored prefix in address order, shorter prefixes first
+func (t *Trie) Walk(fn func(network net.IPNet, value interface{})) {
+	t.root.walk(0, 0, fn)
+}
+
+func (n *trieNode) walk(key uint32, ones int, fn func(net.IPNet, interface{})) {
+	if n.set {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, key)
+		fn(net.IPNet{IP: ip, Mask: net.CIDRMask(ones, 32)}, n.value)
+	}
+
+	for bit, child := range n.children {
+		if child != nil {
+			child.walk(key|uint32(bit)<<uint(31-ones), ones+1, fn)
+		}
+	}
+}
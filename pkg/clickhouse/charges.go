@@ -0,0 +1,93 @@
+package clickhouse
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/inkuber/ipcad2ch/pkg/rating"
+	"log"
+	"time"
+)
+
+func initCharges(db *sql.DB) error {
+	chargesQuery := `
+		CREATE TABLE IF NOT EXISTS charges
+		(
+			month Date,
+			user_id String,
+			tariff LowCardinality(String),
+			rule LowCardinality(String),
+			bytes UInt64,
+			billed_bytes UInt64,
+			cost Float64
+		)
+		ENGINE = SummingMergeTree((bytes, billed_bytes, cost))
+		PARTITION BY toYYYYMM(month)
+		ORDER BY (month, user_id, tariff, rule)
+		SETTINGS index_granularity = 8192
+	`
+
+	_, err := db.Exec(chargesQuery)
+	return err
+}
+
+// loadUsage returns bytes of month already charged by user and rule, used for free quotas
+func loadUsage(db *sql.DB, month time.Time) (map[rating.UsageKey]uint64, error) {
+	log.Println(fmt.Sprintf("Loading charged usage of month %s", month.Format("2006-01")))
+
+	rows, err := db.Query(`
+		SELECT user_id, rule, sum(bytes)
+		FROM charges
+		WHERE month = ?
+		GROUP BY user_id, rule
+	`, month)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := make(map[rating.UsageKey]uint64)
+	for rows.Next() {
+		var userID, rule string
+		var bytes uint64
+
+		err := rows.Scan(&userID, &rule, &bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		usage[rating.UsageKey{Month: month, UserID: userID, Rule: rule}] = bytes
+	}
+
+	return usage, rows.Err()
+}
+
+// saveCharges writes charges of saved entries, rows are summed by charges table engine
+func saveCharges(db *sql.DB, charges []rating.Charge) error {
+	if len(charges) == 0 {
+		return nil
+	}
+
+	log.Println(fmt.Sprintf("Saving %d charges to clickhouse", len(charges)))
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare("INSERT INTO charges (month, user_id, tariff, rule, bytes, billed_bytes, cost) VALUES (?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, c := range charges {
+		_, err := stmt.Exec(c.Month, c.UserID, c.Tariff, c.Rule, c.Bytes, c.Billed, c.Cost)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
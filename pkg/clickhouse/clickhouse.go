@@ -1,14 +1,18 @@
 package clickhouse
 
 import (
+	"context"
 	"database/sql"
 	"encoding/binary"
 	"fmt"
 	"github.com/ClickHouse/clickhouse-go"
 	"github.com/inkuber/ipcad2ch/pkg/classifier"
-	"github.com/inkuber/ipcad2ch/pkg/ipcad"
+	"github.com/inkuber/ipcad2ch/pkg/metrics"
+	"github.com/inkuber/ipcad2ch/pkg/rating"
 	"log"
 	"net"
+	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -21,6 +25,21 @@ type Config struct {
 	Password  string `mapstructure:"password"`
 	Database  string `mapstructure:"database"`
 	BunchSize int    `mapstructure:"bunch"`
+
+	// Number of top unclassified prefixes in end of run report
+	UnclassifiedTop int `mapstructure:"unclassifiedTop"`
+
+	// Write users and networks dictionaries to history tables
+	History bool `mapstructure:"history"`
+
+	// Anonymization of details addresses
+	Privacy PrivacyConfig `mapstructure:"privacy"`
+
+	// Retries and spool of failed writes
+	Spool SpoolConfig `mapstructure:"spool"`
+
+	// Journal of loads
+	Loads LoadsConfig `mapstructure:"loads"`
 }
 
 type Entry struct {
@@ -33,96 +52,468 @@ type Entry struct {
 	Proto     uint8
 	Iface     string
 	Collected time.Time
+	Exporter  string
+
+	UserID    string
+	Dir       string
+	Class     string
+	RemoteASN uint32
 
-	UserID string
-	Dir    string
-	Class  string
+	RemoteCountry string
+	RemoteOrg     string
+	Service       string
+
+	UserAttributes map[string]string
+	DictVersion    string
+	Mirror         bool
+	Cost           float64
 }
 
-func Write(wg *sync.WaitGroup, cfg Config, c classifier.Classifier, in chan *ipcad.Entry) {
+// Write rates and saves classified entries in bunches, c is used for attributes columns and dictionaries history.
+// Bunches which could not be written are retried and spooled to disk when spool is configured,
+// l is recorded to loads journal when it is not nil
+func Write(wg *sync.WaitGroup, cfg Config, c *classifier.Classifier, r *rating.Rater, l *Load, in chan *classifier.Entry) {
 	log.Println("Starting clickhouse write coroutine")
 
 	defer wg.Done()
 
-	db, err := connect(cfg)
-	defer db.Close()
+	err := cfg.Privacy.validate()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	w := &writer{
+		cfg:        cfg,
+		c:          c,
+		r:          r,
+		attributes: c.Attributes(),
+		spool:      NewSpool(cfg.Spool),
+		load:       l,
+	}
+
+	var loadID string
+	if l != nil {
+		loadID = l.ID
+	}
+	defer w.close()
+
+	// Entries are anonymized on insert without retention
+	if cfg.Privacy.Retention == 0 {
+		w.privacy = cfg.Privacy
+	}
+
+	if r.Enabled() {
+		r.Usage = func(month time.Time) (map[rating.UsageKey]uint64, error) {
+			db, err := w.conn()
+			if err != nil {
+				return nil, err
+			}
+
+			return loadUsage(db, month)
+		}
+	}
+
+	_, err = w.conn()
+	if err != nil {
+		if !w.spool.Enabled() {
+			log.Fatal(err)
+		}
+
+		log.Println(fmt.Sprintf("Could not connect to clickhouse, entries are spooled: %v", err))
+	} else {
+		w.replay()
+	}
+
+	bunch := make([]Entry, cfg.BunchSize)
+	unclassified := NewUnclassified()
+
+	index := 0
+	for e := range in {
+		if index == cfg.BunchSize {
+			w.write(&Batch{LoadID: loadID, Entries: bunch})
+			index = 0
+
+			if unclassified.Len() > cfg.BunchSize {
+				w.saveUnclassified(unclassified)
+			}
+		}
+
+		bunch[index] = Entry(*e)
+		unclassified.Add(bunch[index])
+
+		if l != nil {
+			l.Rows = l.Rows + 1
+			l.Bytes = l.Bytes + e.Bytes
+		}
+
+		index = index + 1
+	}
+
+	if index > 0 {
+		w.write(&Batch{LoadID: loadID, Entries: bunch[:index]})
+	}
+
+	// Charges of entries rated before failed write
+	if charges := r.Flush(); len(charges) > 0 {
+		w.write(&Batch{LoadID: loadID, Charges: charges})
+	}
+
+	w.saveUnclassified(unclassified)
+	unclassified.Report(cfg.UnclassifiedTop)
+
+	w.saveLoad()
+	w.anonymize()
+	w.spool.Report()
+
+	log.Println("Clickhouse write coroutine ended")
+}
+
+// writer connects to clickhouse lazily and stores batches with retries and spool
+type writer struct {
+	cfg        Config
+	c          *classifier.Classifier
+	r          *rating.Rater
+	attributes []string
+	privacy    PrivacyConfig
+	spool      *Spool
+	load       *Load
+
+	// spooled is set when batch of this run is spooled
+	spooled bool
+
+	// versions are dictionaries versions of written entries checked in history
+	versions map[string]bool
+
+	db *sql.DB
+}
+
+// conn returns connection with initialized tables, it is connected again after failure
+func (w *writer) conn() (*sql.DB, error) {
+	if w.db != nil {
+		return w.db, nil
+	}
+
+	db, err := connect(w.cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	err = w.init(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	w.db = db
+
+	return db, nil
+}
+
+// anonymize rewrites old partitions after entries of this run and spooled ones are written,
+// so partitions are not replaced while this run writes to them
+func (w *writer) anonymize() {
+	if !w.cfg.Privacy.Enabled() || w.cfg.Privacy.Retention == 0 || w.db == nil {
+		return
+	}
+
+	count, _, err := w.spool.Stats()
+	if err != nil {
+		log.Println(fmt.Sprintf("Could not check spool, details partitions are not anonymized: %v", err))
+		return
+	}
+
+	if count > 0 {
+		log.Println(fmt.Sprintf("Details partitions are not anonymized while %d batches are spooled", count))
+		return
+	}
+
+	err = anonymizePartitions(w.db, w.cfg.Privacy)
+	if err != nil {
+		log.Println(fmt.Sprintf("Could not anonymize details partitions: %v", err))
+	}
+}
+
+func (w *writer) init(db *sql.DB) error {
+	err := initTables(db, w.attributes)
+	if err != nil {
+		return err
+	}
+
+	if w.cfg.History {
+		err = w.saveHistory(db, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	if w.r.Enabled() {
+		err = initCharges(db)
+		if err != nil {
+			return err
+		}
+	}
+
+	if w.load != nil {
+		err = initLoads(db)
+		if err != nil {
+			return err
+		}
+
+		err = saveLoad(db, w.load, STARTED)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// saveHistory writes current dictionaries to history when entries carry unknown version,
+// so version loaded by Reload or followed sessions is saved before its first entries
+func (w *writer) saveHistory(db *sql.DB, entries []Entry) error {
+	if w.versions == nil {
+		w.versions = make(map[string]bool)
+	}
+
+	known := entries != nil
+	for _, e := range entries {
+		if !w.versions[e.DictVersion] {
+			known = false
+			break
+		}
+	}
+
+	if known {
+		return nil
+	}
+
+	s := w.c.Snapshot()
+	if !w.versions[s.Version] {
+		err := saveHistory(db, s)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Versions replaced before their entries were written could not be saved
+	w.versions[s.Version] = true
+	for _, e := range entries {
+		w.versions[e.DictVersion] = true
+	}
+
+	return nil
+}
+
+func (w *writer) close() {
+	if w.db != nil {
+		w.db.Close()
+	}
+}
+
+// store rates entries once and saves entries and charges, saved parts are removed from batch
+func (w *writer) store(b *Batch) error {
+	db, err := w.conn()
+	if err != nil {
+		return err
+	}
+
+	if b.Rated < len(b.Entries) {
+		for b.Rated < len(b.Entries) {
+			e := classifier.Entry(b.Entries[b.Rated])
+
+			err := w.r.Rate(&e)
+			if err != nil {
+				return err
+			}
+
+			b.Entries[b.Rated].Cost = e.Cost
+			b.Rated = b.Rated + 1
+		}
+
+		b.Charges = append(b.Charges, w.r.Flush()...)
+	}
+
+	if len(b.Entries) > 0 && w.cfg.History {
+		err = w.saveHistory(db, b.Entries)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(b.Entries) > 0 {
+		err = save(db, b.LoadID, b.Entries, w.attributes, w.privacy)
+		if err != nil {
+			return err
+		}
+
+		b.Entries = nil
+		b.Rated = 0
+	}
+
+	if len(b.Charges) > 0 {
+		err = saveCharges(db, b.Charges)
+		if err != nil {
+			return err
+		}
+
+		b.Charges = nil
+	}
+
+	return nil
+}
+
+// retry stores batch with retries and growing backoff
+func (w *writer) retry(b *Batch) error {
+	backoff := w.cfg.Spool.Backoff
+
+	var err error
+	for attempt := 0; attempt <= w.cfg.Spool.Retries; attempt++ {
+		if attempt > 0 {
+			log.Println(fmt.Sprintf("Retrying clickhouse write in %s after error: %v", backoff, err))
+			metrics.Add("ipcad2ch_clickhouse_retries_total", 1)
+			time.Sleep(backoff)
+			backoff = backoff * 2
+		}
+
+		err = w.store(b)
+		if err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
 
+// write stores batch after spooled ones, batch is spooled when it could not be written
+func (w *writer) write(b *Batch) {
+	names, err := w.spool.Files()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = initTables(db)
+	// Spooled batches are written first to keep order
+	if len(names) > 0 {
+		w.push(b)
+		w.replay()
+		return
+	}
+
+	err = w.retry(b)
+	if err == nil {
+		return
+	}
+
+	if !w.spool.Enabled() {
+		log.Fatal(err)
+	}
+
+	log.Println(fmt.Sprintf("Could not write to clickhouse: %v", err))
+	w.push(b)
+}
+
+// push spools batch, batch is dropped when spool is full
+func (w *writer) push(b *Batch) {
+	err := w.spool.Push(b)
+	if err == ErrSpoolFull {
+		log.Println(fmt.Sprintf("Dropped batch of %d entries and %d charges: %v", len(b.Entries), len(b.Charges), err))
+		metrics.Add("ipcad2ch_spool_dropped_entries_total", float64(len(b.Entries)))
+		return
+	}
+
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	bunch := make([]Entry, cfg.BunchSize)
+	w.spooled = true
+	metrics.Add("ipcad2ch_spool_pushed_batches_total", 1)
+}
+
+// replay writes spooled batches in order until first failure
+func (w *writer) replay() {
+	names, err := w.spool.Files()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(names) > 0 {
+		log.Println(fmt.Sprintf("Replaying %d spooled batches", len(names)))
+	}
+
+	for _, name := range names {
+		b, err := w.spool.Load(name)
+		if err != nil {
+			log.Println(err)
+			err = w.spool.Reject(name)
+			if err != nil {
+				log.Fatal(err)
+			}
+			continue
+		}
+
+		err = w.store(b)
+		if err != nil {
+			log.Println(fmt.Sprintf("Could not replay spooled batch %s: %v", name, err))
 
-	var chWg sync.WaitGroup
-
-	chWg.Add(1)
-	go func() {
-		index := 0
-		for {
-			select {
-			case e := <-in:
-				if e == nil {
-					if index > 0 {
-						tosave := bunch[:index]
-						err := save(db, tosave)
-						if err != nil {
-							log.Fatal(err)
-						}
-					}
-
-					chWg.Done()
-					log.Println("Clickhouse read coroutine ended")
-					return
-				}
-
-				ipcadEntry := *e
-
-				if index < cfg.BunchSize {
-					if ipcadEntry.SrcIP == nil || ipcadEntry.DstIP == nil {
-						log.Fatal("nil src or dst passed")
-					}
-
-					entry := Entry{
-						SrcIP:     ipcadEntry.SrcIP,
-						DstIP:     ipcadEntry.DstIP,
-						Packets:   ipcadEntry.Packets,
-						Bytes:     ipcadEntry.Bytes,
-						SrcPort:   ipcadEntry.SrcPort,
-						DstPort:   ipcadEntry.DstPort,
-						Proto:     ipcadEntry.Proto,
-						Iface:     ipcadEntry.Iface,
-						Collected: ipcadEntry.Collected,
-					}
-
-					e := classifier.Entry(entry)
-					c.Classify(&e)
-
-					bunch[index] = Entry(e)
-
-					index = index + 1
-				} else {
-					err := save(db, bunch)
-					if err != nil {
-						log.Fatal(err)
-					}
-					index = 0
-				}
+			// Rest of batch is kept, written part is not replayed again
+			err = w.spool.Save(name, b)
+			if err != nil {
+				log.Fatal(err)
 			}
+			return
+		}
+
+		err = w.spool.Remove(name)
+		if err != nil {
+			log.Fatal(err)
 		}
-	}()
 
-	chWg.Wait()
+		metrics.Add("ipcad2ch_spool_replayed_batches_total", 1)
+	}
 }
 
-func save(db *sql.DB, bunch []Entry) error {
+// saveLoad records load is done or spooled
+func (w *writer) saveLoad() {
+	if w.load == nil {
+		return
+	}
+
+	status := DONE
+	if w.spooled {
+		status = SPOOLED
+	}
+
+	db, err := w.conn()
+	if err == nil {
+		err = saveLoad(db, w.load, status)
+	}
+
+	if err != nil {
+		log.Println(fmt.Sprintf("Could not record load %s: %v", w.load.ID, err))
+	}
+}
+
+// saveUnclassified writes unclassified prefixes, they are kept for next save on failure
+func (w *writer) saveUnclassified(u *Unclassified) {
+	db, err := w.conn()
+	if err == nil {
+		err = u.Save(db)
+	}
+
+	if err != nil {
+		log.Println(fmt.Sprintf("Could not save unclassified prefixes: %v", err))
+	}
+}
+
+func save(db *sql.DB, loadID string, bunch []Entry, attributes []string, privacy PrivacyConfig) error {
 	log.Println(fmt.Sprintf("Saving bunch of records to clickhouse [len=%d cap=%d]", len(bunch), cap(bunch)))
 
-	insertQuery := `
+	// User attributes are stored in user_<attribute> columns
+	attributeColumns := ""
+	for _, attribute := range attributes {
+		attributeColumns = attributeColumns + fmt.Sprintf(",\n\t\t\tuser_%s", attribute)
+	}
+
+	insertQuery := fmt.Sprintf(`
 		INSERT INTO details (
 			collected,
 			user_id,
@@ -134,9 +525,20 @@ func save(db *sql.DB, bunch []Entry) error {
 			dst_port,
 			packets,
 			bytes,
-			proto
-		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`
+			proto,
+			remote_asn,
+			remote_country,
+			remote_org,
+			service,
+			exporter,
+			iface,
+			dict_version,
+			mirror,
+			cost,
+			anonymized,
+			load_id%s
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?%s)
+	`, attributeColumns, strings.Repeat(", ?", len(attributes)))
 
 	tx, err := db.Begin()
 	if err != nil {
@@ -145,6 +547,7 @@ func save(db *sql.DB, bunch []Entry) error {
 
 	stmt, err := tx.Prepare(insertQuery)
 	if err != nil {
+		tx.Rollback()
 		return err
 	}
 	defer stmt.Close()
@@ -157,7 +560,18 @@ func save(db *sql.DB, bunch []Entry) error {
 		srcIP := ip2int(e.SrcIP)
 		dstIP := ip2int(e.DstIP)
 
-		_, err := stmt.Exec(
+		var anonymized uint8
+		if privacy.Enabled() {
+			srcIP, dstIP = privacy.anonymize(e.Dir, e.UserID, srcIP, dstIP)
+			anonymized = 1
+		}
+
+		var mirror uint8
+		if e.Mirror {
+			mirror = 1
+		}
+
+		values := []interface{}{
 			e.Collected,
 			e.UserID,
 			e.Dir,
@@ -169,10 +583,28 @@ func save(db *sql.DB, bunch []Entry) error {
 			e.Packets,
 			e.Bytes,
 			e.Proto,
-		)
+			e.RemoteASN,
+			e.RemoteCountry,
+			e.RemoteOrg,
+			e.Service,
+			e.Exporter,
+			e.Iface,
+			e.DictVersion,
+			mirror,
+			e.Cost,
+			anonymized,
+			loadID,
+		}
+
+		for _, attribute := range attributes {
+			values = append(values, e.UserAttributes[attribute])
+		}
+
+		_, err := stmt.Exec(values...)
 
 		if err != nil {
-			log.Fatal(err)
+			tx.Rollback()
+			return err
 		}
 	}
 
@@ -184,9 +616,8 @@ func save(db *sql.DB, bunch []Entry) error {
 	return nil
 }
 
-func connect(cfg Config) (*sql.DB, error) {
-	log.Println("Connecting to clickhouse")
-
+// DSN returns clickhouse-go data source name of connection settings
+func DSN(cfg Config) string {
 	var params []string
 	if cfg.User != "" {
 		params = append(params, fmt.Sprintf("username=%s", cfg.User))
@@ -200,10 +631,16 @@ func connect(cfg Config) (*sql.DB, error) {
 		params = append(params, fmt.Sprintf("database=%s", cfg.Database))
 	}
 
-	DSN := fmt.Sprintf("tcp://%s:%d?%s", cfg.Host, cfg.Port, strings.Join(params, "&"))
-	log.Println(fmt.Sprintf("DSN: %s", DSN))
+	return fmt.Sprintf("tcp://%s:%d?%s", cfg.Host, cfg.Port, strings.Join(params, "&"))
+}
+
+func connect(cfg Config) (*sql.DB, error) {
+	log.Println("Connecting to clickhouse")
+
+	dsn := DSN(cfg)
+	log.Println(fmt.Sprintf("DSN: %s", dsn))
 
-	db, err := sql.Open("clickhouse", DSN)
+	db, err := sql.Open("clickhouse", dsn)
 	if err != nil {
 		return nil, err
 	}
@@ -220,7 +657,178 @@ func connect(cfg Config) (*sql.DB, error) {
 	return db, nil
 }
 
-func initTables(db *sql.DB) error {
+// Columns added to details after first release, created on existing tables
+var detailsColumns = []string{
+	"remote_asn UInt32",
+	"remote_country LowCardinality(String)",
+	"remote_org LowCardinality(String)",
+	"service LowCardinality(String)",
+	"exporter LowCardinality(String)",
+	"iface LowCardinality(String)",
+	"dict_version LowCardinality(String)",
+	"mirror UInt8",
+	"cost Float64",
+	"anonymized UInt8",
+	"load_id String",
+}
+
+// classEnum is type of class columns, tables created before new classes are altered to it
+var classEnum = "Enum8('unknown' = 0, 'local' = 1, 'peering' = 2, 'internet' = 3, 'multicast' = 4, 'private' = 5, 'cgnat' = 6, 'linklocal' = 7, 'broadcast' = 8, 'reserved' = 9, 'bogon' = 10)"
+
+// migrateClasses extends class columns of details, views inner tables and history,
+// materialized views can't be altered, their inner tables are altered instead
+func migrateClasses(db *sql.DB) error {
+	rows, err := db.Query(`
+		SELECT c.table, t.engine, c.type
+		FROM system.columns AS c
+		INNER JOIN system.tables AS t ON c.database = t.database AND c.table = t.name
+		WHERE c.database = currentDatabase() AND c.name = 'class' AND c.type LIKE 'Enum8(%'
+	`)
+	if err != nil {
+		return err
+	}
+
+	tables := make([]string, 0)
+	for rows.Next() {
+		var table, engine, columnType string
+		err := rows.Scan(&table, &engine, &columnType)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+
+		if columnType == classEnum || !strings.HasSuffix(engine, "MergeTree") {
+			continue
+		}
+
+		tables = append(tables, table)
+	}
+	rows.Close()
+
+	for _, table := range tables {
+		log.Println(fmt.Sprintf("Extending classes of table %s", table))
+
+		_, err = db.Exec(fmt.Sprintf("ALTER TABLE `%s` MODIFY COLUMN class %s", table, classEnum))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+var (
+	viewKey    = regexp.MustCompile(`ORDER BY \(([^)]*)\)`)
+	viewSelect = regexp.MustCompile(`(?s)SETTINGS index_granularity = 8192 AS(.*)$`)
+)
+
+// migrateMirror adds mirror key to views created before mirrored rows were
+// split, inner table gets the column and view query is replaced, so mirrored
+// rows written before migration stay counted with mirror = 0
+func migrateMirror(db *sql.DB, views map[string]string) error {
+	rows, err := db.Query(`
+		SELECT
+			name,
+			if(uuid = toUUID('00000000-0000-0000-0000-000000000000'), concat('.inner.', name), concat('.inner_id.', toString(uuid))) AS inner
+		FROM system.tables
+		WHERE database = currentDatabase() AND engine = 'MaterializedView' AND inner NOT IN (
+			SELECT table FROM system.columns WHERE database = currentDatabase() AND name = 'mirror'
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	inners := make(map[string]string)
+	for rows.Next() {
+		var view, inner string
+		err := rows.Scan(&view, &inner)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+
+		if _, ok := views[view]; ok {
+			inners[view] = inner
+		}
+	}
+	rows.Close()
+
+	if len(inners) == 0 {
+		return nil
+	}
+
+	// Setting of view query change is kept by connection
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(context.Background(), "SET allow_experimental_alter_materialized_view_structure = 1")
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(inners))
+	for view := range inners {
+		names = append(names, view)
+	}
+	sort.Strings(names)
+
+	for _, view := range names {
+		log.Println(fmt.Sprintf("Adding mirror key to view %s", view))
+
+		key := viewKey.FindStringSubmatch(views[view])[1]
+		_, err = conn.ExecContext(context.Background(), fmt.Sprintf("ALTER TABLE `%s` ADD COLUMN IF NOT EXISTS mirror UInt8 AFTER dir, MODIFY ORDER BY (%s)", inners[view], key))
+		if err != nil {
+			return err
+		}
+
+		query := viewSelect.FindStringSubmatch(views[view])[1]
+		_, err = conn.ExecContext(context.Background(), fmt.Sprintf("ALTER TABLE `%s` MODIFY QUERY %s", view, query))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// userAttributeView is daily aggregation by user attribute
+func userAttributeView(attribute string) string {
+	return fmt.Sprintf(`
+		CREATE MATERIALIZED VIEW IF NOT EXISTS daily_user_%[1]s
+		(
+			date Date,
+			%[1]s LowCardinality(String),
+			class Enum8('unknown' = 0, 'local' = 1, 'peering' = 2, 'internet' = 3, 'multicast' = 4, 'private' = 5, 'cgnat' = 6, 'linklocal' = 7, 'broadcast' = 8, 'reserved' = 9, 'bogon' = 10),
+			dir Enum8('unknown' = 0, 'in' = 1, 'out' = 2),
+			mirror UInt8,
+			bytes AggregateFunction(sum, UInt32)
+		)
+		ENGINE = AggregatingMergeTree()
+		PARTITION BY toYYYYMM(date)
+		ORDER BY (date, %[1]s, class, dir, mirror)
+		SETTINGS index_granularity = 8192 AS
+		SELECT
+			toDate(collected) AS date,
+			user_%[1]s AS %[1]s,
+			class,
+			dir,
+			mirror,
+			sumState(bytes) AS bytes
+		FROM details
+		GROUP BY
+			toDate(collected),
+			user_%[1]s,
+			class,
+			dir,
+			mirror
+	`, attribute)
+}
+
+func initTables(db *sql.DB, attributes []string) error {
 	log.Println("Checking tables exists in clickhouse")
 
 	detailsQuery := `
@@ -229,14 +837,25 @@ func initTables(db *sql.DB) error {
 			collected DateTime,
 			user_id String,
 			dir Enum8('unknown' = 0, 'in' = 1, 'out' = 2),
-			class Enum8('unknown' = 0, 'local' = 1, 'peering' = 2, 'internet' = 3, 'multicast' = 4),
+			class Enum8('unknown' = 0, 'local' = 1, 'peering' = 2, 'internet' = 3, 'multicast' = 4, 'private' = 5, 'cgnat' = 6, 'linklocal' = 7, 'broadcast' = 8, 'reserved' = 9, 'bogon' = 10),
 			src_ip UInt32,
 			src_port UInt16,
 			dst_ip UInt32,
 			dst_port UInt16,
 			packets UInt16,
 			bytes UInt32,
-			proto UInt8
+			proto UInt8,
+			remote_asn UInt32,
+			remote_country LowCardinality(String),
+			remote_org LowCardinality(String),
+			service LowCardinality(String),
+			exporter LowCardinality(String),
+			iface LowCardinality(String),
+			dict_version LowCardinality(String),
+			mirror UInt8,
+			cost Float64,
+			anonymized UInt8,
+			load_id String
 		)
 		ENGINE = MergeTree
 		PARTITION BY toYYYYMMDD(collected)
@@ -249,26 +868,29 @@ func initTables(db *sql.DB) error {
 		(
 			date Date,
 			user_id String,
-			class Enum8('unknown' = 0, 'local' = 1, 'peering' = 2, 'internet' = 3, 'multicast' = 4),
+			class Enum8('unknown' = 0, 'local' = 1, 'peering' = 2, 'internet' = 3, 'multicast' = 4, 'private' = 5, 'cgnat' = 6, 'linklocal' = 7, 'broadcast' = 8, 'reserved' = 9, 'bogon' = 10),
 			dir Enum8('unknown' = 0, 'in' = 1, 'out' = 2),
+			mirror UInt8,
 			bytes AggregateFunction(sum, UInt32)
 		)
 		ENGINE = AggregatingMergeTree()
 		PARTITION BY toYYYYMM(date)
-		ORDER BY (date, user_id, class, dir)
+		ORDER BY (date, user_id, class, dir, mirror)
 		SETTINGS index_granularity = 8192 AS
 		SELECT
 			toDate(collected) AS date,
 			user_id,
 			class,
 			dir,
+			mirror,
 			sumState(bytes) AS bytes
 		FROM details
 		GROUP BY
 			toDate(collected),
 			user_id,
 			class,
-			dir
+			dir,
+			mirror
 	`
 
 	hourlyQuery := `
@@ -276,26 +898,29 @@ func initTables(db *sql.DB) error {
 		(
 			date DateTime,
 			user_id String,
-			class Enum8('unknown' = 0, 'local' = 1, 'peering' = 2, 'internet' = 3, 'multicast' = 4),
+			class Enum8('unknown' = 0, 'local' = 1, 'peering' = 2, 'internet' = 3, 'multicast' = 4, 'private' = 5, 'cgnat' = 6, 'linklocal' = 7, 'broadcast' = 8, 'reserved' = 9, 'bogon' = 10),
 			dir Enum8('unknown' = 0, 'in' = 1, 'out' = 2),
+			mirror UInt8,
 			bytes AggregateFunction(sum, UInt32)
 		)
 		ENGINE = AggregatingMergeTree()
 		PARTITION BY toYYYYMM(date)
-		ORDER BY (date, user_id, class, dir)
+		ORDER BY (date, user_id, class, dir, mirror)
 		SETTINGS index_granularity = 8192 AS
 		SELECT
 			toStartOfHour(collected) AS date,
 			user_id,
 			class,
 			dir,
+			mirror,
 			sumState(bytes) AS bytes
 		FROM details
 		GROUP BY
 			toStartOfHour(collected),
 			user_id,
 			class,
-			dir
+			dir,
+			mirror
 	`
 
 	minutelyQuery := `
@@ -303,26 +928,108 @@ func initTables(db *sql.DB) error {
 		(
 			date DateTime,
 			user_id String,
-			class Enum8('unknown' = 0, 'local' = 1, 'peering' = 2, 'internet' = 3, 'multicast' = 4),
+			class Enum8('unknown' = 0, 'local' = 1, 'peering' = 2, 'internet' = 3, 'multicast' = 4, 'private' = 5, 'cgnat' = 6, 'linklocal' = 7, 'broadcast' = 8, 'reserved' = 9, 'bogon' = 10),
 			dir Enum8('unknown' = 0, 'in' = 1, 'out' = 2),
+			mirror UInt8,
 			bytes AggregateFunction(sum, UInt32)
 		)
 		ENGINE = AggregatingMergeTree()
 		PARTITION BY toYYYYMM(date)
-		ORDER BY (date, user_id, class, dir)
+		ORDER BY (date, user_id, class, dir, mirror)
 		SETTINGS index_granularity = 8192 AS
 		SELECT
 			toStartOfMinute(collected) AS date,
 			user_id,
 			class,
 			dir,
+			mirror,
 			sumState(bytes) AS bytes
 		FROM details
 		GROUP BY
 			toStartOfMinute(collected),
 			user_id,
 			class,
-			dir
+			dir,
+			mirror
+	`
+
+	dailyCountryQuery := `
+		CREATE MATERIALIZED VIEW IF NOT EXISTS daily_country
+		(
+			date Date,
+			user_id String,
+			country LowCardinality(String),
+			dir Enum8('unknown' = 0, 'in' = 1, 'out' = 2),
+			mirror UInt8,
+			bytes AggregateFunction(sum, UInt32)
+		)
+		ENGINE = AggregatingMergeTree()
+		PARTITION BY toYYYYMM(date)
+		ORDER BY (date, user_id, country, dir, mirror)
+		SETTINGS index_granularity = 8192 AS
+		SELECT
+			toDate(collected) AS date,
+			user_id,
+			remote_country AS country,
+			dir,
+			mirror,
+			sumState(bytes) AS bytes
+		FROM details
+		GROUP BY
+			toDate(collected),
+			user_id,
+			remote_country,
+			dir,
+			mirror
+	`
+
+	dailyServiceQuery := `
+		CREATE MATERIALIZED VIEW IF NOT EXISTS daily_service
+		(
+			date Date,
+			user_id String,
+			service LowCardinality(String),
+			dir Enum8('unknown' = 0, 'in' = 1, 'out' = 2),
+			mirror UInt8,
+			bytes AggregateFunction(sum, UInt32)
+		)
+		ENGINE = AggregatingMergeTree()
+		PARTITION BY toYYYYMM(date)
+		ORDER BY (date, user_id, service, dir, mirror)
+		SETTINGS index_granularity = 8192 AS
+		SELECT
+			toDate(collected) AS date,
+			user_id,
+			service,
+			dir,
+			mirror,
+			sumState(bytes) AS bytes
+		FROM details
+		GROUP BY
+			toDate(collected),
+			user_id,
+			service,
+			dir,
+			mirror
+	`
+
+	unclassifiedQuery := `
+		CREATE TABLE IF NOT EXISTS unclassified
+		(
+			collected DateTime,
+			reason Enum8('no_network' = 1, 'no_user' = 2),
+			side Enum8('src' = 1, 'dst' = 2),
+			prefix String,
+			exporter LowCardinality(String),
+			iface LowCardinality(String),
+			flows UInt64,
+			packets UInt64,
+			bytes UInt64
+		)
+		ENGINE = SummingMergeTree((flows, packets, bytes))
+		PARTITION BY toYYYYMM(collected)
+		ORDER BY (collected, reason, prefix, side, exporter, iface)
+		SETTINGS index_granularity = 8192
 	`
 
 	_, err := db.Exec(detailsQuery)
@@ -330,6 +1037,18 @@ func initTables(db *sql.DB) error {
 		return err
 	}
 
+	columns := append([]string(nil), detailsColumns...)
+	for _, attribute := range attributes {
+		columns = append(columns, fmt.Sprintf("user_%s LowCardinality(String)", attribute))
+	}
+
+	for _, column := range columns {
+		_, err = db.Exec(fmt.Sprintf("ALTER TABLE details ADD COLUMN IF NOT EXISTS %s", column))
+		if err != nil {
+			return err
+		}
+	}
+
 	_, err = db.Exec(dailyQuery)
 	if err != nil {
 		return err
@@ -345,6 +1064,48 @@ func initTables(db *sql.DB) error {
 		return err
 	}
 
+	_, err = db.Exec(dailyCountryQuery)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(dailyServiceQuery)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(unclassifiedQuery)
+	if err != nil {
+		return err
+	}
+
+	views := map[string]string{
+		"daily":         dailyQuery,
+		"hourly":        hourlyQuery,
+		"minutely":      minutelyQuery,
+		"daily_country": dailyCountryQuery,
+		"daily_service": dailyServiceQuery,
+	}
+
+	for _, attribute := range attributes {
+		views["daily_user_"+attribute] = userAttributeView(attribute)
+
+		_, err = db.Exec(userAttributeView(attribute))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = migrateClasses(db)
+	if err != nil {
+		return err
+	}
+
+	err = migrateMirror(db, views)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -0,0 +1,179 @@
+package clickhouse
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// schemaDriver returns the same rows for any query and records executed statements,
+// results override rows by query when set
+type schemaDriver struct {
+	columns []string
+	rows    [][]driver.Value
+	execs   []string
+	results func(query string) [][]driver.Value
+}
+
+type schemaConn struct{ d *schemaDriver }
+type schemaStmt struct {
+	d     *schemaDriver
+	query string
+}
+type schemaRows struct {
+	d    *schemaDriver
+	rows [][]driver.Value
+	i    int
+}
+
+func (d *schemaDriver) Open(name string) (driver.Conn, error) { return &schemaConn{d}, nil }
+
+func (c *schemaConn) Prepare(query string) (driver.Stmt, error) { return &schemaStmt{c.d, query}, nil }
+func (c *schemaConn) Close() error                              { return nil }
+func (c *schemaConn) Begin() (driver.Tx, error)                 { return schemaTx{}, nil }
+
+type schemaTx struct{}
+
+func (schemaTx) Commit() error   { return nil }
+func (schemaTx) Rollback() error { return nil }
+
+func (s *schemaStmt) Close() error  { return nil }
+func (s *schemaStmt) NumInput() int { return -1 }
+func (s *schemaStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.d.execs = append(s.d.execs, s.query)
+	return driver.RowsAffected(0), nil
+}
+func (s *schemaStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if s.d.results != nil {
+		return &schemaRows{d: s.d, rows: s.d.results(s.query)}, nil
+	}
+	return &schemaRows{d: s.d, rows: s.d.rows}, nil
+}
+
+func (r *schemaRows) Columns() []string { return r.d.columns }
+func (r *schemaRows) Close() error      { return nil }
+func (r *schemaRows) Next(dest []driver.Value) error {
+	if r.i == len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.i])
+	r.i = r.i + 1
+	return nil
+}
+
+var schema = &schemaDriver{columns: []string{"table", "engine", "type"}}
+
+func init() {
+	sql.Register("ipcad2ch-schema", schema)
+}
+
+func TestShouldMigrateClassesOfStorageTablesOnly(t *testing.T) {
+	old := "Enum8('unknown' = 0, 'local' = 1, 'peering' = 2, 'internet' = 3, 'multicast' = 4)"
+
+	schema.rows = [][]driver.Value{
+		{"details", "MergeTree", old},
+		{"daily", "MaterializedView", old},
+		{".inner.daily", "AggregatingMergeTree", old},
+		{"hourly", "MaterializedView", old},
+		{".inner.hourly", "AggregatingMergeTree", old},
+		{"daily_user_tariff", "MaterializedView", old},
+		{".inner.daily_user_tariff", "AggregatingMergeTree", old},
+		{"network_map_history", "ReplacingMergeTree", classEnum},
+	}
+	schema.execs = nil
+
+	db, err := sql.Open("ipcad2ch-schema", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	err = migrateClasses(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"details", ".inner.daily", ".inner.hourly", ".inner.daily_user_tariff"}
+	if len(schema.execs) != len(expected) {
+		t.Fatalf("Should alter %d tables, got %v", len(expected), schema.execs)
+	}
+
+	for i, table := range expected {
+		if schema.execs[i] != fmt.Sprintf("ALTER TABLE `%s` MODIFY COLUMN class %s", table, classEnum) {
+			t.Errorf("Should alter %s, got %s", table, schema.execs[i])
+		}
+	}
+}
+
+func TestShouldAddAttributeColumnsOfOwnRunOnly(t *testing.T) {
+	schema.rows = nil
+
+	db, err := sql.Open("ipcad2ch-schema", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	size := len(detailsColumns)
+	for _, attributes := range [][]string{{"tariff"}, {"region"}} {
+		schema.execs = nil
+
+		err = initTables(db, attributes)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		added := make([]string, 0)
+		for _, query := range schema.execs {
+			if strings.HasPrefix(query, "ALTER TABLE details ADD COLUMN IF NOT EXISTS user_") {
+				added = append(added, query)
+			}
+		}
+
+		if len(added) != 1 || !strings.Contains(added[0], "user_"+attributes[0]) {
+			t.Errorf("Should add column of %v only, got %v", attributes, added)
+		}
+	}
+
+	if len(detailsColumns) != size {
+		t.Errorf("Should not change details columns %v", detailsColumns)
+	}
+}
+
+func TestShouldAddMirrorKeyToOwnViews(t *testing.T) {
+	schema.columns = []string{"name", "inner"}
+	defer func() { schema.columns = []string{"table", "engine", "type"} }()
+
+	schema.rows = [][]driver.Value{
+		{"daily", ".inner.daily"},
+		{"daily_user_tariff", ".inner_id.5b7d4c1e-0000-4000-8000-000000000001"},
+		{"custom_report", ".inner.custom_report"},
+	}
+	schema.execs = nil
+
+	db, err := sql.Open("ipcad2ch-schema", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	err = migrateMirror(db, map[string]string{"daily_user_tariff": userAttributeView("tariff")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(schema.execs) != 3 || !strings.HasPrefix(schema.execs[0], "SET ") {
+		t.Fatalf("Should alter own views only, got %v", schema.execs)
+	}
+
+	if schema.execs[1] != "ALTER TABLE `.inner_id.5b7d4c1e-0000-4000-8000-000000000001` ADD COLUMN IF NOT EXISTS mirror UInt8 AFTER dir, MODIFY ORDER BY (date, tariff, class, dir, mirror)" {
+		t.Errorf("Should add mirror to inner table key, got %s", schema.execs[1])
+	}
+
+	if !strings.HasPrefix(schema.execs[2], "ALTER TABLE `daily_user_tariff` MODIFY QUERY") || !strings.Contains(schema.execs[2], "dir,\n\t\t\tmirror\n") {
+		t.Errorf("Should replace view query, got %s", schema.execs[2])
+	}
+}
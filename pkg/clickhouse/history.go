@@ -0,0 +1,144 @@
+package clickhouse
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/inkuber/ipcad2ch/pkg/classifier"
+	"log"
+)
+
+func initHistory(db *sql.DB) error {
+	userMapQuery := `
+		CREATE TABLE IF NOT EXISTS user_map_history
+		(
+			version LowCardinality(String),
+			loaded DateTime,
+			ip UInt32,
+			user_id String,
+			source LowCardinality(String)
+		)
+		ENGINE = ReplacingMergeTree
+		PARTITION BY toYYYYMM(loaded)
+		ORDER BY (version, ip)
+		SETTINGS index_granularity = 8192
+	`
+
+	networkMapQuery := `
+		CREATE TABLE IF NOT EXISTS network_map_history
+		(
+			version LowCardinality(String),
+			loaded DateTime,
+			network String,
+			class Enum8('unknown' = 0, 'local' = 1, 'peering' = 2, 'internet' = 3, 'multicast' = 4, 'private' = 5, 'cgnat' = 6, 'linklocal' = 7, 'broadcast' = 8, 'reserved' = 9, 'bogon' = 10),
+			source LowCardinality(String)
+		)
+		ENGINE = ReplacingMergeTree
+		PARTITION BY toYYYYMM(loaded)
+		ORDER BY (version, network, class)
+		SETTINGS index_granularity = 8192
+	`
+
+	_, err := db.Exec(userMapQuery)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(networkMapQuery)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// saveHistory writes dictionaries snapshot once per version
+func saveHistory(db *sql.DB, s classifier.Snapshot) error {
+	err := initHistory(db)
+	if err != nil {
+		return err
+	}
+
+	var count uint64
+	err = db.QueryRow("SELECT count() FROM user_map_history WHERE version = ?", s.Version).Scan(&count)
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		err = db.QueryRow("SELECT count() FROM network_map_history WHERE version = ?", s.Version).Scan(&count)
+		if err != nil {
+			return err
+		}
+	}
+
+	if count > 0 {
+		log.Println(fmt.Sprintf("Dictionaries version %s is already in history", s.Version))
+		return nil
+	}
+
+	log.Println(fmt.Sprintf("Saving dictionaries version %s to history users:%d networks:%d", s.Version, len(s.Users), len(s.Networks)))
+
+	if len(s.Users) > 0 {
+		err = saveUserMap(db, s)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(s.Networks) > 0 {
+		err = saveNetworkMap(db, s)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func saveUserMap(db *sql.DB, s classifier.Snapshot) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare("INSERT INTO user_map_history (version, loaded, ip, user_id, source) VALUES (?, ?, ?, ?, ?)")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, u := range s.Users {
+		_, err := stmt.Exec(s.Version, s.Loaded, u.IP, u.UserID, u.Source)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func saveNetworkMap(db *sql.DB, s classifier.Snapshot) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare("INSERT INTO network_map_history (version, loaded, network, class, source) VALUES (?, ?, ?, ?, ?)")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, n := range s.Networks {
+		_, err := stmt.Exec(s.Version, s.Loaded, n.Network.String(), n.Class, n.Source)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
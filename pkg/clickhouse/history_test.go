@@ -0,0 +1,94 @@
+package clickhouse
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"github.com/inkuber/ipcad2ch/pkg/classifier"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestShouldSaveHistoryOfReloadedVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "users.json")
+	err = ioutil.WriteFile(file, []byte(`{"192.168.0.1": "1"}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := classifier.Config{}
+	cfg.Users.Fetch.File = file
+	cfg.Networks.Networks = map[string]string{"192.168.0.0/16": "local"}
+
+	c := classifier.NewClassifier(cfg)
+	first := c.Version
+
+	schema.columns = []string{"count"}
+	defer func() { schema.columns = []string{"table", "engine", "type"} }()
+	schema.rows = [][]driver.Value{{uint64(0)}}
+
+	db, err := sql.Open("ipcad2ch-schema", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	w := &writer{cfg: Config{History: true}, c: c}
+
+	inserts := func() []string {
+		found := make([]string, 0)
+		for _, query := range schema.execs {
+			if strings.HasPrefix(query, "INSERT INTO user_map_history") {
+				found = append(found, query)
+			}
+		}
+		schema.execs = nil
+		return found
+	}
+
+	schema.execs = nil
+	err = w.saveHistory(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(inserts()) != 1 {
+		t.Fatalf("Should save history on connect")
+	}
+
+	err = w.saveHistory(db, []Entry{{DictVersion: first}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(inserts()) != 0 {
+		t.Errorf("Should not save known version again")
+	}
+
+	err = ioutil.WriteFile(file, []byte(`{"192.168.0.1": "2"}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.Reload()
+	if err != nil || c.Version == first {
+		t.Fatalf("Should reload new version %v", err)
+	}
+
+	err = w.saveHistory(db, []Entry{{DictVersion: first}, {DictVersion: c.Version}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(inserts()) != 1 {
+		t.Errorf("Should save history of reloaded version")
+	}
+}
@@ -0,0 +1,197 @@
+package clickhouse
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"time"
+)
+
+var (
+	// STARTED load status, rows are being written
+	STARTED string = "started"
+
+	// DONE load status, all rows are written
+	DONE string = "done"
+
+	// SPOOLED load status, some rows are spooled and written by replay
+	SPOOLED string = "spooled"
+
+	// DUPLICATE load status, load was refused as already loaded
+	DUPLICATE string = "duplicate"
+)
+
+/*
+LoadsConfig of loads journal
+
+	LoadsConfig {
+	  Journal: Record loads to loads table and refuse already loaded input
+	}
+*/
+type LoadsConfig struct {
+	Journal bool `mapstructure:"journal"`
+}
+
+/*
+Load is one run over input, its ID is equal for equal source, collected time and content
+
+Stream is not hashed before it is read, its ID is equal for equal source and collected time,
+stream without collected time is never refused
+
+Should be instantiate with NewLoad method
+*/
+type Load struct {
+	ID        string
+	Source    string
+	Exporter  string
+	Collected time.Time
+	Hash      string
+	Started   time.Time
+
+	// Sum returns hash of stream read so far, Hash is set from it when load is finished,
+	// started load of stream is recorded with empty hash
+	Sum func() string
+
+	Rows  uint64
+	Bytes uint64
+}
+
+// NewLoad constructor method, collected is configured collected time, empty when not set,
+// hash is empty for stream
+func NewLoad(source string, exporter string, collected string, hash string) (*Load, error) {
+	l := &Load{
+		Source:   source,
+		Exporter: exporter,
+		Hash:     hash,
+		Started:  time.Now(),
+	}
+
+	l.Collected = l.Started
+	if collected != "" {
+		t, err := time.Parse(time.RFC3339, collected)
+		if err != nil {
+			return nil, err
+		}
+		l.Collected = t
+	}
+
+	key := hash
+	if hash == "" && collected == "" {
+		key = l.Started.Format(time.RFC3339Nano)
+	}
+
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\n%s\n%s", source, collected, key)))
+	l.ID = hex.EncodeToString(sum[:16])
+
+	return l, nil
+}
+
+func initLoads(db *sql.DB) error {
+	loadsQuery := `
+		CREATE TABLE IF NOT EXISTS loads
+		(
+			load_id String,
+			updated DateTime,
+			status Enum8('started' = 1, 'done' = 2, 'spooled' = 3, 'duplicate' = 4),
+			source String,
+			exporter LowCardinality(String),
+			collected DateTime,
+			content_hash String,
+			rows UInt64,
+			bytes UInt64,
+			duration Float64
+		)
+		ENGINE = MergeTree
+		PARTITION BY toYYYYMM(updated)
+		ORDER BY (load_id, updated)
+		SETTINGS index_granularity = 8192
+	`
+
+	_, err := db.Exec(loadsQuery)
+	return err
+}
+
+// CheckLoad checks load is already done or spooled, refused load is recorded as duplicate
+func CheckLoad(cfg Config, l *Load) (bool, error) {
+	db, err := connect(cfg)
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+
+	err = initLoads(db)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := db.Query("SELECT toString(status), updated FROM loads WHERE load_id = ? ORDER BY updated", l.ID)
+	if err != nil {
+		return false, err
+	}
+
+	loaded := false
+	started := false
+	for rows.Next() {
+		var status string
+		var updated time.Time
+
+		err := rows.Scan(&status, &updated)
+		if err != nil {
+			rows.Close()
+			return false, err
+		}
+
+		switch status {
+		case DONE, SPOOLED:
+			log.Println(fmt.Sprintf("Load %s is %s at %s", l.ID, status, updated.Format(time.RFC3339)))
+			loaded = true
+		case STARTED:
+			started = true
+		}
+	}
+	rows.Close()
+
+	if started && !loaded {
+		log.Println(fmt.Sprintf("Previous run of load %s is not finished, its rows could be duplicated, see details with load_id = '%s'", l.ID, l.ID))
+	}
+
+	if loaded {
+		err = saveLoad(db, l, DUPLICATE)
+		if err != nil {
+			return true, err
+		}
+	}
+
+	return loaded, nil
+}
+
+// saveLoad records load status with rows counted so far
+func saveLoad(db *sql.DB, l *Load, status string) error {
+	if l.Sum != nil && status != STARTED {
+		l.Hash = l.Sum()
+	}
+
+	log.Println(fmt.Sprintf("Load %s %s: %d rows, %d bytes", l.ID, status, l.Rows, l.Bytes))
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare("INSERT INTO loads (load_id, updated, status, source, exporter, collected, content_hash, rows, bytes, duration) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(l.ID, time.Now(), status, l.Source, l.Exporter, l.Collected, l.Hash, l.Rows, l.Bytes, time.Since(l.Started).Seconds())
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
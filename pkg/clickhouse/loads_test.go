@@ -0,0 +1,81 @@
+package clickhouse
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func TestShouldIdentifyLoad(t *testing.T) {
+	first, err := NewLoad("bras1:stdin", "bras1", "2020-11-19T10:00:00Z", "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, _ := NewLoad("bras1:stdin", "bras1", "2020-11-19T10:00:00Z", "abc")
+	if first.ID != second.ID || len(first.ID) != 32 {
+		t.Errorf("Should have equal id of equal load %s %s", first.ID, second.ID)
+	}
+
+	if first.Collected.Format("2006-01-02 15") != "2020-11-19 10" {
+		t.Errorf("Should parse collected time %v", first.Collected)
+	}
+
+	for _, other := range [][]string{
+		{"bras2:stdin", "2020-11-19T10:00:00Z", "abc"},
+		{"bras1:stdin", "2020-11-19T11:00:00Z", "abc"},
+		{"bras1:stdin", "2020-11-19T10:00:00Z", "abd"},
+	} {
+		l, _ := NewLoad(other[0], "", other[1], other[2])
+		if l.ID == first.ID {
+			t.Errorf("Should have other id of %v", other)
+		}
+	}
+
+	stream, _ := NewLoad("bras1:stdin", "bras1", "2020-11-19T10:00:00Z", "")
+	other, _ := NewLoad("bras1:stdin", "bras1", "2020-11-19T10:00:00Z", "")
+	if stream.ID != other.ID || stream.ID == first.ID {
+		t.Errorf("Should identify stream by collected time %s %s", stream.ID, other.ID)
+	}
+
+	stream, _ = NewLoad("bras1:stdin", "bras1", "", "")
+	time.Sleep(time.Millisecond)
+	other, _ = NewLoad("bras1:stdin", "bras1", "", "")
+	if stream.ID == other.ID {
+		t.Errorf("Should have unique id of stream without collected time %s", stream.ID)
+	}
+
+	_, err = NewLoad("bras1:stdin", "bras1", "yesterday", "abc")
+	if err == nil {
+		t.Errorf("Should reject invalid collected time")
+	}
+}
+
+func TestShouldHashStreamWhenLoadIsFinished(t *testing.T) {
+	l, err := NewLoad("bras1:stdin", "bras1", "2020-11-19T10:00:00Z", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sums := 0
+	l.Sum = func() string {
+		sums = sums + 1
+		return "abc"
+	}
+
+	db, err := sql.Open("ipcad2ch-schema", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	err = saveLoad(db, l, STARTED)
+	if err != nil || sums != 0 || l.Hash != "" {
+		t.Errorf("Should record started stream with empty hash %s %v", l.Hash, err)
+	}
+
+	err = saveLoad(db, l, DONE)
+	if err != nil || sums != 1 || l.Hash != "abc" {
+		t.Errorf("Should record hash of done stream %s %v", l.Hash, err)
+	}
+}
@@ -0,0 +1,282 @@
+package clickhouse
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"github.com/inkuber/ipcad2ch/pkg/metrics"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// TRUNCATE privacy mode, remote address is masked by prefix
+	TRUNCATE string = "truncate"
+
+	// HASH privacy mode, remote address is replaced by keyed hash
+	HASH string = "hash"
+)
+
+/*
+PrivacyConfig of details anonymization, aggregated views are filled from raw entries
+
+	PrivacyConfig {
+	  Mode: Remote address anonymization: truncate, hash or empty
+	  Key: Secret key of hash mode
+	  Prefix: Prefix length of truncate mode, default 24
+	  HideUserIP: Replace address of known user by 0, user_id is kept
+	  Retention: Raw details are kept for retention and rewritten after,
+	    zero anonymizes on insert
+	  Settle: Partition is rewritten when it was not written for settle period,
+	    it should be longer than delay of spool replay and archive loads
+	}
+*/
+type PrivacyConfig struct {
+	Mode       string        `mapstructure:"mode"`
+	Key        string        `mapstructure:"key" json:"-"`
+	Prefix     int           `mapstructure:"prefix"`
+	HideUserIP bool          `mapstructure:"hideUserIP"`
+	Retention  time.Duration `mapstructure:"retention"`
+	Settle     time.Duration `mapstructure:"settle"`
+}
+
+// Enabled checks any anonymization is configured
+func (p PrivacyConfig) Enabled() bool {
+	return p.Mode != "" || p.HideUserIP
+}
+
+func (p PrivacyConfig) validate() error {
+	switch p.Mode {
+	case TRUNCATE:
+		if p.Prefix < 0 || p.Prefix > 32 {
+			return fmt.Errorf("privacy prefix %d is out of 0-32", p.Prefix)
+		}
+	case HASH:
+		if p.Key == "" {
+			return fmt.Errorf("privacy key is not set for hash mode")
+		}
+	case "":
+	default:
+		return fmt.Errorf("unknown privacy mode %s", p.Mode)
+	}
+
+	return nil
+}
+
+func (p PrivacyConfig) mask() uint32 {
+	if p.Prefix <= 0 {
+		return 0
+	}
+
+	return ^uint32(0) << uint(32-p.Prefix)
+}
+
+// remote anonymizes remote address, hash is equal to SQL expression of rewrite
+func (p PrivacyConfig) remote(ip uint32) uint32 {
+	switch p.Mode {
+	case TRUNCATE:
+		return ip & p.mask()
+	case HASH:
+		sum := sha256.Sum256([]byte(p.Key + strconv.FormatUint(uint64(ip), 10)))
+		return binary.LittleEndian.Uint32(sum[:4])
+	}
+
+	return ip
+}
+
+func (p PrivacyConfig) local(ip uint32, userID string) uint32 {
+	if p.HideUserIP && userID != "" {
+		return 0
+	}
+
+	return ip
+}
+
+// anonymize returns stored source and destination, both sides are remote when direction is unknown
+func (p PrivacyConfig) anonymize(dir string, userID string, srcIP uint32, dstIP uint32) (uint32, uint32) {
+	switch dir {
+	case "out":
+		return p.local(srcIP, userID), p.remote(dstIP)
+	case "in":
+		return p.remote(srcIP), p.local(dstIP, userID)
+	}
+
+	return p.remote(srcIP), p.remote(dstIP)
+}
+
+// remoteExpr is SQL form of remote method
+func (p PrivacyConfig) remoteExpr(column string) string {
+	switch p.Mode {
+	case TRUNCATE:
+		return fmt.Sprintf("bitAnd(%s, toUInt32(%d))", column, p.mask())
+	case HASH:
+		key := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(p.Key)
+		return fmt.Sprintf("reinterpretAsUInt32(substring(SHA256(concat('%s', toString(%s))), 1, 4))", key, column)
+	}
+
+	return column
+}
+
+// localExpr is SQL form of local method
+func (p PrivacyConfig) localExpr(column string) string {
+	if p.HideUserIP {
+		return fmt.Sprintf("if(user_id != '', toUInt32(0), %s)", column)
+	}
+
+	return column
+}
+
+// columnExpr returns rewrite expression of details column, anonymized rows are kept as is
+func (p PrivacyConfig) columnExpr(column string) string {
+	switch column {
+	case "src_ip":
+		return fmt.Sprintf("if(anonymized = 1, src_ip, if(dir = 'out', %s, %s))", p.localExpr(column), p.remoteExpr(column))
+	case "dst_ip":
+		return fmt.Sprintf("if(anonymized = 1, dst_ip, if(dir = 'in', %s, %s))", p.localExpr(column), p.remoteExpr(column))
+	case "anonymized":
+		return "toUInt8(1)"
+	}
+
+	return fmt.Sprintf("`%s`", column)
+}
+
+/*
+anonymizePartitions rewrites details partitions older than retention with raw rows
+
+Partition is copied anonymized to details_anonymize table and replaced from it,
+materialized views are not triggered, so aggregates keep full fidelity.
+
+Rows inserted to partition between copy and replace would be lost, so partitions
+written during settle period are skipped and partition written during copy is
+left for the next run
+*/
+func anonymizePartitions(db *sql.DB, p PrivacyConfig) error {
+	log.Println(fmt.Sprintf("Anonymizing details partitions older than %s not written for %s", p.Retention, p.Settle))
+
+	rows, err := db.Query(`
+		SELECT partition_id
+		FROM system.parts
+		WHERE database = currentDatabase() AND table = 'details' AND active
+		GROUP BY partition_id
+		HAVING max(max_time) < subtractSeconds(now(), ?) AND max(modification_time) < subtractSeconds(now(), ?)
+		ORDER BY partition_id
+	`, int64(p.Retention.Seconds()), int64(p.Settle.Seconds()))
+	if err != nil {
+		return err
+	}
+
+	partitions := make([]string, 0)
+	for rows.Next() {
+		var partition string
+		err := rows.Scan(&partition)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		partitions = append(partitions, partition)
+	}
+	rows.Close()
+
+	columns, err := detailsColumnNames(db)
+	if err != nil {
+		return err
+	}
+
+	exprs := make([]string, 0, len(columns))
+	for _, column := range columns {
+		exprs = append(exprs, p.columnExpr(column))
+	}
+
+	for _, partition := range partitions {
+		var raw uint64
+		err := db.QueryRow("SELECT count() FROM details WHERE toString(toYYYYMMDD(collected)) = ? AND anonymized = 0", partition).Scan(&raw)
+		if err != nil {
+			return err
+		}
+
+		if raw == 0 {
+			continue
+		}
+
+		log.Println(fmt.Sprintf("Anonymizing %d rows of details partition %s", raw, partition))
+
+		queries := []string{
+			"DROP TABLE IF EXISTS details_anonymize",
+			"CREATE TABLE details_anonymize AS details",
+			fmt.Sprintf("INSERT INTO details_anonymize SELECT %s FROM details WHERE toString(toYYYYMMDD(collected)) = '%s'", strings.Join(exprs, ", "), partition),
+		}
+
+		for _, query := range queries {
+			_, err = db.Exec(query)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Copy is compared with partition right before replace
+		var copied, total uint64
+		err = db.QueryRow("SELECT count() FROM details_anonymize").Scan(&copied)
+		if err != nil {
+			return err
+		}
+
+		err = db.QueryRow("SELECT count() FROM details WHERE toString(toYYYYMMDD(collected)) = ?", partition).Scan(&total)
+		if err != nil {
+			return err
+		}
+
+		queries = []string{
+			fmt.Sprintf("ALTER TABLE details REPLACE PARTITION ID '%s' FROM details_anonymize", partition),
+			"DROP TABLE details_anonymize",
+		}
+
+		if copied != total {
+			log.Println(fmt.Sprintf("Details partition %s was written while anonymized, it is left for next run", partition))
+			queries = queries[1:]
+		}
+
+		for _, query := range queries {
+			_, err = db.Exec(query)
+			if err != nil {
+				return err
+			}
+		}
+
+		if copied != total {
+			continue
+		}
+
+		metrics.Add("ipcad2ch_anonymized_partitions_total", 1)
+		metrics.Add("ipcad2ch_anonymized_rows_total", float64(raw))
+	}
+
+	return nil
+}
+
+func detailsColumnNames(db *sql.DB) ([]string, error) {
+	rows, err := db.Query(`
+		SELECT name
+		FROM system.columns
+		WHERE database = currentDatabase() AND table = 'details'
+		ORDER BY position
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := make([]string, 0)
+	for rows.Next() {
+		var column string
+		err := rows.Scan(&column)
+		if err != nil {
+			return nil, err
+		}
+		columns = append(columns, column)
+	}
+
+	return columns, rows.Err()
+}
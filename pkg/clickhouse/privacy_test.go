@@ -0,0 +1,120 @@
+package clickhouse
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShouldAnonymizeRemoteAddress(t *testing.T) {
+	p := PrivacyConfig{Mode: TRUNCATE, Prefix: 24}
+
+	src, dst := p.anonymize("out", "1", 0xC0A80105, 0x08080808)
+	if src != 0xC0A80105 || dst != 0x08080800 {
+		t.Errorf("Should truncate remote destination %x %x", src, dst)
+	}
+
+	src, dst = p.anonymize("unknown", "", 0x0A000001, 0x08080808)
+	if src != 0x0A000000 || dst != 0x08080800 {
+		t.Errorf("Should truncate both sides of unknown direction %x %x", src, dst)
+	}
+
+	p = PrivacyConfig{Mode: HASH, Key: "secret", HideUserIP: true}
+
+	src, dst = p.anonymize("in", "1", 0x08080808, 0xC0A80105)
+	if dst != 0 || src == 0x08080808 || src != p.remote(0x08080808) {
+		t.Errorf("Should hash remote source and hide user address %x %x", src, dst)
+	}
+
+	other := PrivacyConfig{Mode: HASH, Key: "other"}
+	if other.remote(0x08080808) == src {
+		t.Errorf("Should hash by key")
+	}
+
+	_, dst = p.anonymize("in", "", 0x08080808, 0xC0A80105)
+	if dst != 0xC0A80105 {
+		t.Errorf("Should keep address without user %x", dst)
+	}
+}
+
+func TestShouldValidatePrivacy(t *testing.T) {
+	if (PrivacyConfig{Mode: HASH}).validate() == nil {
+		t.Errorf("Should require key of hash mode")
+	}
+
+	if (PrivacyConfig{Mode: "drop"}).validate() == nil {
+		t.Errorf("Should reject unknown mode")
+	}
+
+	if (PrivacyConfig{Mode: TRUNCATE, Prefix: 16}).validate() != nil {
+		t.Errorf("Should accept truncate mode")
+	}
+}
+
+func TestShouldBuildRewriteExpressions(t *testing.T) {
+	p := PrivacyConfig{Mode: HASH, Key: "it's", HideUserIP: true}
+
+	expr := p.columnExpr("src_ip")
+	if !strings.HasPrefix(expr, "if(anonymized = 1, src_ip, if(dir = 'out', if(user_id != ''") || !strings.Contains(expr, `concat('it\'s', toString(src_ip))`) {
+		t.Errorf("Should build src_ip expression %s", expr)
+	}
+
+	p = PrivacyConfig{Mode: TRUNCATE, Prefix: 24}
+	if p.columnExpr("dst_ip") != "if(anonymized = 1, dst_ip, if(dir = 'in', dst_ip, bitAnd(dst_ip, toUInt32(4294967040))))" {
+		t.Errorf("Should build dst_ip expression %s", p.columnExpr("dst_ip"))
+	}
+
+	if p.columnExpr("anonymized") != "toUInt8(1)" || p.columnExpr("user_tariff") != "`user_tariff`" {
+		t.Errorf("Should keep other columns")
+	}
+}
+
+func TestShouldLeavePartitionWrittenWhileAnonymized(t *testing.T) {
+	schema.columns = []string{"value"}
+	defer func() {
+		schema.columns = []string{"table", "engine", "type"}
+		schema.results = nil
+	}()
+
+	// Partition 20201119 keeps 10 rows, one row is inserted to 20201120 while it is copied
+	totals := []uint64{10, 11}
+	schema.results = func(query string) [][]driver.Value {
+		switch {
+		case strings.Contains(query, "system.parts"):
+			return [][]driver.Value{{"20201119"}, {"20201120"}}
+		case strings.Contains(query, "system.columns"):
+			return [][]driver.Value{{"src_ip"}, {"dst_ip"}, {"anonymized"}}
+		case strings.Contains(query, "anonymized = 0"), strings.Contains(query, "FROM details_anonymize"):
+			return [][]driver.Value{{uint64(10)}}
+		}
+
+		total := totals[0]
+		totals = totals[1:]
+		return [][]driver.Value{{total}}
+	}
+	schema.execs = nil
+
+	db, err := sql.Open("ipcad2ch-schema", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	err = anonymizePartitions(db, PrivacyConfig{Mode: TRUNCATE, Prefix: 24, Retention: time.Hour, Settle: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replaced := make([]string, 0)
+	for _, query := range schema.execs {
+		if strings.HasPrefix(query, "ALTER TABLE details REPLACE PARTITION") {
+			replaced = append(replaced, query)
+		}
+	}
+
+	if len(replaced) != 1 || !strings.Contains(replaced[0], "'20201119'") {
+		t.Errorf("Should replace unchanged partition only, got %v", replaced)
+	}
+}
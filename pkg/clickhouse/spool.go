@@ -0,0 +1,254 @@
+package clickhouse
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"github.com/inkuber/ipcad2ch/pkg/metrics"
+	"github.com/inkuber/ipcad2ch/pkg/rating"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/*
+SpoolConfig of batches which could not be written to clickhouse
+
+	SpoolConfig {
+	  Dir: Spool directory, empty disables spool and failed write stops the run
+	  MaxSize: Spool size limit in megabytes, batches over limit are dropped, 0 is unlimited
+	  Retries: Number of retries after failed write, default 3
+	  Backoff: Delay before first retry, doubled for every next retry, default 1s
+	}
+*/
+type SpoolConfig struct {
+	Dir     string        `mapstructure:"dir"`
+	MaxSize int64         `mapstructure:"maxSize"`
+	Retries int           `mapstructure:"retries"`
+	Backoff time.Duration `mapstructure:"backoff"`
+}
+
+/*
+Batch is unit of clickhouse write, it is spooled with progress of write
+
+	Batch {
+	  LoadID: Load of entries
+	  Entries: Details entries, cleared when saved
+	  Rated: Number of rated entries, entries are rated once
+	  Charges: Charges of rated entries, cleared when saved
+	}
+*/
+type Batch struct {
+	LoadID  string
+	Entries []Entry
+	Rated   int
+	Charges []rating.Charge
+}
+
+// ErrSpoolFull is returned by Push when batch doesn't fit spool size limit
+var ErrSpoolFull = fmt.Errorf("spool size limit exceeded")
+
+const spoolExt = ".batch"
+
+/*
+Spool stores batches in files of directory, files are named by push time and replayed in order
+
+Should be instantiate with NewSpool method
+*/
+type Spool struct {
+	Config SpoolConfig
+
+	seq uint64
+}
+
+// NewSpool constructor method, spool directory is created
+func NewSpool(cfg SpoolConfig) *Spool {
+	s := &Spool{Config: cfg}
+
+	if s.Enabled() {
+		err := os.MkdirAll(cfg.Dir, 0700)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	return s
+}
+
+// Enabled checks spool directory is configured
+func (s *Spool) Enabled() bool {
+	return s.Config.Dir != ""
+}
+
+// Files returns spooled batch names in push order
+func (s *Spool) Files() ([]string, error) {
+	if !s.Enabled() {
+		return nil, nil
+	}
+
+	infos, err := ioutil.ReadDir(s.Config.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0)
+	for _, info := range infos {
+		if !info.IsDir() && strings.HasSuffix(info.Name(), spoolExt) {
+			names = append(names, info.Name())
+		}
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// Stats returns number and size in bytes of spooled batches
+func (s *Spool) Stats() (int, int64, error) {
+	names, err := s.Files()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var size int64
+	for _, name := range names {
+		info, err := os.Stat(filepath.Join(s.Config.Dir, name))
+		if err != nil {
+			return 0, 0, err
+		}
+		size = size + info.Size()
+	}
+
+	return len(names), size, nil
+}
+
+// Push stores batch to new file after all spooled ones
+func (s *Spool) Push(b *Batch) error {
+	data, err := encodeBatch(b)
+	if err != nil {
+		return err
+	}
+
+	if s.Config.MaxSize > 0 {
+		_, size, err := s.Stats()
+		if err != nil {
+			return err
+		}
+
+		if size+int64(len(data)) > s.Config.MaxSize*1024*1024 {
+			return ErrSpoolFull
+		}
+	}
+
+	seq := atomic.AddUint64(&s.seq, 1)
+	name := fmt.Sprintf("%020d-%06d%s", time.Now().UnixNano(), seq%1000000, spoolExt)
+
+	err = s.write(name, data)
+	if err != nil {
+		return err
+	}
+
+	log.Println(fmt.Sprintf("Spooled batch %s of %d entries and %d charges", name, len(b.Entries), len(b.Charges)))
+
+	return nil
+}
+
+// Save replaces spooled batch with its rest after partial write
+func (s *Spool) Save(name string, b *Batch) error {
+	data, err := encodeBatch(b)
+	if err != nil {
+		return err
+	}
+
+	return s.write(name, data)
+}
+
+// write stores file atomically: temporary file is synced and renamed
+func (s *Spool) write(name string, data []byte) error {
+	path := filepath.Join(s.Config.Dir, name)
+
+	f, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// Load reads spooled batch
+func (s *Spool) Load(name string) (*Batch, error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.Config.Dir, name))
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Batch{}
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(b)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode spooled batch %s: %v", name, err)
+	}
+
+	return b, nil
+}
+
+// Remove deletes written batch
+func (s *Spool) Remove(name string) error {
+	return os.Remove(filepath.Join(s.Config.Dir, name))
+}
+
+// Reject moves batch which could not be read aside, it is not replayed anymore
+func (s *Spool) Reject(name string) error {
+	path := filepath.Join(s.Config.Dir, name)
+	return os.Rename(path, path+".bad")
+}
+
+// Report writes backlog metrics
+func (s *Spool) Report() {
+	if !s.Enabled() {
+		return
+	}
+
+	count, size, err := s.Stats()
+	if err != nil {
+		log.Println(fmt.Sprintf("Could not read spool %s: %v", s.Config.Dir, err))
+		return
+	}
+
+	if count > 0 {
+		log.Println(fmt.Sprintf("Spool backlog: %d batches, %d bytes", count, size))
+	}
+
+	metrics.Set("ipcad2ch_spool_batches", float64(count))
+	metrics.Set("ipcad2ch_spool_bytes", float64(size))
+}
+
+func encodeBatch(b *Batch) ([]byte, error) {
+	var buf bytes.Buffer
+
+	err := gob.NewEncoder(&buf).Encode(b)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
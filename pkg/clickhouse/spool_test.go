@@ -0,0 +1,123 @@
+package clickhouse
+
+import (
+	"github.com/inkuber/ipcad2ch/pkg/rating"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestShouldSpoolBatchesInOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewSpool(SpoolConfig{Dir: dir})
+
+	first := &Batch{Entries: []Entry{{SrcIP: net.ParseIP("10.0.0.1"), DstIP: net.ParseIP("8.8.8.8"), Bytes: 100, UserAttributes: map[string]string{"tariff": "basic"}}}, Rated: 1}
+	second := &Batch{Charges: []rating.Charge{{Tariff: "basic", Bytes: 100, Cost: 1.5}}}
+
+	for _, b := range []*Batch{first, second} {
+		err := s.Push(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	names, err := s.Files()
+	if err != nil || len(names) != 2 {
+		t.Fatalf("Should list 2 spooled batches %v %v", names, err)
+	}
+
+	b, err := s.Load(names[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(b.Entries) != 1 || b.Rated != 1 || !b.Entries[0].DstIP.Equal(net.ParseIP("8.8.8.8")) || b.Entries[0].UserAttributes["tariff"] != "basic" {
+		t.Errorf("Should load first batch %v", b)
+	}
+
+	b, err = s.Load(names[1])
+	if err != nil || len(b.Charges) != 1 || b.Charges[0].Cost != 1.5 {
+		t.Errorf("Should load second batch %v %v", b, err)
+	}
+
+	err = s.Remove(names[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "00000000000000000000-000000.batch"), []byte("broken"), 0600)
+
+	names, _ = s.Files()
+	if len(names) != 2 {
+		t.Fatalf("Should list 2 spooled batches %v", names)
+	}
+
+	_, err = s.Load(names[0])
+	if err == nil {
+		t.Errorf("Should not load broken batch")
+	}
+
+	s.Reject(names[0])
+
+	count, size, err := s.Stats()
+	if err != nil || count != 1 || size == 0 {
+		t.Errorf("Should count spooled batches %d %d %v", count, size, err)
+	}
+}
+
+func TestShouldLimitSpoolSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewSpool(SpoolConfig{Dir: dir, MaxSize: 1})
+
+	entries := make([]Entry, 20000)
+	for i := range entries {
+		entries[i] = Entry{SrcIP: net.ParseIP("10.0.0.1"), DstIP: net.ParseIP("8.8.8.8"), Iface: "ng12", Exporter: "bras1", Collected: time.Now(), Bytes: uint64(i)}
+	}
+
+	err = s.Push(&Batch{Entries: entries})
+	if err != ErrSpoolFull {
+		t.Errorf("Should reject batch over limit, got %v", err)
+	}
+}
+
+func TestShouldSpoolWhenClickhouseIsUnavailable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w := &writer{
+		cfg:   Config{Host: "127.0.0.1", Port: 1, Spool: SpoolConfig{Dir: dir}},
+		r:     rating.NewRater(rating.Config{}),
+		spool: NewSpool(SpoolConfig{Dir: dir}),
+	}
+
+	w.write(&Batch{Entries: []Entry{{SrcIP: net.ParseIP("10.0.0.1"), DstIP: net.ParseIP("8.8.8.8")}}})
+	w.write(&Batch{Entries: []Entry{{SrcIP: net.ParseIP("10.0.0.2"), DstIP: net.ParseIP("8.8.8.8")}}})
+
+	names, _ := w.spool.Files()
+	if len(names) != 2 {
+		t.Fatalf("Should spool 2 batches, got %v", names)
+	}
+
+	w.replay()
+
+	b, err := w.spool.Load(names[0])
+	if err != nil || !b.Entries[0].SrcIP.Equal(net.ParseIP("10.0.0.1")) || b.Rated != 0 {
+		t.Errorf("Should keep spooled batches in order %v %v", b, err)
+	}
+}
@@ -0,0 +1,224 @@
+package clickhouse
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"time"
+)
+
+var (
+	// NONETWORK reason, no endpoint in local networks
+	NONETWORK string = "no_network"
+
+	// NOUSER reason, no user found for local endpoint
+	NOUSER string = "no_user"
+)
+
+type unclassifiedKey struct {
+	Collected time.Time
+	Reason    string
+	Side      string
+	Prefix    string
+	Exporter  string
+	Iface     string
+}
+
+type unclassifiedStat struct {
+	Flows   uint64
+	Packets uint64
+	Bytes   uint64
+}
+
+/*
+Unclassified aggregates flows without direction or user by /24 (/64 for IPv6)
+of unmatched endpoint, exporter and interface
+
+Flow without direction is aggregated under both sides, totals count it once.
+
+Should be instantiate with NewUnclassified method
+*/
+type Unclassified struct {
+	stats   map[unclassifiedKey]*unclassifiedStat
+	total   map[string]*unclassifiedStat
+	reasons map[string]*unclassifiedStat
+}
+
+// NewUnclassified constructor method
+func NewUnclassified() *Unclassified {
+	return &Unclassified{
+		stats:   make(map[unclassifiedKey]*unclassifiedStat),
+		total:   make(map[string]*unclassifiedStat),
+		reasons: make(map[string]*unclassifiedStat),
+	}
+}
+
+// Add counts entry if it is not classified, mirrored rows repeat counted flow
+func (u *Unclassified) Add(e Entry) {
+	if e.Mirror {
+		return
+	}
+
+	if e.Dir == "unknown" {
+		src := u.add(e, NONETWORK, "src", e.SrcIP)
+		dst := u.add(e, NONETWORK, "dst", e.DstIP)
+
+		count(u.total, src+" "+NONETWORK, e)
+		if dst != src {
+			count(u.total, dst+" "+NONETWORK, e)
+		}
+		count(u.reasons, NONETWORK, e)
+		return
+	}
+
+	if e.UserID == "" {
+		ip := e.DstIP
+		side := "dst"
+		if e.Dir == "out" {
+			ip = e.SrcIP
+			side = "src"
+		}
+
+		count(u.total, u.add(e, NOUSER, side, ip)+" "+NOUSER, e)
+		count(u.reasons, NOUSER, e)
+	}
+}
+
+// add counts entry in prefix row of side, prefix is returned
+func (u *Unclassified) add(e Entry, reason string, side string, ip net.IP) string {
+	key := unclassifiedKey{
+		Collected: e.Collected,
+		Reason:    reason,
+		Side:      side,
+		Prefix:    prefix(ip),
+		Exporter:  e.Exporter,
+		Iface:     e.Iface,
+	}
+
+	stat, ok := u.stats[key]
+	if !ok {
+		stat = &unclassifiedStat{}
+		u.stats[key] = stat
+	}
+
+	stat.Flows = stat.Flows + 1
+	stat.Packets = stat.Packets + e.Packets
+	stat.Bytes = stat.Bytes + e.Bytes
+
+	return key.Prefix
+}
+
+func count(totals map[string]*unclassifiedStat, key string, e Entry) {
+	total, ok := totals[key]
+	if !ok {
+		total = &unclassifiedStat{}
+		totals[key] = total
+	}
+
+	total.Flows = total.Flows + 1
+	total.Packets = total.Packets + e.Packets
+	total.Bytes = total.Bytes + e.Bytes
+}
+
+// Len returns number of aggregated rows
+func (u *Unclassified) Len() int {
+	return len(u.stats)
+}
+
+// Save writes aggregated rows to unclassified table and resets them
+func (u *Unclassified) Save(db *sql.DB) error {
+	if len(u.stats) == 0 {
+		return nil
+	}
+
+	log.Println(fmt.Sprintf("Saving %d unclassified prefixes to clickhouse", len(u.stats)))
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO unclassified (
+			collected,
+			reason,
+			side,
+			prefix,
+			exporter,
+			iface,
+			flows,
+			packets,
+			bytes
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for key, stat := range u.stats {
+		_, err := stmt.Exec(
+			key.Collected,
+			key.Reason,
+			key.Side,
+			key.Prefix,
+			key.Exporter,
+			key.Iface,
+			stat.Flows,
+			stat.Packets,
+			stat.Bytes,
+		)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	u.stats = make(map[unclassifiedKey]*unclassifiedStat)
+
+	return nil
+}
+
+// Report logs top prefixes of unclassified traffic by bytes
+func (u *Unclassified) Report(top int) {
+	keys := make([]string, 0, len(u.total))
+	for key := range u.total {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return u.total[keys[i]].Bytes > u.total[keys[j]].Bytes
+	})
+
+	if len(keys) > top {
+		keys = keys[:top]
+	}
+
+	for _, reason := range []string{NONETWORK, NOUSER} {
+		if stat, ok := u.reasons[reason]; ok {
+			log.Println(fmt.Sprintf("Unclassified %s flows:%d bytes:%d", reason, stat.Flows, stat.Bytes))
+		}
+	}
+
+	log.Println(fmt.Sprintf("Top %d unclassified prefixes:", len(keys)))
+	for _, key := range keys {
+		stat := u.total[key]
+		log.Println(fmt.Sprintf("  %s flows:%d bytes:%d", key, stat.Flows, stat.Bytes))
+	}
+}
+
+func prefix(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%s/24", ip4.Mask(net.CIDRMask(24, 32)))
+	}
+
+	return fmt.Sprintf("%s/64", ip.Mask(net.CIDRMask(64, 128)))
+}
@@ -0,0 +1,54 @@
+package clickhouse
+
+import (
+	"net"
+	"testing"
+)
+
+func TestShouldAggregateUnclassified(t *testing.T) {
+	u := NewUnclassified()
+
+	u.Add(Entry{SrcIP: net.ParseIP("10.0.0.1"), DstIP: net.ParseIP("8.8.8.8"), Bytes: 100, Dir: "unknown", Iface: "em0"})
+	u.Add(Entry{SrcIP: net.ParseIP("10.0.0.2"), DstIP: net.ParseIP("8.8.4.4"), Bytes: 50, Dir: "unknown", Iface: "em0"})
+	u.Add(Entry{SrcIP: net.ParseIP("8.8.8.8"), DstIP: net.ParseIP("192.168.1.5"), Bytes: 10, Dir: "in"})
+	u.Add(Entry{SrcIP: net.ParseIP("192.168.1.5"), DstIP: net.ParseIP("8.8.8.8"), Bytes: 10, Dir: "out", UserID: "1"})
+
+	if u.Len() != 4 {
+		t.Errorf("Should aggregate 4 rows, got %d", u.Len())
+	}
+
+	stat := u.stats[unclassifiedKey{Reason: NONETWORK, Side: "src", Prefix: "10.0.0.0/24", Iface: "em0"}]
+	if stat == nil || stat.Flows != 2 || stat.Bytes != 150 {
+		t.Errorf("Should aggregate by prefix %v", stat)
+	}
+
+	stat = u.stats[unclassifiedKey{Reason: NOUSER, Side: "dst", Prefix: "192.168.1.0/24"}]
+	if stat == nil || stat.Bytes != 10 {
+		t.Errorf("Should aggregate flows without user %v", stat)
+	}
+
+	total := u.reasons[NONETWORK]
+	if total == nil || total.Flows != 2 || total.Bytes != 150 {
+		t.Errorf("Should count flow without direction once in totals %v", total)
+	}
+
+	total = u.total["10.0.0.0/24 "+NONETWORK]
+	if total == nil || total.Flows != 2 || total.Bytes != 150 {
+		t.Errorf("Should count prefix totals %v", total)
+	}
+
+	u.Add(Entry{SrcIP: net.ParseIP("10.0.1.1"), DstIP: net.ParseIP("10.0.1.2"), Bytes: 30, Dir: "unknown"})
+	total = u.total["10.0.1.0/24 "+NONETWORK]
+	if total == nil || total.Flows != 1 || total.Bytes != 30 {
+		t.Errorf("Should count flow within one prefix once %v", total)
+	}
+
+	u.Add(Entry{SrcIP: net.ParseIP("192.168.1.6"), DstIP: net.ParseIP("192.168.1.5"), Bytes: 20, Dir: "out", Mirror: true})
+	if u.reasons[NOUSER].Flows != 1 {
+		t.Errorf("Should skip mirrored flows %v", u.reasons[NOUSER])
+	}
+
+	if prefix(net.ParseIP("2001:db8::1")) != "2001:db8::/64" {
+		t.Errorf("Should aggregate IPv6 by /64")
+	}
+}
@@ -0,0 +1,147 @@
+package filter
+
+import (
+	"fmt"
+	"github.com/inkuber/ipcad2ch/pkg/classifier"
+	"log"
+	"path"
+)
+
+/*
+Config describes filters of one source, the first config matching exporter is used
+
+	Config {
+	  Exporter: Exporter name pattern, empty matches any source
+	  Pre: Filter of parsed entries checked before classification
+	  Post: Filter of classified entries
+	}
+
+Entries are kept when filter matches, empty filter keeps all entries. Filter is
+expression of conditions joined with and, or, not and parentheses:
+
+	[src|dst] host IP, [src|dst] net CIDR, [src|dst] port N
+	iface, exporter, class, dir, user, service, country, org: pattern, e.g. "ng*"
+	bytes, packets, proto, asn: number, proto could be tcp, udp, icmp, gre, esp
+
+Condition operator is optional, default is ==, strings and addresses are compared
+with == and !=, numbers with == != > >= < <=, e.g.
+
+	not iface lo0 and not (proto udp and dst port 53) and bytes > 0
+*/
+type Config struct {
+	Exporter string `mapstructure:"exporter"`
+	Pre      string `mapstructure:"pre"`
+	Post     string `mapstructure:"post"`
+}
+
+// Filter is compiled filter expression
+type Filter struct {
+	Expr string
+	root node
+}
+
+// Parse compiles filter expression, empty expression matches any entry
+func Parse(expr string) (*Filter, error) {
+	f := &Filter{Expr: expr}
+	if expr == "" {
+		return f, nil
+	}
+
+	root, err := parse(expr)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse filter %q: %v", expr, err)
+	}
+
+	f.root = root
+
+	return f, nil
+}
+
+// Match checks entry is kept by filter
+func (f *Filter) Match(e *classifier.Entry) bool {
+	if f == nil || f.root == nil {
+		return true
+	}
+
+	return f.root.Match(e)
+}
+
+type source struct {
+	Exporter string
+	Pre      *Filter
+	Post     *Filter
+}
+
+/*
+Set is compiled filters of all sources
+
+Should be instantiate with NewSet method
+*/
+type Set struct {
+	sources []source
+}
+
+// NewSet compiles filters of sources
+func NewSet(cfgs []Config) *Set {
+	s := &Set{}
+
+	for _, cfg := range cfgs {
+		if _, err := path.Match(cfg.Exporter, ""); err != nil {
+			log.Fatal(fmt.Sprintf("Could not parse exporter pattern %s %v", cfg.Exporter, err))
+		}
+
+		pre, err := Parse(cfg.Pre)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		post, err := Parse(cfg.Post)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		s.sources = append(s.sources, source{Exporter: cfg.Exporter, Pre: pre, Post: post})
+	}
+
+	if len(s.sources) > 0 {
+		log.Println(fmt.Sprintf("Compiled filters of %d sources", len(s.sources)))
+	}
+
+	return s
+}
+
+func (s *Set) lookup(exporter string) *source {
+	if s == nil {
+		return nil
+	}
+
+	for i, src := range s.sources {
+		if src.Exporter == "" {
+			return &s.sources[i]
+		}
+
+		if ok, _ := path.Match(src.Exporter, exporter); ok {
+			return &s.sources[i]
+		}
+	}
+
+	return nil
+}
+
+// Pre checks parsed entry is kept for classification
+func (s *Set) Pre(e *classifier.Entry) bool {
+	if src := s.lookup(e.Exporter); src != nil {
+		return src.Pre.Match(e)
+	}
+
+	return true
+}
+
+// Post checks classified entry is kept for writing
+func (s *Set) Post(e *classifier.Entry) bool {
+	if src := s.lookup(e.Exporter); src != nil {
+		return src.Post.Match(e)
+	}
+
+	return true
+}
@@ -0,0 +1,87 @@
+package filter
+
+import (
+	"github.com/inkuber/ipcad2ch/pkg/classifier"
+	"net"
+	"testing"
+)
+
+func TestShouldMatchFilter(t *testing.T) {
+	dns := &classifier.Entry{
+		SrcIP: net.ParseIP("192.168.0.1"), DstIP: net.ParseIP("8.8.8.8"),
+		SrcPort: 50000, DstPort: 53, Proto: 17, Bytes: 100, Iface: "ng12",
+	}
+	loopback := &classifier.Entry{
+		SrcIP: net.ParseIP("127.0.0.1"), DstIP: net.ParseIP("127.0.0.1"),
+		SrcPort: 80, DstPort: 40000, Proto: 6, Bytes: 100, Iface: "lo0",
+	}
+	empty := &classifier.Entry{
+		SrcIP: net.ParseIP("192.168.0.1"), DstIP: net.ParseIP("1.1.1.1"),
+		Proto: 6, Iface: "ng13", Class: "local",
+	}
+
+	cases := []struct {
+		expr    string
+		matches [3]bool
+	}{
+		{"", [3]bool{true, true, true}},
+		{"not iface lo0 and not (proto 17 and dst port 53) and bytes > 0", [3]bool{false, false, false}},
+		{"not iface lo0 and bytes > 0", [3]bool{true, false, false}},
+		{"iface ng*", [3]bool{true, false, true}},
+		{"proto udp or port 80", [3]bool{true, true, false}},
+		{"src net 192.168.0.0/16 and dst host 8.8.8.8", [3]bool{true, false, false}},
+		{"host != 127.0.0.1", [3]bool{true, false, true}},
+		{"dst port >= 1024", [3]bool{false, true, false}},
+		{`class != "local"`, [3]bool{true, true, false}},
+		{"not not bytes = 0", [3]bool{false, false, true}},
+	}
+
+	for _, c := range cases {
+		f, err := Parse(c.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i, e := range []*classifier.Entry{dns, loopback, empty} {
+			if f.Match(e) != c.matches[i] {
+				t.Errorf("Filter %q entry %d should match %t", c.expr, i, c.matches[i])
+			}
+		}
+	}
+}
+
+func TestShouldRejectInvalidFilter(t *testing.T) {
+	for _, expr := range []string{
+		"iface",
+		"bytes > ten",
+		"(proto 17",
+		"proto 17)",
+		"class > local",
+		"src iface lo0",
+		"host 300.1.1.1",
+		"color red",
+		`iface "lo0`,
+		"bytes => 1",
+	} {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("Should reject filter %q", expr)
+		}
+	}
+}
+
+func TestShouldSelectSourceFilters(t *testing.T) {
+	s := NewSet([]Config{
+		{Exporter: "bras*", Pre: "not iface lo0", Post: `class != "local"`},
+		{Post: "bytes > 0"},
+	})
+
+	e := &classifier.Entry{Exporter: "bras1", Iface: "lo0", Class: "local"}
+	if s.Pre(e) || s.Post(e) {
+		t.Errorf("Should filter bras entry")
+	}
+
+	e = &classifier.Entry{Exporter: "border", Iface: "lo0", Class: "local", Bytes: 1}
+	if !s.Pre(e) || !s.Post(e) {
+		t.Errorf("Should keep border entry")
+	}
+}
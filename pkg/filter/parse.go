@@ -0,0 +1,385 @@
+package filter
+
+import (
+	"fmt"
+	"github.com/inkuber/ipcad2ch/pkg/classifier"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// node is compiled filter expression
+type node interface {
+	Match(e *classifier.Entry) bool
+}
+
+type orNode struct{ left, right node }
+type andNode struct{ left, right node }
+type notNode struct{ node node }
+
+func (n orNode) Match(e *classifier.Entry) bool  { return n.left.Match(e) || n.right.Match(e) }
+func (n andNode) Match(e *classifier.Entry) bool { return n.left.Match(e) && n.right.Match(e) }
+func (n notNode) Match(e *classifier.Entry) bool { return !n.node.Match(e) }
+
+// compareNode compares one entry field with value
+type compareNode struct {
+	field string
+	side  string
+	op    string
+	text  string
+	num   uint64
+	net   *net.IPNet
+}
+
+var stringFields = map[string]func(e *classifier.Entry) string{
+	"iface":    func(e *classifier.Entry) string { return e.Iface },
+	"exporter": func(e *classifier.Entry) string { return e.Exporter },
+	"class":    func(e *classifier.Entry) string { return e.Class },
+	"dir":      func(e *classifier.Entry) string { return e.Dir },
+	"user":     func(e *classifier.Entry) string { return e.UserID },
+	"service":  func(e *classifier.Entry) string { return e.Service },
+	"country":  func(e *classifier.Entry) string { return e.RemoteCountry },
+	"org":      func(e *classifier.Entry) string { return e.RemoteOrg },
+}
+
+var numberFields = map[string]func(e *classifier.Entry) uint64{
+	"bytes":   func(e *classifier.Entry) uint64 { return e.Bytes },
+	"packets": func(e *classifier.Entry) uint64 { return e.Packets },
+	"proto":   func(e *classifier.Entry) uint64 { return uint64(e.Proto) },
+	"asn":     func(e *classifier.Entry) uint64 { return uint64(e.RemoteASN) },
+}
+
+var protocols = map[string]uint64{
+	"icmp": 1,
+	"tcp":  6,
+	"udp":  17,
+	"gre":  47,
+	"esp":  50,
+}
+
+var operators = map[string]bool{"=": true, "==": true, "!=": true, ">": true, ">=": true, "<": true, "<=": true}
+
+func (n compareNode) Match(e *classifier.Entry) bool {
+	switch n.field {
+	case "host", "net", "port":
+		// Without side any side matches, != is true when no side matches
+		src, dst := n.matchSide(e, "src"), n.matchSide(e, "dst")
+		switch n.side {
+		case "src":
+			return n.result(src)
+		case "dst":
+			return n.result(dst)
+		}
+
+		if n.op == "!=" {
+			return !src && !dst
+		}
+
+		return src || dst
+	}
+
+	if get, ok := stringFields[n.field]; ok {
+		value := get(e)
+		matched, _ := path.Match(n.text, value)
+		if n.op == "!=" {
+			return !matched
+		}
+		return matched
+	}
+
+	return compare(numberFields[n.field](e), n.op, n.num)
+}
+
+// matchSide checks side address or port, operator is applied for port only
+func (n compareNode) matchSide(e *classifier.Entry, side string) bool {
+	ip, port := e.SrcIP, uint64(e.SrcPort)
+	if side == "dst" {
+		ip, port = e.DstIP, uint64(e.DstPort)
+	}
+
+	switch n.field {
+	case "host", "net":
+		return n.net.Contains(ip)
+	}
+
+	if n.op == "!=" {
+		return port == n.num
+	}
+
+	return compare(port, n.op, n.num)
+}
+
+func (n compareNode) result(matched bool) bool {
+	if n.op == "!=" {
+		return !matched
+	}
+
+	return matched
+}
+
+func compare(value uint64, op string, expected uint64) bool {
+	switch op {
+	case "!=":
+		return value != expected
+	case ">":
+		return value > expected
+	case ">=":
+		return value >= expected
+	case "<":
+		return value < expected
+	case "<=":
+		return value <= expected
+	}
+
+	return value == expected
+}
+
+type parser struct {
+	tokens []string
+	pos    int
+}
+
+// parse compiles expression:
+//
+//	expr := and { "or" and }
+//	and := unary { "and" unary }
+//	unary := "not" unary | "(" expr ")" | [ "src" | "dst" ] field [ op ] value
+func parse(expr string) (node, error) {
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	n, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %s", p.tokens[p.pos])
+	}
+
+	return n, nil
+}
+
+func (p *parser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+
+	return ""
+}
+
+func (p *parser) next() (string, error) {
+	if p.pos >= len(p.tokens) {
+		return "", fmt.Errorf("unexpected end of filter")
+	}
+
+	token := p.tokens[p.pos]
+	p.pos = p.pos + 1
+
+	return token, nil
+}
+
+func (p *parser) or() (node, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek() == "or" {
+		p.pos = p.pos + 1
+
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+
+		left = orNode{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) and() (node, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek() == "and" {
+		p.pos = p.pos + 1
+
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+
+		left = andNode{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) unary() (node, error) {
+	switch p.peek() {
+	case "not":
+		p.pos = p.pos + 1
+
+		n, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+
+		return notNode{n}, nil
+	case "(":
+		p.pos = p.pos + 1
+
+		n, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+
+		token, err := p.next()
+		if err != nil || token != ")" {
+			return nil, fmt.Errorf("expected )")
+		}
+
+		return n, nil
+	}
+
+	return p.compare()
+}
+
+func (p *parser) compare() (node, error) {
+	field, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	n := compareNode{op: "=="}
+
+	if field == "src" || field == "dst" {
+		n.side = field
+
+		field, err = p.next()
+		if err != nil {
+			return nil, err
+		}
+
+		if field != "host" && field != "net" && field != "port" {
+			return nil, fmt.Errorf("expected host, net or port after %s", n.side)
+		}
+	}
+
+	n.field = field
+
+	if operators[p.peek()] {
+		n.op = p.peek()
+		p.pos = p.pos + 1
+	}
+
+	if n.op == "=" {
+		n.op = "=="
+	}
+
+	value, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	if operators[value] || value == "(" || value == ")" {
+		return nil, fmt.Errorf("expected value of %s", field)
+	}
+
+	value = strings.Trim(value, `"`)
+
+	switch {
+	case field == "host" || field == "net":
+		if n.op != "==" && n.op != "!=" {
+			return nil, fmt.Errorf("operator %s is not allowed for %s", n.op, field)
+		}
+
+		if !strings.Contains(value, "/") && strings.Contains(value, ":") {
+			value = value + "/128"
+		} else if !strings.Contains(value, "/") {
+			value = value + "/32"
+		}
+
+		_, n.net, err = net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse %s %s", field, value)
+		}
+	case field == "port" || numberFields[field] != nil:
+		if number, ok := protocols[value]; ok && field == "proto" {
+			n.num = number
+			break
+		}
+
+		n.num, err = strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse %s %s", field, value)
+		}
+	case stringFields[field] != nil:
+		if n.op != "==" && n.op != "!=" {
+			return nil, fmt.Errorf("operator %s is not allowed for %s", n.op, field)
+		}
+
+		if _, err := path.Match(value, ""); err != nil {
+			return nil, fmt.Errorf("could not parse pattern %s", value)
+		}
+
+		n.text = value
+	default:
+		return nil, fmt.Errorf("unknown field %s", field)
+	}
+
+	return n, nil
+}
+
+// tokenize splits expression by spaces, parentheses and operators, quoted strings are kept
+func tokenize(expr string) ([]string, error) {
+	tokens := make([]string, 0)
+
+	for i := 0; i < len(expr); {
+		ch := expr[i]
+
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n':
+			i = i + 1
+		case ch == '(' || ch == ')':
+			tokens = append(tokens, string(ch))
+			i = i + 1
+		case ch == '"':
+			end := strings.IndexByte(expr[i+1:], '"')
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			tokens = append(tokens, expr[i:i+end+2])
+			i = i + end + 2
+		case strings.IndexByte("=!<>", ch) >= 0:
+			j := i + 1
+			if j < len(expr) && expr[j] == '=' {
+				j = j + 1
+			}
+
+			if !operators[expr[i:j]] {
+				return nil, fmt.Errorf("unknown operator %s", expr[i:j])
+			}
+
+			tokens = append(tokens, expr[i:j])
+			i = j
+		default:
+			j := i
+			for j < len(expr) && strings.IndexByte(" \t\n()\"=!<>", expr[j]) == -1 {
+				j = j + 1
+			}
+			tokens = append(tokens, expr[i:j])
+			i = j
+		}
+	}
+
+	return tokens, nil
+}
@@ -0,0 +1,174 @@
+package geoip
+
+import (
+	"fmt"
+	"github.com/inkuber/ipcad2ch/pkg/classifier"
+	"log"
+	"sync"
+)
+
+/*
+Config struct used in enricher constructor NewEnricher
+
+	Config {
+	  Country: Path to GeoLite2/DB-IP country or city MMDB file
+	  ASN: Path to GeoLite2/DB-IP ASN MMDB file
+	}
+*/
+type Config struct {
+	Country string `mapstructure:"country"`
+	ASN     string `mapstructure:"asn"`
+}
+
+type asn struct {
+	Number uint32
+	Org    string
+}
+
+/*
+Enricher attaches remote country and ASN to classified entries
+
+Should be instantiate with NewEnricher method, it is safe for concurrent use
+*/
+type Enricher struct {
+	Config  Config
+	Country *Reader
+	ASN     *Reader
+
+	mu        sync.RWMutex
+	countries map[uint]string
+	asns      map[uint]asn
+}
+
+// NewEnricher constructor method
+func NewEnricher(cfg Config) *Enricher {
+	e := &Enricher{
+		Config:    cfg,
+		countries: make(map[uint]string),
+		asns:      make(map[uint]asn),
+	}
+
+	var err error
+
+	if cfg.Country != "" {
+		log.Println(fmt.Sprintf("Reading country database from file %s", cfg.Country))
+
+		e.Country, err = Open(cfg.Country)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.Println(fmt.Sprintf("Country database type:%s nodes:%d", e.Country.Metadata.DatabaseType, e.Country.Metadata.NodeCount))
+	}
+
+	if cfg.ASN != "" {
+		log.Println(fmt.Sprintf("Reading ASN database from file %s", cfg.ASN))
+
+		e.ASN, err = Open(cfg.ASN)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.Println(fmt.Sprintf("ASN database type:%s nodes:%d", e.ASN.Metadata.DatabaseType, e.ASN.Metadata.NodeCount))
+	}
+
+	return e
+}
+
+// Enabled checks any database is configured
+func (e *Enricher) Enabled() bool {
+	return e.Country != nil || e.ASN != nil
+}
+
+// Enrich entry by remote ip, entry must be classified before
+func (e *Enricher) Enrich(entry *classifier.Entry) {
+	ip := entry.RemoteIP()
+	if ip == nil {
+		return
+	}
+
+	if e.Country != nil {
+		offset, err := e.Country.LookupOffset(ip)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if offset != 0 {
+			e.mu.RLock()
+			country, ok := e.countries[offset]
+			e.mu.RUnlock()
+
+			if !ok {
+				country = e.decodeCountry(offset)
+
+				e.mu.Lock()
+				e.countries[offset] = country
+				e.mu.Unlock()
+			}
+
+			entry.RemoteCountry = country
+		}
+	}
+
+	if e.ASN != nil {
+		offset, err := e.ASN.LookupOffset(ip)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if offset != 0 {
+			e.mu.RLock()
+			a, ok := e.asns[offset]
+			e.mu.RUnlock()
+
+			if !ok {
+				a = e.decodeASN(offset)
+
+				e.mu.Lock()
+				e.asns[offset] = a
+				e.mu.Unlock()
+			}
+
+			// ASN learned from BGP routes has priority, organization of other ASN is not set
+			if entry.RemoteASN == 0 {
+				entry.RemoteASN = a.Number
+			}
+
+			if entry.RemoteASN == a.Number {
+				entry.RemoteOrg = a.Org
+			}
+		}
+	}
+}
+
+func (e *Enricher) decodeCountry(offset uint) string {
+	record, err := e.Country.Decode(offset)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	m, _ := record.(map[string]interface{})
+	for _, key := range []string{"country", "registered_country"} {
+		country, _ := m[key].(map[string]interface{})
+		if code, ok := country["iso_code"].(string); ok {
+			return code
+		}
+	}
+
+	return ""
+}
+
+func (e *Enricher) decodeASN(offset uint) asn {
+	record, err := e.ASN.Decode(offset)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	m, _ := record.(map[string]interface{})
+	org, _ := m["autonomous_system_organization"].(string)
+
+	return asn{
+		Number: uint32(toUint(m["autonomous_system_number"])),
+		Org:    org,
+	}
+}
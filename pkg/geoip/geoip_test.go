@@ -0,0 +1,131 @@
+package geoip
+
+import (
+	"github.com/inkuber/ipcad2ch/pkg/classifier"
+	"net"
+	"testing"
+)
+
+func mmdbString(s string) []byte {
+	if len(s) >= 29 {
+		return append([]byte{2<<5 | 29, byte(len(s) - 29)}, s...)
+	}
+	return append([]byte{byte(2<<5 | len(s))}, s...)
+}
+
+func mmdbUint16(v uint16) []byte {
+	return []byte{5<<5 | 2, byte(v >> 8), byte(v)}
+}
+
+func mmdbUint32(v uint32) []byte {
+	return []byte{6<<5 | 4, byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+}
+
+func mmdbMap(items ...[]byte) []byte {
+	b := []byte{byte(7<<5 | len(items)/2)}
+	for _, item := range items {
+		b = append(b, item...)
+	}
+	return b
+}
+
+// testDatabase builds IPv4 database with one node: 0.0.0.0/1 is NL AS13335, 128.0.0.0/1 is empty
+func testDatabase() []byte {
+	// Country code string at offset 0 referenced by pointer from the record map at offset 3
+	data := mmdbString("NL")
+	data = append(data, mmdbMap(
+		mmdbString("country"), mmdbMap(mmdbString("iso_code"), []byte{1 << 5, 0}),
+		mmdbString("autonomous_system_number"), mmdbUint32(13335),
+		mmdbString("autonomous_system_organization"), mmdbString("CLOUDFLARENET"),
+	)...)
+
+	tree := []byte{0, 0, 20, 0, 0, 1}
+
+	metadata := mmdbMap(
+		mmdbString("node_count"), mmdbUint32(1),
+		mmdbString("record_size"), mmdbUint16(24),
+		mmdbString("ip_version"), mmdbUint16(4),
+		mmdbString("database_type"), mmdbString("Test"),
+	)
+
+	db := append(tree, make([]byte, 16)...)
+	db = append(db, data...)
+	db = append(db, metadataStart...)
+	return append(db, metadata...)
+}
+
+func TestShouldReadMMDB(t *testing.T) {
+	r, err := FromBytes(testDatabase())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Metadata.DatabaseType != "Test" || r.Metadata.NodeCount != 1 {
+		t.Errorf("Metadata mismatch %v", r.Metadata)
+	}
+
+	record, err := r.Lookup(net.ParseIP("1.1.1.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, ok := record.(map[string]interface{})
+	if !ok || m["autonomous_system_organization"] != "CLOUDFLARENET" {
+		t.Errorf("Record mismatch %v", record)
+	}
+
+	record, err = r.Lookup(net.ParseIP("200.1.1.1"))
+	if err != nil || record != nil {
+		t.Errorf("Should not find record")
+	}
+}
+
+func TestShouldEnrichEntry(t *testing.T) {
+	r, err := FromBytes(testDatabase())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := &Enricher{
+		Country:   r,
+		ASN:       r,
+		countries: make(map[uint]string),
+		asns:      make(map[uint]asn),
+	}
+
+	entry := classifier.Entry{
+		SrcIP: net.ParseIP("192.168.0.1"),
+		DstIP: net.ParseIP("1.1.1.1"),
+		Dir:   classifier.OUT,
+	}
+	e.Enrich(&entry)
+
+	if entry.RemoteCountry != "NL" || entry.RemoteASN != 13335 || entry.RemoteOrg != "CLOUDFLARENET" {
+		t.Errorf("Should enrich entry %v", entry)
+	}
+
+	// BGP ASN is kept, organization of DB ASN is not mixed with it
+	entry = classifier.Entry{
+		SrcIP:     net.ParseIP("192.168.0.1"),
+		DstIP:     net.ParseIP("1.1.1.1"),
+		Dir:       classifier.OUT,
+		RemoteASN: 64512,
+	}
+	e.Enrich(&entry)
+
+	if entry.RemoteASN != 64512 || entry.RemoteOrg != "" {
+		t.Errorf("Should keep BGP ASN without organization %v", entry)
+	}
+
+	entry = classifier.Entry{
+		SrcIP:     net.ParseIP("192.168.0.1"),
+		DstIP:     net.ParseIP("1.1.1.1"),
+		Dir:       classifier.OUT,
+		RemoteASN: 13335,
+	}
+	e.Enrich(&entry)
+
+	if entry.RemoteOrg != "CLOUDFLARENET" {
+		t.Errorf("Should set organization of equal BGP ASN %v", entry)
+	}
+}
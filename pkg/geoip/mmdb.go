@@ -0,0 +1,396 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+)
+
+var metadataStart = []byte("\xAB\xCD\xEFMaxMind.com")
+
+var errInvalidDatabase = errors.New("invalid MaxMind DB")
+
+// Metadata of MaxMind DB file
+type Metadata struct {
+	NodeCount    uint
+	RecordSize   uint
+	IPVersion    uint
+	DatabaseType string
+}
+
+/*
+Reader is pure Go MaxMind DB (MMDB) format reader
+
+Should be instantiate with Open method
+*/
+type Reader struct {
+	Metadata Metadata
+
+	buffer     []byte
+	data       []byte
+	nodeSize   uint
+	ipv4Start  uint
+	ipv4Loaded bool
+}
+
+// Open reads MMDB file into memory
+func Open(file string) (*Reader, error) {
+	buffer, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return FromBytes(buffer)
+}
+
+// FromBytes creates reader from MMDB file content
+func FromBytes(buffer []byte) (*Reader, error) {
+	start := bytes.LastIndex(buffer, metadataStart)
+	if start == -1 {
+		return nil, errInvalidDatabase
+	}
+
+	d := decoder{buffer: buffer[start+len(metadataStart):]}
+	value, _, err := d.decode(0)
+	if err != nil {
+		return nil, err
+	}
+
+	meta, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errInvalidDatabase
+	}
+
+	r := &Reader{buffer: buffer}
+	r.Metadata.NodeCount = uint(toUint(meta["node_count"]))
+	r.Metadata.RecordSize = uint(toUint(meta["record_size"]))
+	r.Metadata.IPVersion = uint(toUint(meta["ip_version"]))
+	r.Metadata.DatabaseType, _ = meta["database_type"].(string)
+
+	switch r.Metadata.RecordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("unsupported MMDB record size %d", r.Metadata.RecordSize)
+	}
+
+	r.nodeSize = r.Metadata.RecordSize / 4
+	treeSize := r.Metadata.NodeCount * r.nodeSize
+	if treeSize+16 > uint(start) {
+		return nil, errInvalidDatabase
+	}
+
+	r.data = buffer[treeSize+16 : start]
+
+	// IPv4 subtree is found once, so concurrent lookups only read reader
+	if r.Metadata.IPVersion == 6 {
+		_, err = r.ipv4StartNode()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// Lookup finds record for ip, returns nil if ip is not in database
+func (r *Reader) Lookup(ip net.IP) (interface{}, error) {
+	offset, err := r.lookupOffset(ip)
+	if err != nil || offset == 0 {
+		return nil, err
+	}
+
+	return r.Decode(offset)
+}
+
+// LookupOffset finds data section offset of ip record, 0 if ip is not in database
+func (r *Reader) LookupOffset(ip net.IP) (uint, error) {
+	return r.lookupOffset(ip)
+}
+
+// Decode decodes record at data section offset returned by LookupOffset
+func (r *Reader) Decode(offset uint) (interface{}, error) {
+	d := decoder{buffer: r.data}
+	value, _, err := d.decode(offset - 1)
+	return value, err
+}
+
+func (r *Reader) lookupOffset(ip net.IP) (uint, error) {
+	bits := ip.To4()
+	node := uint(0)
+
+	if bits == nil {
+		if r.Metadata.IPVersion == 4 {
+			return 0, nil
+		}
+		bits = ip.To16()
+	} else if r.Metadata.IPVersion == 6 {
+		start, err := r.ipv4StartNode()
+		if err != nil {
+			return 0, err
+		}
+		node = start
+	}
+
+	count := r.Metadata.NodeCount
+	for i := 0; i < len(bits)*8 && node < count; i++ {
+		bit := uint(bits[i>>3]>>(7-uint(i&7))) & 1
+
+		var err error
+		node, err = r.readNode(node, bit)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if node == count {
+		return 0, nil
+	}
+
+	if node < count {
+		return 0, errInvalidDatabase
+	}
+
+	// Offsets are shifted by one to keep 0 as not found marker
+	return node - count - 16 + 1, nil
+}
+
+func (r *Reader) ipv4StartNode() (uint, error) {
+	if r.ipv4Loaded {
+		return r.ipv4Start, nil
+	}
+
+	node := uint(0)
+	for i := 0; i < 96 && node < r.Metadata.NodeCount; i++ {
+		var err error
+		node, err = r.readNode(node, 0)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	r.ipv4Start = node
+	r.ipv4Loaded = true
+
+	return node, nil
+}
+
+func (r *Reader) readNode(node uint, bit uint) (uint, error) {
+	base := node * r.nodeSize
+	if base+r.nodeSize > uint(len(r.buffer)) {
+		return 0, errInvalidDatabase
+	}
+
+	b := r.buffer[base : base+r.nodeSize]
+
+	switch r.Metadata.RecordSize {
+	case 24:
+		off := bit * 3
+		return uint(b[off])<<16 | uint(b[off+1])<<8 | uint(b[off+2]), nil
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]), nil
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6]), nil
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:])), nil
+	}
+}
+
+type decoder struct {
+	buffer []byte
+}
+
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+func (d *decoder) decode(offset uint) (interface{}, uint, error) {
+	if offset >= uint(len(d.buffer)) {
+		return nil, 0, errInvalidDatabase
+	}
+
+	ctrl := d.buffer[offset]
+	offset++
+
+	kind := uint(ctrl >> 5)
+
+	if kind == typePointer {
+		pointer, next, err := d.pointer(ctrl, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		value, _, err := d.decode(pointer)
+		return value, next, err
+	}
+
+	if kind == typeExtended {
+		if offset >= uint(len(d.buffer)) {
+			return nil, 0, errInvalidDatabase
+		}
+		kind = 7 + uint(d.buffer[offset])
+		offset++
+	}
+
+	size, offset, err := d.size(ctrl, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch kind {
+	case typeMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			var key, value interface{}
+			key, offset, err = d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+
+			value, offset, err = d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+
+			k, ok := key.(string)
+			if !ok {
+				return nil, 0, errInvalidDatabase
+			}
+			m[k] = value
+		}
+		return m, offset, nil
+	case typeArray:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			var value interface{}
+			value, offset, err = d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+		}
+		return a, offset, nil
+	case typeBool:
+		return size != 0, offset, nil
+	case typeEndMarker, typeContainer:
+		return nil, offset, nil
+	}
+
+	if offset+size > uint(len(d.buffer)) {
+		return nil, 0, errInvalidDatabase
+	}
+	b := d.buffer[offset : offset+size]
+	next := offset + size
+
+	switch kind {
+	case typeString:
+		return string(b), next, nil
+	case typeBytes:
+		return append([]byte{}, b...), next, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, errInvalidDatabase
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), next, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, errInvalidDatabase
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), next, nil
+	case typeUint16, typeUint32, typeUint64, typeUint128:
+		var v uint64
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		return v, next, nil
+	case typeInt32:
+		var v uint32
+		for _, c := range b {
+			v = v<<8 | uint32(c)
+		}
+		return int32(v), next, nil
+	}
+
+	return nil, 0, fmt.Errorf("unknown MMDB data type %d", kind)
+}
+
+func (d *decoder) size(ctrl byte, offset uint) (uint, uint, error) {
+	size := uint(ctrl & 0x1f)
+	if size < 29 {
+		return size, offset, nil
+	}
+
+	n := size - 28
+	if offset+n > uint(len(d.buffer)) {
+		return 0, 0, errInvalidDatabase
+	}
+
+	var v uint
+	for _, c := range d.buffer[offset : offset+n] {
+		v = v<<8 | uint(c)
+	}
+
+	switch size {
+	case 29:
+		return 29 + v, offset + n, nil
+	case 30:
+		return 285 + v, offset + n, nil
+	default:
+		return 65821 + v, offset + n, nil
+	}
+}
+
+func (d *decoder) pointer(ctrl byte, offset uint) (uint, uint, error) {
+	n := uint((ctrl>>3)&0x3) + 1
+	if offset+n > uint(len(d.buffer)) {
+		return 0, 0, errInvalidDatabase
+	}
+
+	b := d.buffer[offset : offset+n]
+	var v uint
+	if n != 4 {
+		v = uint(ctrl & 0x7)
+	}
+	for _, c := range b {
+		v = v<<8 | uint(c)
+	}
+
+	switch n {
+	case 2:
+		v += 2048
+	case 3:
+		v += 526336
+	}
+
+	return v, offset + n, nil
+}
+
+func toUint(v interface{}) uint64 {
+	switch n := v.(type) {
+	case uint64:
+		return n
+	case int32:
+		return uint64(n)
+	}
+
+	return 0
+}
@@ -0,0 +1,62 @@
+package ipcad
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"os"
+	"sync"
+)
+
+// Hash returns hash of regular file content, file is read again from start
+func Hash(in *os.File) (string, error) {
+	h := sha256.New()
+
+	_, err := io.Copy(h, in)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = in.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+/*
+Hasher hashes stream while it is read, so stream is neither buffered nor delayed,
+Sum is safe to call while stream is read
+
+Should be instantiate with NewHasher method
+*/
+type Hasher struct {
+	in io.Reader
+	h  hash.Hash
+	mu sync.Mutex
+}
+
+// NewHasher constructor method
+func NewHasher(in io.Reader) *Hasher {
+	return &Hasher{in: in, h: sha256.New()}
+}
+
+func (h *Hasher) Read(p []byte) (int, error) {
+	n, err := h.in.Read(p)
+
+	h.mu.Lock()
+	h.h.Write(p[:n])
+	h.mu.Unlock()
+
+	return n, err
+}
+
+// Sum returns hash of content read so far, it is equal to Hash when stream is read to the end
+func (h *Hasher) Sum() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return hex.EncodeToString(h.h.Sum(nil))
+}
@@ -0,0 +1,85 @@
+package ipcad
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestShouldHashInput(t *testing.T) {
+	content := "188.218.183.98   121.82.188.202         1           82  18218   888     8  em1\n"
+
+	f, err := ioutil.TempFile("", "ipcad")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	f.WriteString(content)
+	f.Seek(0, 0)
+
+	hash, err := Hash(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := ioutil.ReadAll(f)
+	if string(data) != content {
+		t.Errorf("Should read file from start, got %q", data)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		w.WriteString(content)
+		w.Close()
+	}()
+
+	hasher := NewHasher(r)
+	data, _ = ioutil.ReadAll(hasher)
+	r.Close()
+
+	if string(data) != content || hasher.Sum() != hash {
+		t.Errorf("Should hash stream while read with equal hash %q %s %s", data, hasher.Sum(), hash)
+	}
+}
+
+func TestShouldSumWhileStreamIsRead(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for i := 0; i < 1000; i++ {
+			w.WriteString("188.218.183.98   121.82.188.202         1           82  18218   888     8  em1\n")
+		}
+		w.Close()
+	}()
+
+	hasher := NewHasher(r)
+
+	done := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				hasher.Sum()
+			}
+		}
+	}()
+
+	ioutil.ReadAll(hasher)
+	close(done)
+	r.Close()
+
+	if len(hasher.Sum()) != 64 {
+		t.Errorf("Should sum stream while read")
+	}
+}
@@ -23,11 +23,13 @@ type Entry struct {
 	Iface   string
 
 	Collected time.Time
+	Exporter  string
 }
 
 type Config struct {
 	Collected string `yaml:"collected"`
 	Pipe      bool   `yaml:"pipe"`
+	Exporter  string `yaml:"exporter"`
 }
 
 var (
@@ -60,6 +62,7 @@ func Read(wg *sync.WaitGroup, cfg Config, in io.Reader, out chan *Entry) {
 			if line != "" {
 				entry, ok := Parse(line)
 				if ok {
+					entry.Exporter = cfg.Exporter
 					out <- entry
 
 					if cfg.Pipe {
@@ -0,0 +1,143 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+Config struct used in Write method
+
+	Config {
+	  File: Path to Prometheus node_exporter textfile collector file
+	}
+*/
+type Config struct {
+	File string `mapstructure:"file"`
+}
+
+var (
+	// COUNTER metric type
+	COUNTER string = "counter"
+
+	// GAUGE metric type
+	GAUGE string = "gauge"
+)
+
+var (
+	mu     sync.Mutex
+	values = make(map[string]float64)
+	types  = make(map[string]string)
+)
+
+// Add increases counter, name could contain labels: name{label="value"}
+func Add(name string, value float64) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	types[family(name)] = COUNTER
+	values[name] = values[name] + value
+}
+
+// Set sets gauge value, name could contain labels: name{label="value"}
+func Set(name string, value float64) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	types[family(name)] = GAUGE
+	values[name] = value
+}
+
+// Get returns current metric value
+func Get(name string) float64 {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return values[name]
+}
+
+// Reset removes all metrics
+func Reset() {
+	mu.Lock()
+	defer mu.Unlock()
+
+	values = make(map[string]float64)
+	types = make(map[string]string)
+}
+
+// Format returns metrics in Prometheus text exposition format
+func Format() string {
+	mu.Lock()
+	defer mu.Unlock()
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if family(names[i]) != family(names[j]) {
+			return family(names[i]) < family(names[j])
+		}
+		return names[i] < names[j]
+	})
+
+	var b bytes.Buffer
+	last := ""
+	for _, name := range names {
+		f := family(name)
+		if f != last {
+			fmt.Fprintf(&b, "# TYPE %s %s\n", f, types[f])
+			last = f
+		}
+		fmt.Fprintf(&b, "%s %s\n", name, strconv.FormatFloat(values[name], 'f', -1, 64))
+	}
+
+	return b.String()
+}
+
+// Write atomically replaces textfile with current metrics, does nothing if file is not set
+func Write(cfg Config) {
+	if cfg.File == "" {
+		return
+	}
+
+	log.Println(fmt.Sprintf("Writing metrics to file %s", cfg.File))
+
+	tmp, err := ioutil.TempFile(filepath.Dir(cfg.File), ".metrics")
+	if err != nil {
+		log.Println(fmt.Sprintf("Could not write metrics %v", err))
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.WriteString(Format())
+	if err == nil {
+		err = tmp.Close()
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), cfg.File)
+	}
+
+	if err != nil {
+		log.Println(fmt.Sprintf("Could not write metrics %v", err))
+	}
+}
+
+func family(name string) string {
+	if i := strings.IndexByte(name, '{'); i != -1 {
+		return name[:i]
+	}
+
+	return name
+}
@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestShouldFormatMetrics(t *testing.T) {
+	Reset()
+
+	Add(`ipcad2ch_flows_total{exporter="bras1"}`, 2)
+	Add(`ipcad2ch_flows_total{exporter="bras1"}`, 3)
+	Add(`ipcad2ch_flows_total{exporter="bras2"}`, 1)
+	Set("ipcad2ch_last_run_timestamp_seconds", 1605780000)
+
+	expected := `# TYPE ipcad2ch_flows_total counter
+ipcad2ch_flows_total{exporter="bras1"} 5
+ipcad2ch_flows_total{exporter="bras2"} 1
+# TYPE ipcad2ch_last_run_timestamp_seconds gauge
+ipcad2ch_last_run_timestamp_seconds 1605780000
+`
+
+	if Format() != expected {
+		t.Errorf("Format mismatch:\n%s", Format())
+	}
+}
+
+func TestShouldWriteTextfile(t *testing.T) {
+	Reset()
+	Set("ipcad2ch_up", 1)
+
+	dir, err := ioutil.TempDir("", "metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "ipcad2ch.prom")
+	Write(Config{File: file})
+
+	body, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(body) != "# TYPE ipcad2ch_up gauge\nipcad2ch_up 1\n" {
+		t.Errorf("Textfile mismatch:\n%s", body)
+	}
+}
@@ -0,0 +1,317 @@
+package rating
+
+import (
+	"fmt"
+	"github.com/inkuber/ipcad2ch/pkg/classifier"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Config of rating stage, entries without user are not rated
+
+	Config {
+	  TariffAttribute: user attribute with tariff name, default tariff
+	  DefaultTariff: tariff of users without tariff attribute
+	  Rules: price rules, first matching rule wins, see RuleConfig
+	}
+*/
+type Config struct {
+	TariffAttribute string       `mapstructure:"tariffAttribute"`
+	DefaultTariff   string       `mapstructure:"defaultTariff"`
+	Rules           []RuleConfig `mapstructure:"rules"`
+}
+
+/*
+RuleConfig describes one price rule, empty condition matches any entry
+
+	RuleConfig {
+	  Name: Rule name stored in charges table
+	  Tariffs: User tariffs list
+	  Classes: Classes list: local, peering, internet...
+	  Services: Services list
+	  Dir: Direction: in or out
+	  Hours: Hours of collected time with ranges "0-7,23"
+	  Price: Price of gigabyte (10^9 bytes)
+	  Quota: Free gigabytes per user in calendar month
+	}
+*/
+type RuleConfig struct {
+	Name     string   `mapstructure:"name"`
+	Tariffs  []string `mapstructure:"tariffs"`
+	Classes  []string `mapstructure:"classes"`
+	Services []string `mapstructure:"services"`
+	Dir      string   `mapstructure:"dir"`
+	Hours    string   `mapstructure:"hours"`
+	Price    float64  `mapstructure:"price"`
+	Quota    float64  `mapstructure:"quota"`
+}
+
+// Rule is compiled price rule
+type Rule struct {
+	Name     string
+	Tariffs  map[string]bool
+	Classes  map[string]bool
+	Services map[string]bool
+	Dir      string
+	Hours    map[int]bool
+	Price    float64
+	Quota    uint64
+}
+
+// UsageKey is user traffic of rule in calendar month
+type UsageKey struct {
+	Month  time.Time
+	UserID string
+	Rule   string
+}
+
+// Charge is user traffic and cost of rule in calendar month
+type Charge struct {
+	UsageKey
+	Tariff string
+	Bytes  uint64
+	Billed uint64
+	Cost   float64
+}
+
+// UsageFunc returns bytes of month used before this run by user and rule
+type UsageFunc func(month time.Time) (map[UsageKey]uint64, error)
+
+const gigabyte = 1000000000
+
+/*
+Rater prices classified entries and collects monthly charges
+
+Should be instantiate with NewRater method, it is safe for concurrent use
+*/
+type Rater struct {
+	Config Config
+	Rules  []Rule
+
+	// Usage loads month usage of previous runs for free quotas
+	Usage UsageFunc
+
+	mu      sync.Mutex
+	months  map[time.Time]bool
+	used    map[UsageKey]uint64
+	charges map[string]*Charge
+}
+
+// NewRater constructor method
+func NewRater(cfg Config) *Rater {
+	r := &Rater{
+		Config:  cfg,
+		months:  make(map[time.Time]bool),
+		used:    make(map[UsageKey]uint64),
+		charges: make(map[string]*Charge),
+	}
+
+	for _, rule := range cfg.Rules {
+		compiled, err := NewRule(rule)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		r.Rules = append(r.Rules, compiled)
+	}
+
+	if r.Enabled() {
+		log.Println(fmt.Sprintf("Compiled %d price rules", len(r.Rules)))
+	}
+
+	return r
+}
+
+// NewRule compiles price rule
+func NewRule(cfg RuleConfig) (Rule, error) {
+	r := Rule{
+		Name:     cfg.Name,
+		Tariffs:  set(cfg.Tariffs),
+		Classes:  set(cfg.Classes),
+		Services: set(cfg.Services),
+		Dir:      cfg.Dir,
+		Hours:    make(map[int]bool),
+		Price:    cfg.Price,
+		Quota:    uint64(cfg.Quota * gigabyte),
+	}
+
+	if cfg.Name == "" {
+		return r, fmt.Errorf("price rule name is not set")
+	}
+
+	switch cfg.Dir {
+	case classifier.IN, classifier.OUT, "":
+	default:
+		return r, fmt.Errorf("unknown direction %s of price rule %s", cfg.Dir, cfg.Name)
+	}
+
+	if cfg.Price < 0 || cfg.Quota < 0 {
+		return r, fmt.Errorf("negative price or quota of price rule %s", cfg.Name)
+	}
+
+	for _, hours := range strings.Split(cfg.Hours, ",") {
+		hours = strings.TrimSpace(hours)
+		if hours == "" {
+			continue
+		}
+
+		bounds := strings.SplitN(hours, "-", 2)
+		from, err := strconv.Atoi(bounds[0])
+		to := from
+		if err == nil && len(bounds) == 2 {
+			to, err = strconv.Atoi(bounds[1])
+		}
+
+		if err != nil || from < 0 || to > 23 || from > to {
+			return r, fmt.Errorf("could not parse hours %s of price rule %s", hours, cfg.Name)
+		}
+
+		for hour := from; hour <= to; hour++ {
+			r.Hours[hour] = true
+		}
+	}
+
+	return r, nil
+}
+
+func set(values []string) map[string]bool {
+	s := make(map[string]bool)
+	for _, value := range values {
+		s[value] = true
+	}
+
+	return s
+}
+
+// Match checks rule conditions
+func (r *Rule) Match(tariff string, e *classifier.Entry) bool {
+	if len(r.Tariffs) > 0 && !r.Tariffs[tariff] {
+		return false
+	}
+
+	if len(r.Classes) > 0 && !r.Classes[e.Class] {
+		return false
+	}
+
+	if len(r.Services) > 0 && !r.Services[e.Service] {
+		return false
+	}
+
+	if r.Dir != "" && r.Dir != e.Dir {
+		return false
+	}
+
+	if len(r.Hours) > 0 && !r.Hours[e.Collected.Hour()] {
+		return false
+	}
+
+	return true
+}
+
+// Enabled checks any price rule is configured
+func (r *Rater) Enabled() bool {
+	return len(r.Rules) > 0
+}
+
+// Tariff returns tariff of entry user
+func (r *Rater) Tariff(e *classifier.Entry) string {
+	attribute := r.Config.TariffAttribute
+	if attribute == "" {
+		attribute = "tariff"
+	}
+
+	if tariff := e.UserAttributes[attribute]; tariff != "" {
+		return tariff
+	}
+
+	return r.Config.DefaultTariff
+}
+
+// Rate sets cost of entry, bytes in free quota of the month are not billed
+func (r *Rater) Rate(e *classifier.Entry) error {
+	e.Cost = 0
+
+	if !r.Enabled() || e.UserID == "" {
+		return nil
+	}
+
+	tariff := r.Tariff(e)
+
+	var rule *Rule
+	for i := range r.Rules {
+		if r.Rules[i].Match(tariff, e) {
+			rule = &r.Rules[i]
+			break
+		}
+	}
+
+	if rule == nil {
+		return nil
+	}
+
+	month := time.Date(e.Collected.Year(), e.Collected.Month(), 1, 0, 0, 0, 0, e.Collected.Location())
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.months[month] && r.Usage != nil {
+		usage, err := r.Usage(month)
+		if err != nil {
+			return err
+		}
+
+		for key, bytes := range usage {
+			r.used[key] = r.used[key] + bytes
+		}
+	}
+	r.months[month] = true
+
+	key := UsageKey{Month: month, UserID: e.UserID, Rule: rule.Name}
+
+	var free uint64
+	if used := r.used[key]; used < rule.Quota {
+		free = rule.Quota - used
+	}
+
+	billed := e.Bytes
+	if billed > free {
+		billed = billed - free
+	} else {
+		billed = 0
+	}
+
+	e.Cost = float64(billed) / gigabyte * rule.Price
+	r.used[key] = r.used[key] + e.Bytes
+
+	chargeKey := fmt.Sprintf("%s %s %s %s", month.Format("2006-01-02"), e.UserID, tariff, rule.Name)
+	charge, ok := r.charges[chargeKey]
+	if !ok {
+		charge = &Charge{UsageKey: key, Tariff: tariff}
+		r.charges[chargeKey] = charge
+	}
+
+	charge.Bytes = charge.Bytes + e.Bytes
+	charge.Billed = charge.Billed + billed
+	charge.Cost = charge.Cost + e.Cost
+
+	return nil
+}
+
+// Flush returns charges collected since previous flush
+func (r *Rater) Flush() []Charge {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	charges := make([]Charge, 0, len(r.charges))
+	for _, charge := range r.charges {
+		charges = append(charges, *charge)
+	}
+
+	r.charges = make(map[string]*Charge)
+
+	return charges
+}
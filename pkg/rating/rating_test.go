@@ -0,0 +1,81 @@
+package rating
+
+import (
+	"github.com/inkuber/ipcad2ch/pkg/classifier"
+	"testing"
+	"time"
+)
+
+func TestShouldParseRuleHours(t *testing.T) {
+	rule, err := NewRule(RuleConfig{Name: "night", Hours: "0-6, 23"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rule.Hours) != 8 || !rule.Hours[23] || rule.Hours[7] {
+		t.Errorf("Hours mismatch %v", rule.Hours)
+	}
+
+	for _, hours := range []string{"7-3", "0-24", "night"} {
+		if _, err := NewRule(RuleConfig{Name: "night", Hours: hours}); err == nil {
+			t.Errorf("Should reject hours %s", hours)
+		}
+	}
+}
+
+func TestShouldRateEntries(t *testing.T) {
+	r := NewRater(Config{
+		DefaultTariff: "basic",
+		Rules: []RuleConfig{
+			{Name: "free-local", Classes: []string{"local", "peering"}},
+			{Name: "night", Hours: "0-6", Price: 0.5},
+			{Name: "business", Tariffs: []string{"business"}, Price: 2},
+			{Name: "internet", Price: 1, Quota: 1},
+		},
+	})
+
+	collected := time.Date(2020, 11, 19, 10, 0, 0, 0, time.UTC)
+	r.Usage = func(month time.Time) (map[UsageKey]uint64, error) {
+		return map[UsageKey]uint64{{Month: month, UserID: "1", Rule: "internet"}: 500000000}, nil
+	}
+
+	cases := []struct {
+		entry classifier.Entry
+		cost  float64
+	}{
+		// 0.5 GB of quota left
+		{classifier.Entry{UserID: "1", Class: "internet", Bytes: 1000000000, Collected: collected}, 0.5},
+		{classifier.Entry{UserID: "1", Class: "internet", Bytes: 1000000000, Collected: collected}, 1},
+		{classifier.Entry{UserID: "1", Class: "peering", Bytes: 1000000000, Collected: collected}, 0},
+		{classifier.Entry{UserID: "1", Class: "internet", Bytes: 1000000000, Collected: collected.Add(-6 * time.Hour)}, 0.5},
+		{classifier.Entry{UserID: "2", Class: "internet", Bytes: 1000000000, Collected: collected,
+			UserAttributes: map[string]string{"tariff": "business"}}, 2},
+		{classifier.Entry{Class: "internet", Bytes: 1000000000, Collected: collected}, 0},
+	}
+
+	for i, c := range cases {
+		err := r.Rate(&c.entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if c.entry.Cost != c.cost {
+			t.Errorf("Entry %d cost %f, should be %f", i, c.entry.Cost, c.cost)
+		}
+	}
+
+	charges := r.Flush()
+	if len(charges) != 4 {
+		t.Fatalf("Should collect 4 charges, got %v", charges)
+	}
+
+	for _, charge := range charges {
+		if charge.Rule == "internet" && (charge.Bytes != 2000000000 || charge.Billed != 1500000000 || charge.Tariff != "basic") {
+			t.Errorf("Charge mismatch %v", charge)
+		}
+	}
+
+	if len(r.Flush()) != 0 {
+		t.Errorf("Should reset charges after flush")
+	}
+}
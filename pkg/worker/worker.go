@@ -0,0 +1,112 @@
+package worker
+
+import (
+	"fmt"
+	"github.com/inkuber/ipcad2ch/pkg/classifier"
+	"github.com/inkuber/ipcad2ch/pkg/filter"
+	"github.com/inkuber/ipcad2ch/pkg/geoip"
+	"github.com/inkuber/ipcad2ch/pkg/ipcad"
+	"github.com/inkuber/ipcad2ch/pkg/metrics"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+Config of classification workers between reader and writer
+
+	Config {
+	  Count: Number of parallel workers, default is number of CPUs
+	}
+*/
+type Config struct {
+	Count int `mapstructure:"count"`
+}
+
+// counters of entries dropped by filters
+type counters struct {
+	pre  uint64
+	post uint64
+}
+
+// Classify filters, classifies and enriches entries by parallel workers, out is closed after in is drained
+func Classify(wg *sync.WaitGroup, cfg Config, c *classifier.Classifier, g *geoip.Enricher, f *filter.Set, in chan *ipcad.Entry, out chan *classifier.Entry) {
+	count := cfg.Count
+	if count < 1 {
+		count = 1
+	}
+
+	log.Println(fmt.Sprintf("Starting %d classification workers", count))
+
+	defer wg.Done()
+	defer close(out)
+
+	var workersWg sync.WaitGroup
+	var dropped counters
+
+	for i := 0; i < count; i++ {
+		workersWg.Add(1)
+		go func() {
+			defer workersWg.Done()
+
+			for e := range in {
+				work(c, g, f, e, out, &dropped)
+			}
+		}()
+	}
+
+	workersWg.Wait()
+
+	hits, misses := c.CacheStats()
+	metrics.Add("ipcad2ch_classifier_cache_hits_total", float64(hits))
+	metrics.Add("ipcad2ch_classifier_cache_misses_total", float64(misses))
+
+	metrics.Add(`ipcad2ch_filtered_entries_total{stage="pre"}`, float64(dropped.pre))
+	metrics.Add(`ipcad2ch_filtered_entries_total{stage="post"}`, float64(dropped.post))
+
+	log.Println(fmt.Sprintf("Classification workers ended, cache hits:%d misses:%d, filtered pre:%d post:%d", hits, misses, dropped.pre, dropped.post))
+}
+
+func work(c *classifier.Classifier, g *geoip.Enricher, f *filter.Set, e *ipcad.Entry, out chan *classifier.Entry, dropped *counters) {
+	if e.SrcIP == nil || e.DstIP == nil {
+		log.Fatal("nil src or dst passed")
+	}
+
+	entry := &classifier.Entry{
+		SrcIP:     e.SrcIP,
+		DstIP:     e.DstIP,
+		Packets:   e.Packets,
+		Bytes:     e.Bytes,
+		SrcPort:   e.SrcPort,
+		DstPort:   e.DstPort,
+		Proto:     e.Proto,
+		Iface:     e.Iface,
+		Collected: e.Collected,
+		Exporter:  e.Exporter,
+	}
+
+	if !f.Pre(entry) {
+		atomic.AddUint64(&dropped.pre, 1)
+		return
+	}
+
+	c.Classify(entry)
+
+	entries := []*classifier.Entry{entry}
+	if mirror, ok := c.Mirror(entry); ok {
+		entries = append(entries, &mirror)
+	}
+
+	for _, entry := range entries {
+		if g.Enabled() {
+			g.Enrich(entry)
+		}
+
+		if !f.Post(entry) {
+			atomic.AddUint64(&dropped.post, 1)
+			continue
+		}
+
+		out <- entry
+	}
+}
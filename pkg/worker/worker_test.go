@@ -0,0 +1,45 @@
+package worker
+
+import (
+	"github.com/inkuber/ipcad2ch/pkg/classifier"
+	"github.com/inkuber/ipcad2ch/pkg/filter"
+	"github.com/inkuber/ipcad2ch/pkg/geoip"
+	"github.com/inkuber/ipcad2ch/pkg/ipcad"
+	"net"
+	"sync"
+	"testing"
+)
+
+func TestShouldClassifyInParallel(t *testing.T) {
+	cfg := classifier.Config{MirrorLocal: true, Cache: 100}
+	cfg.Users.Users = map[string]string{"192.168.0.1": "1", "192.168.0.2": "2"}
+	cfg.Networks.Networks = map[string]string{"192.168.0.0/16": "local"}
+
+	c := classifier.NewClassifier(cfg)
+
+	in := make(chan *ipcad.Entry)
+	out := make(chan *classifier.Entry, 10)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go Classify(&wg, Config{Count: 4}, c, geoip.NewEnricher(geoip.Config{}), filter.NewSet(nil), in, out)
+
+	go func() {
+		for i := 0; i < 100; i++ {
+			in <- &ipcad.Entry{SrcIP: net.ParseIP("192.168.0.1"), DstIP: net.ParseIP("8.8.8.8"), Bytes: 1}
+		}
+		in <- &ipcad.Entry{SrcIP: net.ParseIP("192.168.0.1"), DstIP: net.ParseIP("192.168.0.2"), Bytes: 1}
+		close(in)
+	}()
+
+	users := make(map[string]int)
+	for e := range out {
+		users[e.UserID+" "+e.Dir+" "+e.Class] = users[e.UserID+" "+e.Dir+" "+e.Class] + 1
+	}
+
+	wg.Wait()
+
+	if users["1 out internet"] != 100 || users["2 in local"] != 1 || users["1 out local"] != 1 {
+		t.Errorf("Classified entries mismatch %v", users)
+	}
+}